@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip46"
 )
 
 var relayurl = getRelayUrl()
@@ -82,6 +84,30 @@ func (e *Event) GetStatus() string {
 	return *e.Status
 }
 
+// NIP-46 remote signer, used instead of room_nsec for rooms whose
+// room_npub is the bunker's key, when NOSTR_BUNKER_URI is set
+var (
+	bunkerOnce   sync.Once
+	bunkerClient *nip46.BunkerClient
+	bunkerErr    error
+)
+
+func getBunker() (*nip46.BunkerClient, error) {
+	bunkerOnce.Do(func() {
+		clientKey := os.Getenv("NOSTR_BUNKER_CLIENT_KEY")
+		if clientKey == "" {
+			clientKey = nostr.GeneratePrivateKey()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		bunkerClient, bunkerErr = nip46.ConnectBunker(ctx, clientKey, os.Getenv("NOSTR_BUNKER_URI"), nil, func(authURL string) {
+			log.Printf("Bunker requires authorization: %s", authURL)
+		})
+	})
+	return bunkerClient, bunkerErr
+}
+
 type RoomInfo struct {
 	RoomNpub     *string `json:"room_npub"`
 	RoomNsec     *string `json:"room_nsec"`
@@ -212,33 +238,75 @@ func sendNewEvent(payload Event, status string) error {
 		return fmt.Errorf("failed to fetch room info: %v", err)
 	}
 
-	// Check if required fields are present
-	if roomInfo.RoomNsec == nil {
-		return fmt.Errorf("room_nsec is required but not set for room %s", payload.RoomName)
-	}
-
 	relays := defaultRelays
 	if roomInfo.RoomRelayURL != nil && *roomInfo.RoomRelayURL != "" {
 		relays = append(relays, *roomInfo.RoomRelayURL)
 	}
 
-	// Decode the private key from nsec
-	prefix, privKey, err := nip19.Decode(*roomInfo.RoomNsec)
-	if err != nil || prefix != "nsec" {
-		return fmt.Errorf("failed to decode nsec or invalid prefix: %v", err)
+	// Each room's events are signed by the room's own key. A bunker only
+	// signs for rooms whose npub is the bunker's key, so one bunker
+	// identity never speaks for every room.
+	var roomPubkey string
+	if roomInfo.RoomNpub != nil && *roomInfo.RoomNpub != "" {
+		prefix, pub, err := nip19.Decode(*roomInfo.RoomNpub)
+		if err != nil || prefix != "npub" {
+			return fmt.Errorf("failed to decode room_npub or invalid prefix: %v", err)
+		}
+		roomPubkey = pub.(string)
 	}
-	sk := privKey.(string)
 
-	// Get public key from private key
-	pk, _ := nostr.GetPublicKey(sk)
+	var event *nostr.Event
+	if os.Getenv("NOSTR_BUNKER_URI") != "" && roomPubkey != "" {
+		// Sign with the NIP-46 bunker so no secret key is needed here
+		bunker, err := getBunker()
+		if err != nil {
+			return fmt.Errorf("failed to connect to bunker: %v", err)
+		}
 
-	event, err := updateNip53(payload, pk, status)
-	if err != nil {
-		return fmt.Errorf("failed to create event: %v", err)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		pk, err := bunker.GetPublicKey(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get public key from bunker: %v", err)
+		}
+
+		if pk == roomPubkey {
+			event, err = updateNip53(payload, pk, status)
+			if err != nil {
+				return fmt.Errorf("failed to create event: %v", err)
+			}
+			if err := bunker.SignEvent(ctx, event); err != nil {
+				return fmt.Errorf("failed to sign event with bunker: %v", err)
+			}
+		}
 	}
+	if event == nil {
+		// Check if required fields are present
+		if roomInfo.RoomNsec == nil {
+			return fmt.Errorf("room_nsec is required but not set for room %s, and its room_npub isn't the bunker's key", payload.RoomName)
+		}
+
+		// Decode the private key from nsec
+		prefix, privKey, err := nip19.Decode(*roomInfo.RoomNsec)
+		if err != nil || prefix != "nsec" {
+			return fmt.Errorf("failed to decode nsec or invalid prefix: %v", err)
+		}
+		sk := privKey.(string)
 
-	// Sign the event with private key
-	event.Sign(sk)
+		// Get public key from private key
+		pk, _ := nostr.GetPublicKey(sk)
+		if roomPubkey != "" && pk != roomPubkey {
+			return fmt.Errorf("room_nsec doesn't match room_npub for room %s", payload.RoomName)
+		}
+
+		event, err = updateNip53(payload, pk, status)
+		if err != nil {
+			return fmt.Errorf("failed to create event: %v", err)
+		}
+
+		// Sign the event with private key
+		event.Sign(sk)
+	}
 
 	// Update the event ID in the database
 	_, err = conn.Exec(context.Background(),
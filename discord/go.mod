@@ -3,8 +3,8 @@ module github.com/bitcarrot/hivetalk/scheduler/discord
 go 1.21
 
 require (
+	github.com/bitcarrot/hivetalk/scheduler/notify v0.0.0
 	github.com/nbd-wtf/go-nostr v0.27.5
-	golang.org/x/time v0.3.0
 )
 
 require (
@@ -25,3 +25,5 @@ require (
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/sys v0.14.0 // indirect
 )
+
+replace github.com/bitcarrot/hivetalk/scheduler/notify => ../notify
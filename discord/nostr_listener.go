@@ -2,31 +2,26 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
-	"golang.org/x/time/rate"
 )
 
-type DiscordWebhookMessage struct {
-	Content string `json:"content"`
-}
-
-// Global rate limiter for Discord webhooks
-var discordLimiter = rate.NewLimiter(rate.Every(time.Second/5), 1) // 5 requests per second max
+// Discord webhook client, which follows Discord's rate limits
+var discordClient = &notify.DiscordClient{}
 
 // Maximum Discord message size
-const maxDiscordMessageSize = 2000
+const maxDiscordMessageSize = notify.MaxContent
 
 // loadEnv loads environment variables from .env file
 func loadEnv() {
@@ -76,12 +71,29 @@ func loadEnv() {
 	}
 }
 
-func truncateMessage(message string, maxSize int) string {
-	if len(message) <= maxSize {
-		return message
+// envBool reads a boolean environment variable, falling back to def
+func envBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return parsed
+}
+
+// outboxDir is the Discord outbox directory, from DISCORD_OUTBOX_DIR
+func outboxDir() string {
+	if dir := os.Getenv("DISCORD_OUTBOX_DIR"); dir != "" {
+		return dir
 	}
-	// Keep some room for the truncation notice
-	return message[:maxSize-50] + "\n... [message truncated due to Discord size limits]"
+	return "discord_outbox"
+}
+
+func truncateMessage(message string, maxSize int) string {
+	return notify.TruncateWith(message, maxSize, "\n... [message truncated due to Discord size limits]")
 }
 
 func listenToNostrEvents() {
@@ -95,6 +107,35 @@ func listenToNostrEvents() {
 		log.Fatal("DISCORD_WEBHOOK environment variable is required")
 	}
 
+	// Rich embeds unless DISCORD_EMBEDS=false asks for plain markdown
+	embeds := envBool("DISCORD_EMBEDS", true)
+
+	// Queue messages on disk, so they survive Discord outages and restarts,
+	// unless DISCORD_OUTBOX=false
+	var outbox *notify.Outbox
+	if envBool("DISCORD_OUTBOX", true) {
+		var err error
+		outbox, err = notify.OpenOutbox(outboxDir(), discordClient)
+		if err != nil {
+			log.Fatalf("Error opening Discord outbox: %v", err)
+		}
+		outbox.MaxAge = 24 * time.Hour
+		if value := os.Getenv("DISCORD_OUTBOX_MAX_AGE"); value != "" {
+			if outbox.MaxAge, err = time.ParseDuration(value); err != nil {
+				log.Fatalf("Invalid DISCORD_OUTBOX_MAX_AGE %q: %v", value, err)
+			}
+		}
+		log.Printf("Queueing Discord messages in %s", outbox.Dir)
+		go outbox.Run(context.Background())
+	}
+
+	// Log delivery stats every hour
+	go func() {
+		for range time.Tick(time.Hour) {
+			discordClient.LogStats()
+		}
+	}()
+
 	for {
 		log.Printf("Connecting to relay %s...", relayURL)
 
@@ -129,56 +170,34 @@ func listenToNostrEvents() {
 		for event := range sub.Events {
 			log.Printf("Received NIP-53 event with ID: %s, Kind: %d", event.ID, event.Kind)
 
-			// Format the message first
-			formattedMsg := formatNostrMessage(event, nil)
-			// Check if adding the full JSON would exceed the limit
-			// omit jsonPart for now
-			//jsonPart := "\n\n**Original Event JSON:**\n```json\n" + prettyJSON(event) + "\n```"
-			fullMsg := formattedMsg //+ jsonPart
-			// If the full message is too long, truncate the JSON part or omit it
-			if len(fullMsg) > maxDiscordMessageSize {
-				if len(formattedMsg) > maxDiscordMessageSize {
-					// Even the formatted message is too long
-					formattedMsg = truncateMessage(formattedMsg, maxDiscordMessageSize)
-					fullMsg = formattedMsg
-				} else {
-					// Try to include a truncated JSON
-					remaining := maxDiscordMessageSize - len(formattedMsg) - 50 // 50 chars for wrapper and truncation notice
-					if remaining > 100 { // Only include JSON if we have reasonable space
-						truncatedJSON := prettyJSON(event)
-						if len(truncatedJSON) > remaining {
-							truncatedJSON = truncatedJSON[:remaining] + "...\n[truncated]"
-						}
-						fullMsg = formattedMsg + "\n\n**Original Event JSON (truncated):**\n```json\n" + truncatedJSON + "\n```"
-					} else {
-						// Not enough space for JSON
-						fullMsg = formattedMsg + "\n\n*Event JSON omitted due to size constraints*"
-					}
-				}
-			}
-
 			// Create Discord message
-			message := DiscordWebhookMessage{
-				Content: fullMsg,
+			var message notify.DiscordWebhookMessage
+			if embeds {
+				message = notify.DiscordMessages([]notify.DiscordEmbed{nostrEmbed(event)})[0]
+			} else {
+				message = notify.DiscordWebhookMessage{Content: plainNostrMessage(event)}
 			}
 
-			// Wait for rate limiter before sending
-			if err := discordLimiter.Wait(ctx); err != nil {
-				log.Printf("Rate limiter error: %v", err)
+			// Queue it for Discord, where the outbox retries until it's
+			// delivered
+			if outbox != nil {
+				if err := outbox.Post(discordWebhook, "", message); err != nil {
+					log.Printf("Failed to queue event %s for Discord: %v", event.ID, err)
+				} else {
+					log.Printf("Queued event %s for Discord", event.ID)
+				}
+				continue
 			}
-			// Send to Discord with retries
-			for retries := 0; retries < 3; retries++ {
-				if err := sendToDiscord(discordWebhook, message); err != nil {
-					if retries < 2 {
-						log.Printf("Failed to send to Discord: %v. Retrying in 2 seconds...", err)
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					log.Printf("Failed to send to Discord after 3 attempts: %v", err)
+
+			// Send to Discord; the client waits out rate limits and retries
+			if err := discordClient.Post(ctx, discordWebhook, message); err != nil {
+				if notify.IsPermanent(err) {
+					log.Printf("Discord rejected event %s, check DISCORD_WEBHOOK: %v", event.ID, err)
 				} else {
-					log.Printf("Successfully sent event %s to Discord", event.ID)
-					break
+					log.Printf("Failed to send event %s to Discord: %v", event.ID, err)
 				}
+			} else {
+				log.Printf("Successfully sent event %s to Discord", event.ID)
 			}
 		}
 
@@ -189,140 +208,250 @@ func listenToNostrEvents() {
 	}
 }
 
-func formatNostrMessage(event *nostr.Event, content map[string]interface{}) string {
-	// Get important tags
-	var title, summary, image, status, starts, ends, streaming, service, room string
-	var participants []string
-
-	// Convert pubkey to npub
-	npub, _ := nip19.EncodePublicKey(event.PubKey)
-	authorNpub := npub[:8] + "..." // Take first 8 chars
+// The NIP-53 tags of a live activity, meeting space or meeting event
+type liveEvent struct {
+	title, summary, image, status, streaming, service, room string
+	starts, ends                                            time.Time
+	currentParticipants                                     string
+	participants                                            []liveParticipant
+}
 
-	// Determine kind description
-	kindDescription := "Unknown"
-	switch event.Kind {
-	case 30311:
-		kindDescription = "Live Activities"
-	case 30312:
-		kindDescription = "Interactive Rooms"
-	case 30313:
-		kindDescription = "Scheduled Meeting Room"
-	}
+type liveParticipant struct {
+	npub, role string
+}
 
+func parseLiveEvent(event *nostr.Event) liveEvent {
+	var info liveEvent
 	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
 		switch tag[0] {
 		case "title":
-			title = tag[1]
+			info.title = tag[1]
 		case "summary":
-			summary = tag[1]
+			info.summary = tag[1]
 		case "image":
-			image = tag[1]
+			info.image = tag[1]
 		case "status":
-			status = tag[1]
+			info.status = tag[1]
 		case "streaming":
-			streaming = tag[1]
+			info.streaming = tag[1]
 		case "starts":
 			if t, err := strconv.ParseInt(tag[1], 10, 64); err == nil {
-				starts = time.Unix(t, 0).Format(time.RFC1123)
+				info.starts = time.Unix(t, 0)
 			}
 		case "ends":
 			if t, err := strconv.ParseInt(tag[1], 10, 64); err == nil {
-				ends = time.Unix(t, 0).Format(time.RFC1123)
+				info.ends = time.Unix(t, 0)
 			}
 		case "service":
-			service = tag[1]
+			info.service = tag[1]
 		case "room":
-			room = tag[1]
+			info.room = tag[1]
+		case "current_participants":
+			info.currentParticipants = tag[1]
 		case "p":
 			role := "owner"
 			if len(tag) >= 4 {
 				role = tag[3]
 			}
 			npub, _ := nip19.EncodePublicKey(tag[1])
-			njump := "https://njump.me/" + npub
-			participants = append(participants, fmt.Sprintf("%s (%s)", njump, role))
-			//participants = append(participants, fmt.Sprintf("%s (%s)", tag[1][:8], role))
+			info.participants = append(info.participants, liveParticipant{npub: npub, role: role})
 		}
 	}
+	return info
+}
+
+func kindDescription(kind int) string {
+	switch kind {
+	case 30311:
+		return "Live Activities"
+	case 30312:
+		return "Interactive Rooms"
+	case 30313:
+		return "Scheduled Meeting Room"
+	}
+	return "Unknown"
+}
+
+func statusEmoji(status string) string {
+	switch status {
+	case "planned":
+		return "📅"
+	case "live", "open":
+		return "🟢"
+	case "private":
+		return "🔒"
+	case "ended", "closed":
+		return "🔴"
+	}
+	return "🔄"
+}
+
+func formatNostrMessage(event *nostr.Event, content map[string]interface{}) string {
+	info := parseLiveEvent(event)
+
+	// Convert pubkey to npub
+	npub, _ := nip19.EncodePublicKey(event.PubKey)
+	authorNpub := notify.TruncateWith(npub, 8, "") + "..." // Take first 8 chars
 
 	// Build message
 	var msg strings.Builder
 	msg.WriteString("\n ===== 🎯 **New Nostr Event Update** ======\n\n")
 
 	msg.WriteString(fmt.Sprintf("👤 **Author:** %s\n", authorNpub))
-	msg.WriteString(fmt.Sprintf("🔢 **Kind:** %d - %s\n", event.Kind, kindDescription))
-
-	if title != "" {
-		msg.WriteString(fmt.Sprintf("📌 **Title:** %s\n", title))
-	}
-	if summary != "" {
-		msg.WriteString(fmt.Sprintf("📝 **Summary:** %s\n", summary))
-	}
-	if status != "" {
-		emoji := "🔄"
-		switch status {
-		case "planned":
-			emoji = "📅"
-		case "live":
-			emoji = "🟢"
-		case "ended":
-			emoji = "🔴"
-		}
-		msg.WriteString(fmt.Sprintf("%s **Status:** %s\n", emoji, status))
+	msg.WriteString(fmt.Sprintf("🔢 **Kind:** %d - %s\n", event.Kind, kindDescription(event.Kind)))
+
+	if info.title != "" {
+		msg.WriteString(fmt.Sprintf("📌 **Title:** %s\n", info.title))
 	}
-	if streaming != "" {
-		msg.WriteString(fmt.Sprintf("🎥 **Stream:** %s\n", streaming))
+	if info.summary != "" {
+		msg.WriteString(fmt.Sprintf("📝 **Summary:** %s\n", info.summary))
 	}
-	if starts != "" {
-		msg.WriteString(fmt.Sprintf("⏰ **Starts:** %s\n", starts))
+	if info.status != "" {
+		msg.WriteString(fmt.Sprintf("%s **Status:** %s\n", statusEmoji(info.status), info.status))
 	}
-	if ends != "" {
-		msg.WriteString(fmt.Sprintf("🏁 **Ends:** %s\n", ends))
+	if info.streaming != "" {
+		msg.WriteString(fmt.Sprintf("🎥 **Stream:** %s\n", info.streaming))
 	}
-	if service != "" {
-		msg.WriteString(fmt.Sprintf("🔗 **Service:** %s\n", service))
+	if !info.starts.IsZero() {
+		msg.WriteString(fmt.Sprintf("⏰ **Starts:** %s\n", notify.DiscordTimestamp(info.starts, 'F')))
 	}
-	if room != "" {
-		msg.WriteString(fmt.Sprintf("🏠 **Room:** %s\n", room))
+	if !info.ends.IsZero() {
+		msg.WriteString(fmt.Sprintf("🏁 **Ends:** %s\n", notify.DiscordTimestamp(info.ends, 'F')))
 	}
-	if len(participants) > 0 {
+	if info.service != "" {
+		msg.WriteString(fmt.Sprintf("🔗 **Service:** %s\n", info.service))
+	}
+	if info.room != "" {
+		msg.WriteString(fmt.Sprintf("🏠 **Room:** %s\n", info.room))
+	}
+	if len(info.participants) > 0 {
+		participants := make([]string, 0, len(info.participants))
+		for _, p := range info.participants {
+			participants = append(participants, fmt.Sprintf("https://njump.me/%s (%s)", p.npub, p.role))
+		}
 		msg.WriteString(fmt.Sprintf("👥 **Participants:** %s\n", strings.Join(participants, ", ")))
 	}
-	if image != "" {
-		msg.WriteString(fmt.Sprintf("\n%s", image))
+	if info.image != "" {
+		msg.WriteString(fmt.Sprintf("\n%s", info.image))
 	}
 
 	return msg.String()
 }
 
-func prettyJSON(v interface{}) string {
-	b, err := json.MarshalIndent(v, "", "  ")
-	if err != nil {
-		return fmt.Sprintf("%v", v)
+// plainNostrMessage is the markdown message for an event when embeds are
+// off, with as much of the event JSON as fits
+func plainNostrMessage(event *nostr.Event) string {
+	formattedMsg := formatNostrMessage(event, nil)
+	// Check if adding the full JSON would exceed the limit
+	// omit jsonPart for now
+	//jsonPart := "\n\n**Original Event JSON:**\n```json\n" + prettyJSON(event) + "\n```"
+	fullMsg := formattedMsg //+ jsonPart
+	// If the full message is too long, truncate the JSON part or omit it
+	if utf8.RuneCountInString(fullMsg) > maxDiscordMessageSize {
+		formattedLen := utf8.RuneCountInString(formattedMsg)
+		if formattedLen > maxDiscordMessageSize {
+			// Even the formatted message is too long
+			fullMsg = truncateMessage(formattedMsg, maxDiscordMessageSize)
+		} else {
+			// Try to include a truncated JSON
+			// 50 chars for wrapper and truncation notice
+			remaining := maxDiscordMessageSize - formattedLen - 50
+			if remaining > 100 { // Only include JSON if we have reasonable space
+				truncatedJSON := notify.TruncateWith(prettyJSON(event), remaining, "...\n[truncated]")
+				fullMsg = formattedMsg + "\n\n**Original Event JSON (truncated):**\n```json\n" + truncatedJSON + "\n```"
+			} else {
+				// Not enough space for JSON
+				fullMsg = formattedMsg + "\n\n*Event JSON omitted due to size constraints*"
+			}
+		}
 	}
-	return string(b)
+	return fullMsg
 }
 
-func sendToDiscord(webhookURL string, message DiscordWebhookMessage) error {
-	payload, err := json.Marshal(message)
-	if err != nil {
-		return err
+// nostrEmbed is the rich embed for an event: the title links to the
+// room's service URL (or the stream), the color follows the status, the
+// image tag is the thumbnail and starts/ends show in each reader's time
+// zone
+func nostrEmbed(event *nostr.Event) notify.DiscordEmbed {
+	info := parseLiveEvent(event)
+
+	title := info.title
+	if title == "" {
+		title = info.room
+	}
+	if title == "" {
+		title = "New Nostr Event Update"
+	}
+	embed := notify.DiscordEmbed{
+		Title:       fmt.Sprintf("%s %s", statusEmoji(info.status), title),
+		Description: info.summary,
+		URL:         info.service,
+		Color:       notify.StatusColor(info.status),
+		Timestamp:   event.CreatedAt.Time().UTC().Format(time.RFC3339),
+		Footer:      &notify.DiscordEmbedFooter{Text: fmt.Sprintf("Kind %d - %s", event.Kind, kindDescription(event.Kind))},
+	}
+	if embed.URL == "" {
+		embed.URL = info.streaming
+	}
+	if info.image != "" {
+		embed.Thumbnail = &notify.DiscordEmbedImage{URL: info.image}
 	}
 
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		return err
+	embed.AddField("Status", info.status, true)
+	embed.AddField("Participants", info.currentParticipants, true)
+	if npub, err := nip19.EncodePublicKey(event.PubKey); err == nil {
+		embed.AddField("Author", fmt.Sprintf("[%s...](https://njump.me/%s)", npub[:12], npub), true)
+	}
+	if !info.starts.IsZero() {
+		embed.AddField("Starts", notify.DiscordTimestamp(info.starts, 'F'), true)
+	}
+	if !info.ends.IsZero() {
+		embed.AddField("Ends", notify.DiscordTimestamp(info.ends, 'F'), true)
+	}
+	if info.room != "" && info.room != title {
+		embed.AddField("Room", info.room, true)
+	}
+	if info.streaming != "" && info.streaming != embed.URL {
+		embed.AddField("Stream", info.streaming, false)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("discord webhook returned status: %d", resp.StatusCode)
+	// One line per listed participant, as many as fit in a field
+	lines := []string{}
+	size := 0
+	for i, p := range info.participants {
+		line := fmt.Sprintf("[%s...](https://njump.me/%s) %s", notify.TruncateWith(p.npub, 12, ""), p.npub, p.role)
+		if size+len(line)+1 > notify.MaxFieldValue-20 {
+			lines = append(lines, fmt.Sprintf("and %d more", len(info.participants)-i))
+			break
+		}
+		lines = append(lines, line)
+		size += len(line) + 1
 	}
+	embed.AddField("Hosts and speakers", strings.Join(lines, "\n"), false)
+	return embed
+}
 
-	return nil
+func prettyJSON(v interface{}) string {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
 }
 
 func main() {
+	// outbox list|replay|purge ... inspects the Discord outbox instead
+	if len(os.Args) > 1 && os.Args[1] == "outbox" {
+		loadEnv()
+		if err := notify.OutboxCommand(outboxDir(), os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
 	log.Println("Starting Nostr event listener...")
 	// Load environment variables from .env file
 	loadEnv()
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testPubkey() string {
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	return pubkey
+}
+
+func TestNostrEmbed(t *testing.T) {
+	event := &nostr.Event{
+		PubKey:    testPubkey(),
+		CreatedAt: 1749578400,
+		Kind:      30312,
+		Tags: nostr.Tags{
+			{"title", "Builders"},
+			{"summary", "Weekly call"},
+			{"status", "open"},
+			{"starts", "1749578400"},
+			{"ends", "1749582000"},
+			{"service", "https://hivetalk.org/join/Builders"},
+			{"image", "https://hivetalk.org/builders.png"},
+		},
+	}
+	// More hosts than fit in one field
+	for i := 0; i < 50; i++ {
+		event.Tags = append(event.Tags, nostr.Tag{"p", testPubkey(), "", "Speaker"})
+	}
+
+	embed := nostrEmbed(event)
+	if embed.Title != "🟢 Builders" || embed.URL != "https://hivetalk.org/join/Builders" || embed.Color != notify.StatusColor("open") {
+		t.Errorf("title %q, URL %q, color %d", embed.Title, embed.URL, embed.Color)
+	}
+	if embed.Thumbnail == nil || embed.Thumbnail.URL != "https://hivetalk.org/builders.png" {
+		t.Errorf("thumbnail %+v", embed.Thumbnail)
+	}
+	fields := map[string]string{}
+	for _, field := range embed.Fields {
+		fields[field.Name] = field.Value
+		if utf8.RuneCountInString(field.Value) > notify.MaxFieldValue {
+			t.Errorf("field %s is %d characters long", field.Name, utf8.RuneCountInString(field.Value))
+		}
+	}
+	if fields["Starts"] != "<t:1749578400:F>" || fields["Ends"] != "<t:1749582000:F>" {
+		t.Errorf("starts %q, ends %q", fields["Starts"], fields["Ends"])
+	}
+	hosts := strings.Split(fields["Hosts and speakers"], "\n")
+	last := hosts[len(hosts)-1]
+	if want := fmt.Sprintf("and %d more", 50-(len(hosts)-1)); last != want {
+		t.Errorf("hosts field ends with %q, want %q", last, want)
+	}
+}
+
+func TestPlainNostrMessage(t *testing.T) {
+	event := &nostr.Event{
+		PubKey: testPubkey(),
+		Kind:   30312,
+		Tags:   nostr.Tags{{"title", "Builders"}, {"status", "open"}},
+	}
+	if got := plainNostrMessage(event); got != formatNostrMessage(event, nil) || strings.Contains(got, "truncated") {
+		t.Errorf("short message changed: %q", got)
+	}
+
+	// A summary longer than a whole message is cut at a character
+	// boundary, with a notice
+	event.Tags = append(event.Tags, nostr.Tag{"summary", strings.Repeat("🐝", notify.MaxContent)})
+	got := plainNostrMessage(event)
+	if n := utf8.RuneCountInString(got); n > maxDiscordMessageSize {
+		t.Errorf("message is %d characters long", n)
+	}
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, "[message truncated due to Discord size limits]") {
+		t.Errorf("truncated message ends with %q", got[len(got)-60:])
+	}
+}
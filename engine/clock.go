@@ -0,0 +1,77 @@
+// Package engine holds the poll/diff/publish machinery shared by the room
+// pollers: a loop that polls a RoomSource with backoff, the close grace
+// and re-open hysteresis state machine, publishing to relays, and the
+// room state stores, signers, d tags, heartbeats and reconciliation with
+// relays both pollers need. Time,
+// room sources and publishing are all behind interfaces so the state
+// machine can be driven from tests.
+package engine
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits. SystemClock is the real one; tests use
+// a FakeClock.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, returning early if ctx is cancelled
+	Sleep(ctx context.Context, d time.Duration)
+}
+
+// SystemClock is the wall clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// FakeClock only moves when told to. Sleep advances it instead of
+// waiting, so a poll loop runs as fast as it can.
+type FakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *FakeClock) Sleep(ctx context.Context, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+}
+
+// Slept returns every duration Sleep was called with, in order
+func (c *FakeClock) Slept() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.slept...)
+}
@@ -0,0 +1,51 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Length of derived d tags, in hex characters
+const derivedDTagLength = 20
+
+// DTagDeriver derives a room's d tag as a keyed hash of the server URL and
+// room ID, so every poller sharing the secret assigns the same d tag
+type DTagDeriver struct {
+	secret    []byte
+	serverURL string
+}
+
+// NewDTagDeriver derives d tags for serverURL's rooms keyed with secret
+func NewDTagDeriver(secret, serverURL string) *DTagDeriver {
+	return &DTagDeriver{secret: []byte(secret), serverURL: serverURL}
+}
+
+// Derive returns the d tag for a room
+func (d *DTagDeriver) Derive(roomID string) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(strings.TrimRight(d.serverURL, "/")))
+	mac.Write([]byte{0})
+	mac.Write([]byte(roomID))
+	return hex.EncodeToString(mac.Sum(nil))[:derivedDTagLength]
+}
+
+// NewDTagDeriverFromEnv sets up d tag derivation from DTAG_MODE ("random",
+// the default, or "hmac") and DTAG_SECRET. Returns nil in random mode.
+func NewDTagDeriverFromEnv(serverURL string) (*DTagDeriver, error) {
+	switch mode := os.Getenv("DTAG_MODE"); mode {
+	case "", "random":
+		return nil, nil
+	case "hmac":
+		secret := os.Getenv("DTAG_SECRET")
+		if secret == "" {
+			return nil, fmt.Errorf("DTAG_SECRET is required when DTAG_MODE is hmac")
+		}
+		return NewDTagDeriver(secret, serverURL), nil
+	default:
+		return nil, fmt.Errorf("unknown DTAG_MODE %q (expected random or hmac)", mode)
+	}
+}
@@ -0,0 +1,48 @@
+package engine
+
+import "testing"
+
+func TestDTagDeriver(t *testing.T) {
+	d := NewDTagDeriver("secret", "https://hivetalk.org")
+	lobby := d.Derive("Lobby")
+	if len(lobby) != derivedDTagLength {
+		t.Errorf("d tag %q has length %d, want %d", lobby, len(lobby), derivedDTagLength)
+	}
+
+	// Pollers sharing the secret agree, whatever the trailing slash
+	if got := NewDTagDeriver("secret", "https://hivetalk.org/").Derive("Lobby"); got != lobby {
+		t.Errorf("with a trailing slash: %s, want %s", got, lobby)
+	}
+	for name, other := range map[string]string{
+		"another room":   d.Derive("Lobby2"),
+		"another server": NewDTagDeriver("secret", "https://other.hivetalk.org").Derive("Lobby"),
+		"another secret": NewDTagDeriver("other", "https://hivetalk.org").Derive("Lobby"),
+		// The separator keeps the URL and room ID from running together
+		"shifted boundary": NewDTagDeriver("secret", "https://hivetalk.or").Derive("gLobby"),
+	} {
+		if other == lobby {
+			t.Errorf("%s gets the same d tag %s", name, lobby)
+		}
+	}
+}
+
+func TestDTagDeriverFromEnv(t *testing.T) {
+	tests := []struct {
+		mode, secret string
+		derive, fail bool
+	}{
+		{"", "", false, false},
+		{"random", "secret", false, false},
+		{"hmac", "secret", true, false},
+		{"hmac", "", false, true},
+		{"sequential", "secret", false, true},
+	}
+	for _, test := range tests {
+		t.Setenv("DTAG_MODE", test.mode)
+		t.Setenv("DTAG_SECRET", test.secret)
+		d, err := NewDTagDeriverFromEnv("https://hivetalk.org")
+		if (err != nil) != test.fail || (d != nil) != test.derive {
+			t.Errorf("DTAG_MODE=%q DTAG_SECRET=%q: deriver %v, err %v", test.mode, test.secret, d, err)
+		}
+	}
+}
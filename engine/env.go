@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvBool reads a boolean environment variable, falling back to def
+func EnvBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return b
+}
+
+// EnvInt reads an integer environment variable, falling back to def
+func EnvInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return n
+}
+
+// EnvDuration reads a duration environment variable (e.g. 90s, 5m),
+// falling back to def
+func EnvDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return d
+}
+
+// ParseRelayURLs splits a comma-separated RELAY_URLS value
+func ParseRelayURLs(value string) []string {
+	relayURLs := []string{}
+	for _, url := range strings.Split(value, ",") {
+		url = strings.TrimSpace(url)
+		if url != "" {
+			relayURLs = append(relayURLs, url)
+		}
+	}
+	return relayURLs
+}
+
+// StatePathFromEnv returns the room state store kind and path from
+// STATE_STORE and STATE_PATH. The path defaults to name.json, or name.db
+// for the bolt store.
+func StatePathFromEnv(name string) (storeKind, statePath string) {
+	storeKind = os.Getenv("STATE_STORE")
+	statePath = os.Getenv("STATE_PATH")
+	if statePath == "" {
+		statePath = name + ".json"
+		if storeKind == "bolt" {
+			statePath = name + ".db"
+		}
+	}
+	return storeKind, statePath
+}
@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// HeartbeatExpiration is the NIP-40 expiration for a room event published
+// at now, slightly beyond the next heartbeat so a live room never lapses
+// between republishes. Zero (no expiration) when heartbeats are off or
+// the room is closed.
+func HeartbeatExpiration(now time.Time, heartbeat time.Duration, status string) time.Time {
+	if heartbeat <= 0 || !Live(status) {
+		return time.Time{}
+	}
+	return now.Add(heartbeat + heartbeat/2)
+}
+
+// HeartbeatDue reports whether a room last published at lastPublished
+// should be republished at now. Only live rooms the last successful poll,
+// at lastPoll, saw are due, and only while that poll is no more than a
+// heartbeat old: when the source stops answering, heartbeats stop too and
+// rooms expire on relays instead of being kept alive on stale state.
+func HeartbeatDue(now time.Time, heartbeat time.Duration, state RoomState, lastPublished, lastPoll time.Time) bool {
+	if !Live(state.Status) || now.Sub(lastPublished) < heartbeat {
+		return false
+	}
+	if lastPoll.IsZero() || now.Sub(lastPoll) > heartbeat {
+		return false
+	}
+	return !state.LastSeen.Before(lastPoll)
+}
+
+// RunHeartbeat calls republish four times per heartbeat until ctx is
+// cancelled, so live rooms' expirations keep moving forward while the
+// poller is alive and they age out on relays if it dies
+func RunHeartbeat(ctx context.Context, heartbeat time.Duration, republish func(ctx context.Context)) {
+	ticker := time.NewTicker(heartbeat / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			republish(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeatDue(t *testing.T) {
+	heartbeat := 10 * time.Minute
+	now := epoch.Add(time.Hour)
+	lastPoll := now.Add(-time.Minute)
+	published := now.Add(-heartbeat)
+
+	tests := []struct {
+		name      string
+		state     RoomState
+		published time.Time
+		lastPoll  time.Time
+		want      bool
+	}{
+		{"seen by the last poll", RoomState{Status: "open", LastSeen: lastPoll}, published, lastPoll, true},
+		{"private", RoomState{Status: "private", LastSeen: lastPoll}, published, lastPoll, true},
+		{"published recently", RoomState{Status: "open", LastSeen: lastPoll}, now.Add(-time.Minute), lastPoll, false},
+		{"closed", RoomState{Status: "closed", LastSeen: lastPoll}, published, lastPoll, false},
+		{"missing from the last poll", RoomState{Status: "open", LastSeen: lastPoll.Add(-time.Minute)}, published, lastPoll, false},
+		{"no successful poll yet", RoomState{Status: "open", LastSeen: lastPoll}, published, time.Time{}, false},
+		{"polls failing for a heartbeat", RoomState{Status: "open", LastSeen: now.Add(-11 * time.Minute)}, published, now.Add(-11 * time.Minute), false},
+	}
+	for _, test := range tests {
+		if got := HeartbeatDue(now, heartbeat, test.state, test.published, test.lastPoll); got != test.want {
+			t.Errorf("%s: HeartbeatDue = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// RoomSource lists the rooms live on one provider, such as the vanilla
+// meetings API or the honey room list. T is the provider's snapshot type.
+type RoomSource[T any] interface {
+	// Name identifies the source in logs, e.g. its API URL
+	Name() string
+	// Fetch returns a full snapshot of the provider's rooms
+	Fetch(ctx context.Context) (T, error)
+}
+
+// Loop polls a RoomSource every Interval and hands each snapshot to Apply.
+// After a failed fetch it waits Interval, doubling with each further
+// failure up to MaxBackoff.
+type Loop[T any] struct {
+	Source     RoomSource[T]
+	Apply      func(ctx context.Context, snapshot T)
+	Clock      Clock // SystemClock when nil
+	Interval   time.Duration
+	MaxBackoff time.Duration
+}
+
+// Run polls until ctx is cancelled
+func (l *Loop[T]) Run(ctx context.Context) {
+	clock := l.clock()
+	log.Printf("Polling %s every %v", l.Source.Name(), l.Interval)
+
+	failures := 0
+	for ctx.Err() == nil {
+		if err := l.Poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			delay := Backoff(l.Interval, l.MaxBackoff, failures)
+			log.Printf("Error fetching rooms from %s (%d in a row), retrying in %v: %v", l.Source.Name(), failures, delay, err)
+			clock.Sleep(ctx, delay)
+			continue
+		}
+		failures = 0
+
+		log.Printf("Sleeping for %v before next poll of %s", l.Interval, l.Source.Name())
+		clock.Sleep(ctx, l.Interval)
+	}
+}
+
+// Poll fetches one snapshot and applies it
+func (l *Loop[T]) Poll(ctx context.Context) error {
+	log.Printf("Polling %s for rooms...", l.Source.Name())
+	snapshot, err := l.Source.Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	l.Apply(ctx, snapshot)
+	return nil
+}
+
+func (l *Loop[T]) clock() Clock {
+	if l.Clock == nil {
+		return SystemClock
+	}
+	return l.Clock
+}
+
+// Backoff is how long to wait after a number of consecutive fetch errors:
+// the poll interval, doubling with each further error up to maxBackoff
+func Backoff(interval, maxBackoff time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff && maxBackoff > interval {
+		delay = maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,87 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// scriptedSource returns a fixed sequence of results, then cancels the
+// loop running it
+type scriptedSource struct {
+	results []error
+	cancel  context.CancelFunc
+	fetches int
+}
+
+func (s *scriptedSource) Name() string {
+	return "scripted"
+}
+
+func (s *scriptedSource) Fetch(ctx context.Context) (int, error) {
+	if s.fetches == len(s.results) {
+		s.cancel()
+		return 0, ctx.Err()
+	}
+	err := s.results[s.fetches]
+	s.fetches++
+	return s.fetches, err
+}
+
+func TestLoopBacksOffOnErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fail := errors.New("unreachable")
+	source := &scriptedSource{
+		results: []error{nil, fail, fail, fail, fail, nil, fail},
+		cancel:  cancel,
+	}
+	clock := NewFakeClock(epoch)
+	applied := []int{}
+	loop := &Loop[int]{
+		Source:     source,
+		Apply:      func(ctx context.Context, n int) { applied = append(applied, n) },
+		Clock:      clock,
+		Interval:   time.Minute,
+		MaxBackoff: 5 * time.Minute,
+	}
+	loop.Run(ctx)
+
+	if want := []int{1, 6}; !reflect.DeepEqual(applied, want) {
+		t.Errorf("applied snapshots %v, want %v", applied, want)
+	}
+	want := []time.Duration{
+		time.Minute,     // after success
+		time.Minute,     // first error
+		2 * time.Minute, // second
+		4 * time.Minute, // third
+		5 * time.Minute, // capped
+		time.Minute,     // success resets the backoff
+		time.Minute,     // first error again
+	}
+	if got := clock.Slept(); !reflect.DeepEqual(got, want) {
+		t.Errorf("slept %v, want %v", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		interval, maxBackoff time.Duration
+		failures             int
+		want                 time.Duration
+	}{
+		{time.Minute, 15 * time.Minute, 1, time.Minute},
+		{time.Minute, 15 * time.Minute, 4, 8 * time.Minute},
+		{time.Minute, 15 * time.Minute, 10, 15 * time.Minute},
+		// A max below the interval never shortens the wait
+		{time.Minute, 30 * time.Second, 3, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.interval, tt.maxBackoff, tt.failures); got != tt.want {
+			t.Errorf("Backoff(%v, %v, %d) = %v, want %v", tt.interval, tt.maxBackoff, tt.failures, got, tt.want)
+		}
+	}
+}
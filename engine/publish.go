@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Publisher sends signed events somewhere, normally to Nostr relays
+type Publisher interface {
+	Publish(ctx context.Context, ev nostr.Event) error
+}
+
+// RelayPublisher sends each event to every relay in turn. A relay that
+// can't be reached or rejects the event is logged and skipped.
+type RelayPublisher struct {
+	URLs []string
+}
+
+func (p RelayPublisher) Publish(ctx context.Context, ev nostr.Event) error {
+	for _, url := range p.URLs {
+		// Stop early if we're shutting down
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Trim any whitespace
+		url = strings.TrimSpace(url)
+		log.Printf("Connecting to relay: %s", url)
+
+		// Create a timeout context for each relay connection
+		relayCtx, relayCancel := context.WithTimeout(ctx, 10*time.Second)
+
+		relay, err := nostr.RelayConnect(relayCtx, url)
+		if err != nil {
+			log.Printf("Error connecting to relay %s: %v\n", url, err)
+			relayCancel() // Cancel context if connection fails
+			continue
+		}
+
+		err = relay.Publish(relayCtx, ev)
+
+		// Always close the relay and cancel context when done
+		relay.Close()
+		relayCancel()
+
+		if err != nil {
+			log.Printf("Error publishing to %s: %v\n", url, err)
+			continue
+		}
+		log.Printf("Published kind %d event %s to %s\n", ev.Kind, ev.ID, url)
+	}
+
+	return nil
+}
+
+// Tags every poller generates itself, which event templates and room
+// policies can't set
+var reservedTags = map[string]bool{
+	"d": true, "room": true, roomIDTagName: true, "status": true, "p": true, "zap": true, "relays": true, "expiration": true,
+	"current_participants": true, "total_participants": true,
+}
+
+// ReservedTag reports whether a tag name is one the poller generates
+// itself, so templates and policies can't set it
+func ReservedTag(name string) bool {
+	return reservedTags[name]
+}
+
+// WithoutTag returns a copy of tags leaving out every tag called name
+func WithoutTag(tags nostr.Tags, name string) nostr.Tags {
+	kept := nostr.Tags{}
+	for _, tag := range tags {
+		if len(tag) > 0 && tag[0] != name {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// ParticipantTags are a room's NIP-53 current_participants and
+// total_participants tags: both while it is live, and the session total
+// once it has closed
+func ParticipantTags(status string, counts ParticipantCounts) nostr.Tags {
+	tags := nostr.Tags{}
+	if Live(status) {
+		tags = append(tags, nostr.Tag{"current_participants", strconv.Itoa(counts.Current)})
+	}
+	if counts.Total > 0 {
+		tags = append(tags, nostr.Tag{"total_participants", strconv.Itoa(counts.Total)})
+	}
+	return tags
+}
@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Most 30312 events to ask each relay for when rebuilding state
+const reconcileQueryLimit = 1000
+
+// Name of the tag recording which room on which server an event
+// announces, ["hivetalk_room", <room ID>, <server URL>]. The room tag is
+// only a display name that templates can change, so reconciliation keys
+// off this one, which templates and policies can't set.
+const roomIDTagName = "hivetalk_room"
+
+// RoomIDTag is the tag identifying a room on a server in its 30312 events
+func RoomIDTag(roomID, serverURL string) nostr.Tag {
+	return nostr.Tag{roomIDTagName, roomID, strings.TrimRight(serverURL, "/")}
+}
+
+// AnnouncedRoom is a room as last announced by the bot on relays
+type AnnouncedRoom struct {
+	DTag      string
+	RoomID    string
+	Name      string // the room tag
+	Status    string
+	CreatedAt nostr.Timestamp
+
+	// Announced before RoomIDTag was added, so RoomID is the room tag
+	Legacy bool
+}
+
+// FetchAnnouncedRooms fetches the newest 30312 event per d tag that pubkey
+// has published to any of the relays for rooms on serverURL, newest
+// first. Pollers sharing a key only see their own server's rooms. Events
+// without a RoomIDTag, from before it was added, are left out unless
+// legacyRoomTag is set; then their room tag stands in for the room ID,
+// which is only safe while the template renders the room tag as it
+// always has.
+func FetchAnnouncedRooms(ctx context.Context, pubkey, serverURL string, relayURLs []string, legacyRoomTag bool) ([]AnnouncedRoom, error) {
+	serverURL = strings.TrimRight(serverURL, "/")
+	latest := make(map[string]AnnouncedRoom)
+	answered := 0
+
+	for _, url := range relayURLs {
+		url = strings.TrimSpace(url)
+		relayCtx, relayCancel := context.WithTimeout(ctx, 10*time.Second)
+
+		relay, err := nostr.RelayConnect(relayCtx, url)
+		if err != nil {
+			log.Printf("Error connecting to relay %s: %v", url, err)
+			relayCancel()
+			continue
+		}
+
+		events, err := relay.QuerySync(relayCtx, nostr.Filter{
+			Kinds:   []int{30312},
+			Authors: []string{pubkey},
+			Limit:   reconcileQueryLimit,
+		})
+		relay.Close()
+		relayCancel()
+		if err != nil {
+			log.Printf("Error querying relay %s: %v", url, err)
+			continue
+		}
+		answered++
+
+		for _, ev := range events {
+			// Relays should only return our own events, but don't trust them
+			if ev.PubKey != pubkey {
+				continue
+			}
+			if ok, _ := ev.CheckSignature(); !ok {
+				continue
+			}
+			room := AnnouncedRoom{CreatedAt: ev.CreatedAt}
+			if tag := ev.Tags.GetFirst([]string{"d", ""}); tag != nil {
+				room.DTag = (*tag)[1]
+			}
+			if tag := ev.Tags.GetFirst([]string{"room", ""}); tag != nil {
+				room.Name = (*tag)[1]
+			}
+			if tag := ev.Tags.GetFirst([]string{roomIDTagName, ""}); tag != nil {
+				if len(*tag) > 2 && (*tag)[2] == serverURL {
+					room.RoomID = (*tag)[1]
+				}
+			} else if legacyRoomTag {
+				room.RoomID, room.Legacy = room.Name, true
+			}
+			if tag := ev.Tags.GetFirst([]string{"status", ""}); tag != nil {
+				room.Status = (*tag)[1]
+			}
+			if room.DTag == "" || room.RoomID == "" {
+				continue
+			}
+			if prev, seen := latest[room.DTag]; !seen || room.CreatedAt > prev.CreatedAt {
+				latest[room.DTag] = room
+			}
+		}
+	}
+
+	if answered == 0 {
+		return nil, fmt.Errorf("no relay answered")
+	}
+
+	rooms := make([]AnnouncedRoom, 0, len(latest))
+	for _, room := range latest {
+		rooms = append(rooms, room)
+	}
+	// Newest first, so a room announced under several d tags keeps its latest
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].CreatedAt > rooms[j].CreatedAt
+	})
+	return rooms, nil
+}
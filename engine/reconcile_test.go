@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestFetchAnnouncedRooms(t *testing.T) {
+	ctx := context.Background()
+	relay := relaytest.New(t)
+	key := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(key)
+	publisher := RelayPublisher{URLs: []string{relay.URL()}}
+	for _, tags := range []nostr.Tags{
+		{{"d", "current"}, RoomIDTag("Lobby", "https://hivetalk.example/"), {"room", "Lobby"}, {"status", "open"}},
+		{{"d", "other-server"}, RoomIDTag("Lobby", "https://other.example"), {"room", "Lobby"}, {"status", "open"}},
+		// Published before RoomIDTag, with the room ID in the room tag
+		{{"d", "legacy"}, {"room", "56377RedLizard"}, {"status", "open"}},
+	} {
+		ev := nostr.Event{CreatedAt: nostr.Now(), Kind: 30312, Tags: tags}
+		ev.Sign(key)
+		if err := publisher.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, legacy := range []bool{false, true} {
+		rooms, err := FetchAnnouncedRooms(ctx, pubkey, "https://hivetalk.example", []string{relay.URL()}, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byDTag := map[string]AnnouncedRoom{}
+		for _, room := range rooms {
+			byDTag[room.DTag] = room
+		}
+		if room := byDTag["current"]; room.RoomID != "Lobby" || room.Legacy {
+			t.Errorf("legacy %v: current event read as %+v", legacy, room)
+		}
+		if _, found := byDTag["other-server"]; found {
+			t.Errorf("legacy %v: another server's room was returned", legacy)
+		}
+		room, found := byDTag["legacy"]
+		if legacy && (room.RoomID != "56377RedLizard" || !room.Legacy || room.Status != "open") {
+			t.Errorf("legacy event read as %+v", room)
+		}
+		if !legacy && found {
+			t.Errorf("legacy event returned without the fallback: %+v", room)
+		}
+	}
+}
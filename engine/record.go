@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ResponseRecorder saves every raw response from a room source as a
+// numbered file, poll-001.json, poll-002.json and so on, so a real
+// sequence of polls can be replayed through the poll loop in tests.
+type ResponseRecorder struct {
+	dir string
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewResponseRecorderFromEnv records responses under RECORD_DIR, in a
+// subdirectory when one is given. Returns nil when RECORD_DIR is unset.
+func NewResponseRecorderFromEnv(subdir string) *ResponseRecorder {
+	dir := os.Getenv("RECORD_DIR")
+	if dir == "" {
+		return nil
+	}
+	if subdir != "" {
+		dir = filepath.Join(dir, subdir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating %s, not recording responses: %v", dir, err)
+		return nil
+	}
+
+	// Carry on numbering after an earlier run's recordings
+	existing, _ := filepath.Glob(filepath.Join(dir, "poll-*.json"))
+	log.Printf("Recording responses to %s", dir)
+	return &ResponseRecorder{dir: dir, next: len(existing) + 1}
+}
+
+// Record saves a response body. A nil recorder does nothing.
+func (r *ResponseRecorder) Record(body []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path := filepath.Join(r.dir, fmt.Sprintf("poll-%03d.json", r.next))
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		log.Printf("Error recording response to %s: %v", path, err)
+		return
+	}
+	r.next++
+}
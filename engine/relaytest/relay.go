@@ -0,0 +1,152 @@
+// Package relaytest runs an in-process stand-in for a Nostr relay, for
+// tests that publish events or read them back.
+package relaytest
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Relay accepts every EVENT with a valid signature, keeping them in
+// order, and answers REQs from what it holds. Subscriptions stay open
+// until CLOSEd, getting new events as they arrive, so two clients can talk
+// through it the way NIP-46 clients and bunkers do.
+type Relay struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	events  []nostr.Event
+	clients map[*client]bool
+}
+
+// A connected client and its open subscriptions
+type client struct {
+	conn net.Conn
+	subs map[string]nostr.Filters // guarded by Relay.mu
+
+	writeMu sync.Mutex
+}
+
+func (c *client) write(env nostr.Envelope) error {
+	data, err := env.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return wsutil.WriteServerText(c.conn, data)
+}
+
+// New starts a relay that is shut down when the test ends
+func New(t testing.TB) *Relay {
+	r := &Relay{clients: make(map[*client]bool)}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// URL is the relay's WebSocket URL
+func (r *Relay) URL() string {
+	return "ws" + strings.TrimPrefix(r.server.URL, "http")
+}
+
+// Events returns the events published so far, in the order they arrived
+func (r *Relay) Events() []nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]nostr.Event(nil), r.events...)
+}
+
+func (r *Relay) serve(w http.ResponseWriter, req *http.Request) {
+	conn, _, _, err := ws.UpgradeHTTP(req, w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	c := &client{conn: conn, subs: make(map[string]nostr.Filters)}
+	r.mu.Lock()
+	r.clients[c] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.clients, c)
+		r.mu.Unlock()
+	}()
+
+	for {
+		message, err := wsutil.ReadClientText(conn)
+		if err != nil {
+			return
+		}
+
+		var replies []nostr.Envelope
+		switch env := nostr.ParseMessage(message).(type) {
+		case *nostr.EventEnvelope:
+			ok, _ := env.Event.CheckSignature()
+			if ok {
+				r.broadcast(env.Event)
+			}
+			reply := &nostr.OKEnvelope{EventID: env.Event.ID, OK: ok}
+			if !ok {
+				reason := "invalid: bad signature"
+				reply.Reason = &reason
+			}
+			replies = append(replies, reply)
+		case *nostr.ReqEnvelope:
+			r.mu.Lock()
+			c.subs[env.SubscriptionID] = env.Filters
+			for i := range r.events {
+				if env.Filters.Match(&r.events[i]) {
+					subID := env.SubscriptionID
+					replies = append(replies, &nostr.EventEnvelope{SubscriptionID: &subID, Event: r.events[i]})
+				}
+			}
+			r.mu.Unlock()
+			eose := nostr.EOSEEnvelope(env.SubscriptionID)
+			replies = append(replies, &eose)
+		case *nostr.CloseEnvelope:
+			r.mu.Lock()
+			delete(c.subs, string(*env))
+			r.mu.Unlock()
+		}
+
+		for _, reply := range replies {
+			if err := c.write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Store an event and send it to every open subscription it matches
+func (r *Relay) broadcast(ev nostr.Event) {
+	type delivery struct {
+		client *client
+		subID  string
+	}
+	var deliveries []delivery
+	r.mu.Lock()
+	r.events = append(r.events, ev)
+	for c := range r.clients {
+		for subID, filters := range c.subs {
+			if filters.Match(&ev) {
+				deliveries = append(deliveries, delivery{c, subID})
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, d := range deliveries {
+		subID := d.subID
+		d.client.write(&nostr.EventEnvelope{SubscriptionID: &subID, Event: ev})
+	}
+}
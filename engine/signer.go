@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip46"
+)
+
+// Signer signs events as the bot's Nostr identity
+type Signer interface {
+	PublicKey() string
+	SignEvent(ctx context.Context, ev *nostr.Event) error
+}
+
+// NewSigner creates a signer. A NIP-46 bunker:// URI takes precedence
+// over a raw private key.
+func NewSigner(ctx context.Context, privateKey, bunkerURI, bunkerClientKey string) (Signer, error) {
+	if bunkerURI != "" {
+		return newBunkerSigner(ctx, bunkerURI, bunkerClientKey)
+	}
+	if privateKey != "" {
+		return NewLocalSigner(privateKey)
+	}
+	return nil, fmt.Errorf("neither a bunker URI nor a private key is set")
+}
+
+// LocalSigner signs with a hex private key held in memory
+type LocalSigner struct {
+	privateKey string
+	publicKey  string
+}
+
+func NewLocalSigner(privateKey string) (*LocalSigner, error) {
+	pubkey, err := nostr.GetPublicKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("error getting public key: %v", err)
+	}
+	return &LocalSigner{privateKey: privateKey, publicKey: pubkey}, nil
+}
+
+func (s *LocalSigner) PublicKey() string {
+	return s.publicKey
+}
+
+func (s *LocalSigner) SignEvent(ctx context.Context, ev *nostr.Event) error {
+	ev.PubKey = s.publicKey
+	return ev.Sign(s.privateKey)
+}
+
+// How long to wait for the bunker to answer a request
+const bunkerRequestTimeout = 30 * time.Second
+
+// bunkerSigner asks a NIP-46 remote signer to sign events, so the bot's
+// secret key never lives on this host. The go-nostr bunker client talks
+// to it over the bunker's relays, with a local client key that the
+// bunker authorizes on connect.
+type bunkerSigner struct {
+	client     *nip46.BunkerClient
+	userPubkey string
+}
+
+// Connect to a bunker and fetch the pubkey it signs for. clientKey is the
+// local key the bunker authorizes; a fresh one is generated when empty.
+// The connection lives as long as ctx.
+func newBunkerSigner(ctx context.Context, uri, clientKey string) (*bunkerSigner, error) {
+	if clientKey == "" {
+		clientKey = nostr.GeneratePrivateKey()
+		log.Printf("No bunker client key set, using a throwaway client key; the bunker will have to authorize this session again after a restart")
+	}
+
+	client, err := nip46.ConnectBunker(ctx, clientKey, uri, nil, func(authURL string) {
+		log.Printf("Bunker requires authorization: %s", authURL)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to bunker: %v", err)
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, bunkerRequestTimeout)
+	defer cancel()
+	userPubkey, err := client.GetPublicKey(requestCtx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting public key from bunker: %v", err)
+	}
+	if !nostr.IsValidPublicKeyHex(userPubkey) {
+		return nil, fmt.Errorf("bunker returned invalid public key %q", userPubkey)
+	}
+	log.Printf("Connected to NIP-46 bunker, signing as %s", userPubkey)
+
+	return &bunkerSigner{client: client, userPubkey: userPubkey}, nil
+}
+
+func (s *bunkerSigner) PublicKey() string {
+	return s.userPubkey
+}
+
+func (s *bunkerSigner) SignEvent(ctx context.Context, ev *nostr.Event) error {
+	ev.PubKey = s.userPubkey
+	id := ev.GetID()
+
+	requestCtx, cancel := context.WithTimeout(ctx, bunkerRequestTimeout)
+	defer cancel()
+	if err := s.client.SignEvent(requestCtx, ev); err != nil {
+		return fmt.Errorf("bunker refused to sign: %v", err)
+	}
+
+	// Make sure the bunker signed exactly the event we asked for
+	if ev.ID != id || ev.PubKey != s.userPubkey {
+		return fmt.Errorf("bunker returned a different event than requested")
+	}
+	if ok, err := ev.CheckSignature(); !ok {
+		return fmt.Errorf("bunker returned an invalid signature: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip46"
+)
+
+// A stand-in NIP-46 bunker on relay: it answers connect when given secret,
+// and get_public_key and sign_event for userKey
+func runTestBunker(t *testing.T, ctx context.Context, relayURL, bunkerKey, userKey, secret string) {
+	bunkerPubkey, _ := nostr.GetPublicKey(bunkerKey)
+	userPubkey, _ := nostr.GetPublicKey(userKey)
+
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{
+		Kinds: []int{nostr.KindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{bunkerPubkey}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sub.EndOfStoredEvents
+
+	answer := func(req nip46.Request) nip46.Response {
+		resp := nip46.Response{ID: req.ID}
+		switch req.Method {
+		case "connect":
+			if len(req.Params) < 2 || req.Params[1] != secret {
+				resp.Error = "invalid secret"
+			} else {
+				resp.Result = "ack"
+			}
+		case "get_public_key":
+			resp.Result = userPubkey
+		case "sign_event":
+			var ev nostr.Event
+			if err := json.Unmarshal([]byte(req.Params[0]), &ev); err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			ev.Sign(userKey)
+			signed, _ := json.Marshal(ev)
+			resp.Result = string(signed)
+		default:
+			resp.Error = fmt.Sprintf("unknown method %s", req.Method)
+		}
+		return resp
+	}
+
+	go func() {
+		for ev := range sub.Events {
+			shared, err := nip44.GenerateConversationKey(ev.PubKey, bunkerKey)
+			if err != nil {
+				continue
+			}
+			plain, err := nip44.Decrypt(ev.Content, shared)
+			if err != nil {
+				continue
+			}
+			var req nip46.Request
+			if err := json.Unmarshal([]byte(plain), &req); err != nil {
+				continue
+			}
+			payload, _ := json.Marshal(answer(req))
+			content, _ := nip44.Encrypt(string(payload), shared)
+			reply := nostr.Event{
+				CreatedAt: nostr.Now(),
+				Kind:      nostr.KindNostrConnect,
+				Tags:      nostr.Tags{nostr.Tag{"p", ev.PubKey}},
+				Content:   content,
+			}
+			reply.Sign(bunkerKey)
+			relay.Publish(ctx, reply)
+		}
+	}()
+}
+
+func TestBunkerSigner(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relay := relaytest.New(t)
+	bunkerKey, userKey := nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()
+	bunkerPubkey, _ := nostr.GetPublicKey(bunkerKey)
+	userPubkey, _ := nostr.GetPublicKey(userKey)
+	runTestBunker(t, ctx, relay.URL(), bunkerKey, userKey, "s3cret")
+
+	uri := fmt.Sprintf("bunker://%s?relay=%s&secret=s3cret", bunkerPubkey, relay.URL())
+	signer, err := NewSigner(ctx, "", uri, nostr.GeneratePrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey() != userPubkey {
+		t.Errorf("signing as %s, want the bunker's user %s", signer.PublicKey(), userPubkey)
+	}
+
+	ev := nostr.Event{CreatedAt: nostr.Now(), Kind: 30312, Tags: nostr.Tags{nostr.Tag{"d", "room"}}}
+	if err := signer.SignEvent(ctx, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ev.CheckSignature(); !ok || ev.PubKey != userPubkey {
+		t.Errorf("signed event from %s, signature ok = %v, %v", ev.PubKey, ok, err)
+	}
+
+	wrong := strings.Replace(uri, "s3cret", "guess", 1)
+	if _, err := NewSigner(ctx, "", wrong, nostr.GeneratePrivateKey()); err == nil || !strings.Contains(err.Error(), "invalid secret") {
+		t.Errorf("connecting with the wrong secret: err = %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"log"
+	"time"
+)
+
+// ClosePolicy holds the thresholds that stop a room that briefly drops out
+// of a source's listing from being announced closed and reopened
+type ClosePolicy struct {
+	// Consecutive polls a room must be missing before it is closed
+	GracePolls int
+	// Minimum time a room must be missing before it is closed
+	GracePeriod time.Duration
+	// Time a closed room must be continuously present before it is
+	// announced as open again
+	MinOpenTime time.Duration
+}
+
+// RoomState is the part of a room's persisted state the Tracker manages.
+// Pollers embed it in their own room records.
+type RoomState struct {
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"last_seen"`
+
+	// Flap tracking: consecutive polls the room has been missing, when it
+	// went missing, and since when it has been continuously present
+	MissedPolls  int       `json:"missed_polls,omitempty"`
+	MissingSince time.Time `json:"missing_since"`
+	PresentSince time.Time `json:"present_since"`
+
+	// Participant numbers for the current session
+	Counts ParticipantCounts `json:"participant_counts"`
+}
+
+// ParticipantCounts tracks how many people are in a room over one session,
+// from when it goes live until it closes
+type ParticipantCounts struct {
+	Current int `json:"current"`
+	Peak    int `json:"peak"`
+	// Joins seen from poll to poll, so never below the peak
+	Total int `json:"total"`
+
+	// Current count as last announced, and when
+	Announced   int       `json:"announced"`
+	AnnouncedAt time.Time `json:"announced_at"`
+}
+
+// CountThrottle limits republishing a room for participant count changes
+type CountThrottle struct {
+	// Minimum time since the room was last announced
+	MinInterval time.Duration
+	// Smallest change from the announced count worth republishing, 1 when unset
+	MinDelta int
+}
+
+// Live reports whether a NIP-53 status means the room is running: open,
+// or private for invite-only rooms
+func Live(status string) bool {
+	return status == "open" || status == "private"
+}
+
+// Tracker moves rooms between statuses, applying a ClosePolicy. The zero
+// Tracker closes rooms on the first missed poll and uses the wall clock.
+type Tracker struct {
+	Policy   ClosePolicy
+	Throttle CountThrottle
+	Clock    Clock // SystemClock when nil
+}
+
+// Now is the tracker's current time
+func (t Tracker) Now() time.Time {
+	if t.Clock == nil {
+		return SystemClock.Now()
+	}
+	return t.Clock.Now()
+}
+
+// Set records a room's observed status, reporting whether it changed. A
+// closed room that comes back live is held at closed until it has been
+// present for MinOpenTime. A room going live starts a new session with
+// fresh participant counts.
+func (t Tracker) Set(roomID string, state *RoomState, status string) bool {
+	now := t.Now()
+
+	if Live(status) {
+		// The room is present again, so forget any missed polls
+		state.MissedPolls = 0
+		state.MissingSince = time.Time{}
+		if state.PresentSince.IsZero() {
+			state.PresentSince = now
+		}
+
+		// Hold back re-announcing a closed room until it has stayed up
+		if state.Status == "closed" && now.Sub(state.PresentSince) < t.Policy.MinOpenTime {
+			log.Printf("Room %s reappeared %v ago, waiting %v before re-announcing", roomID, now.Sub(state.PresentSince).Round(time.Second), t.Policy.MinOpenTime)
+			state.LastSeen = now
+			return false
+		}
+	} else {
+		state.PresentSince = time.Time{}
+	}
+
+	state.LastSeen = now
+	if state.Status != status {
+		if Live(status) && !Live(state.Status) {
+			state.Counts = ParticipantCounts{}
+		}
+		state.Status = status
+		return true
+	}
+	return false
+}
+
+// Missing records a missed poll for a live room and reports whether it
+// has been missing long enough to be closed
+func (t Tracker) Missing(roomID string, state *RoomState) bool {
+	now := t.Now()
+	state.MissedPolls++
+	if state.MissingSince.IsZero() {
+		state.MissingSince = now
+	}
+
+	missingFor := now.Sub(state.MissingSince)
+	if state.MissedPolls < t.Policy.GracePolls || missingFor < t.Policy.GracePeriod {
+		log.Printf("Room %s missing for %d poll(s) (%v), within close grace window", roomID, state.MissedPolls, missingFor.Round(time.Second))
+		return false
+	}
+	return true
+}
+
+// Absent records a poll a room wasn't listed in, reporting whether it
+// should now be closed. Rooms that aren't live only have their re-announce
+// timer restarted; changed reports whether the state was modified.
+func (t Tracker) Absent(roomID string, state *RoomState) (closeNow, changed bool) {
+	if !Live(state.Status) {
+		if !state.PresentSince.IsZero() {
+			state.PresentSince = time.Time{}
+			return false, true
+		}
+		return false, false
+	}
+	return t.Missing(roomID, state), true
+}
+
+// Count records the number of participants in a live room, reporting
+// whether it has moved far enough from the announced count, for long
+// enough, to be worth republishing
+func (t Tracker) Count(state *RoomState, n int) bool {
+	counts := &state.Counts
+	if n > counts.Current {
+		counts.Total += n - counts.Current
+	}
+	counts.Current = n
+	if n > counts.Peak {
+		counts.Peak = n
+	}
+
+	delta := n - counts.Announced
+	if delta < 0 {
+		delta = -delta
+	}
+	minDelta := t.Throttle.MinDelta
+	if minDelta < 1 {
+		minDelta = 1
+	}
+	return delta >= minDelta && t.Now().Sub(counts.AnnouncedAt) >= t.Throttle.MinInterval
+}
+
+// Announced records that a room was just published with its current count
+func (t Tracker) Announced(state *RoomState) {
+	state.Counts.Announced = state.Counts.Current
+	state.Counts.AnnouncedAt = t.Now()
+}
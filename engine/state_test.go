@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func TestTrackerCloseGrace(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tracker := Tracker{
+		Policy: ClosePolicy{GracePolls: 2, GracePeriod: 90 * time.Second},
+		Clock:  clock,
+	}
+	var room RoomState
+
+	if !tracker.Set("room", &room, "open") {
+		t.Fatal("opening a new room should change its status")
+	}
+	if room.PresentSince != epoch {
+		t.Errorf("PresentSince = %v, want %v", room.PresentSince, epoch)
+	}
+
+	// Missing twice within the grace period: still open
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+		closeNow, changed := tracker.Absent("room", &room)
+		if closeNow || !changed {
+			t.Fatalf("poll %d: Absent = %v, %v, want false, true", i+1, closeNow, changed)
+		}
+	}
+	if room.MissedPolls != 2 || room.MissingSince != epoch.Add(time.Minute) {
+		t.Errorf("MissedPolls = %d, MissingSince = %v", room.MissedPolls, room.MissingSince)
+	}
+
+	// The grace period has now passed as well
+	clock.Advance(time.Minute)
+	if closeNow, _ := tracker.Absent("room", &room); !closeNow {
+		t.Fatal("room should close once both grace thresholds are met")
+	}
+	if !tracker.Set("room", &room, "closed") || room.Status != "closed" {
+		t.Fatalf("closing should change the status, got %q", room.Status)
+	}
+
+	// Closed rooms aren't counted as missing
+	if closeNow, changed := tracker.Absent("room", &room); closeNow || changed {
+		t.Errorf("Absent on a closed room = %v, %v, want false, false", closeNow, changed)
+	}
+}
+
+func TestTrackerReappearResetsMissedPolls(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tracker := Tracker{Policy: ClosePolicy{GracePolls: 3}, Clock: clock}
+	var room RoomState
+
+	tracker.Set("room", &room, "open")
+	clock.Advance(time.Minute)
+	tracker.Absent("room", &room)
+	clock.Advance(time.Minute)
+	if tracker.Set("room", &room, "open") {
+		t.Error("a room that was never closed shouldn't report a change")
+	}
+	if room.MissedPolls != 0 || !room.MissingSince.IsZero() {
+		t.Errorf("MissedPolls = %d, MissingSince = %v, want reset", room.MissedPolls, room.MissingSince)
+	}
+	if room.LastSeen != clock.Now() {
+		t.Errorf("LastSeen = %v, want %v", room.LastSeen, clock.Now())
+	}
+}
+
+func TestTrackerMinOpenTime(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tracker := Tracker{Policy: ClosePolicy{MinOpenTime: 5 * time.Minute}, Clock: clock}
+	room := RoomState{Status: "closed"}
+
+	// Held back until the room has been present for MinOpenTime
+	if tracker.Set("room", &room, "open") {
+		t.Fatal("re-opened room announced before MinOpenTime")
+	}
+	clock.Advance(4 * time.Minute)
+	if tracker.Set("room", &room, "open") || room.Status != "closed" {
+		t.Fatal("re-opened room announced before MinOpenTime")
+	}
+
+	// Dropping out again restarts the timer
+	if _, changed := tracker.Absent("room", &room); !changed || !room.PresentSince.IsZero() {
+		t.Fatal("dropping out should restart the re-announce timer")
+	}
+	clock.Advance(time.Minute)
+	if tracker.Set("room", &room, "open") {
+		t.Fatal("timer wasn't restarted")
+	}
+
+	clock.Advance(5 * time.Minute)
+	if !tracker.Set("room", &room, "open") || room.Status != "open" {
+		t.Fatal("room should be re-announced after MinOpenTime")
+	}
+}
+
+func TestTrackerPrivateRoomsAreLive(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tracker := Tracker{Policy: ClosePolicy{GracePolls: 1}, Clock: clock}
+	var room RoomState
+
+	tracker.Set("room", &room, "open")
+	if !tracker.Set("room", &room, "private") {
+		t.Fatal("going private should change the status")
+	}
+	if room.PresentSince != epoch {
+		t.Errorf("PresentSince = %v, want it kept from when the room opened", room.PresentSince)
+	}
+	if closeNow, _ := tracker.Absent("room", &room); !closeNow {
+		t.Error("a missing private room should be closed like an open one")
+	}
+}
+
+func TestTrackerCountThrottle(t *testing.T) {
+	clock := NewFakeClock(epoch)
+	tracker := Tracker{
+		Throttle: CountThrottle{MinInterval: 2 * time.Minute, MinDelta: 2},
+		Clock:    clock,
+	}
+	var room RoomState
+
+	tracker.Set("room", &room, "open")
+	tracker.Count(&room, 3)
+	tracker.Announced(&room)
+
+	// Too small a change
+	clock.Advance(5 * time.Minute)
+	if tracker.Count(&room, 4) {
+		t.Error("a change of 1 shouldn't be republished with MinDelta 2")
+	}
+	// Big enough, but too soon after the last announcement
+	tracker.Announced(&room)
+	clock.Advance(time.Minute)
+	if tracker.Count(&room, 7) {
+		t.Error("republished within MinInterval")
+	}
+	clock.Advance(time.Minute)
+	if !tracker.Count(&room, 7) {
+		t.Error("count change should be republished once MinInterval has passed")
+	}
+
+	// 3, then +1, then +3 joins; leaving doesn't lower the total
+	tracker.Count(&room, 2)
+	want := ParticipantCounts{Current: 2, Peak: 7, Total: 7, Announced: 4, AnnouncedAt: epoch.Add(5 * time.Minute)}
+	if room.Counts != want {
+		t.Errorf("counts = %+v, want %+v", room.Counts, want)
+	}
+	tracker.Count(&room, 5)
+	if room.Counts.Total != 10 {
+		t.Errorf("total = %d, want 10 after 3 more joined", room.Counts.Total)
+	}
+
+	// A new session starts from scratch
+	tracker.Set("room", &room, "closed")
+	tracker.Set("room", &room, "open")
+	if room.Counts != (ParticipantCounts{}) {
+		t.Errorf("counts = %+v after re-opening, want a fresh session", room.Counts)
+	}
+}
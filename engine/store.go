@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RoomStore persists a poller's room database between runs, keyed by
+// room ID. T is the poller's room record.
+// Save must be atomic: after a crash the store holds either the
+// previous or the new set of rooms, never a partial write.
+type RoomStore[T any] interface {
+	Load() (map[string]T, error)
+	Save(rooms map[string]T) error
+	Close() error
+}
+
+// OpenRoomStore opens a room store of the given kind ("json" or "bolt")
+// at path
+func OpenRoomStore[T any](kind, path string) (RoomStore[T], error) {
+	switch kind {
+	case "", "json":
+		return &jsonRoomStore[T]{path: path}, nil
+	case "bolt":
+		return openBoltRoomStore[T](path)
+	default:
+		return nil, fmt.Errorf("unknown state store %q (expected json or bolt)", kind)
+	}
+}
+
+// SetAsideRoomStore closes a store that failed to load, moves its file
+// to path.corrupt-<unix time> so nothing in it is lost, and opens an empty
+// store of the same kind at path. Returns the new store and where the old
+// file went.
+func SetAsideRoomStore[T any](store RoomStore[T], kind, path string) (RoomStore[T], string, error) {
+	store.Close()
+	aside := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+	if err := os.Rename(path, aside); err != nil {
+		return nil, "", err
+	}
+	store, err := OpenRoomStore[T](kind, path)
+	if err != nil {
+		return nil, "", err
+	}
+	return store, aside, nil
+}
+
+// jsonRoomStore keeps rooms in a single JSON file that is replaced
+// with a temp-file + rename on every save
+type jsonRoomStore[T any] struct {
+	path string
+}
+
+func (s *jsonRoomStore[T]) Load() (map[string]T, error) {
+	rooms := make(map[string]T)
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return rooms, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &rooms); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", s.path, err)
+		}
+	}
+
+	return rooms, nil
+}
+
+func (s *jsonRoomStore[T]) Save(rooms map[string]T) error {
+	data, err := json.MarshalIndent(rooms, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file in the same directory so the rename is atomic
+	dir := filepath.Dir(s.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename itself survives a crash
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (s *jsonRoomStore[T]) Close() error {
+	return nil
+}
+
+// Bucket holding one JSON-encoded room record per room ID
+var roomsBucket = []byte("rooms")
+
+// boltRoomStore keeps rooms in an embedded bbolt database
+type boltRoomStore[T any] struct {
+	db *bolt.DB
+}
+
+func openBoltRoomStore[T any](path string) (*boltRoomStore[T], error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltRoomStore[T]{db: db}, nil
+}
+
+func (s *boltRoomStore[T]) Load() (map[string]T, error) {
+	rooms := make(map[string]T)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(k, v []byte) error {
+			var info T
+			if err := json.Unmarshal(v, &info); err != nil {
+				return fmt.Errorf("error parsing room %s: %v", k, err)
+			}
+			rooms[string(k)] = info
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+func (s *boltRoomStore[T]) Save(rooms map[string]T) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// Replace the bucket contents in a single transaction
+		if err := tx.DeleteBucket(roomsBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(roomsBucket)
+		if err != nil {
+			return err
+		}
+
+		for roomID, info := range rooms {
+			data, err := json.Marshal(info)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(roomID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltRoomStore[T]) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetAsideRoomStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.json")
+	if err := os.WriteFile(path, []byte(`{"Lobby":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenRoomStore[string]("json", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Fatal("loaded a truncated state file")
+	}
+
+	store, aside, err := SetAsideRoomStore(store, "json", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if rooms, err := store.Load(); err != nil || len(rooms) != 0 {
+		t.Errorf("store after setting the old one aside: %v, %v", rooms, err)
+	}
+	if data, err := os.ReadFile(aside); err != nil || string(data) != `{"Lobby":` {
+		t.Errorf("set-aside file %s: %q, %v", aside, data, err)
+	}
+}
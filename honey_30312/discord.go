@@ -1,60 +1,31 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
+	"sort"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
 )
 
-// DiscordWebhookMessage represents the structure of a Discord webhook message
-type DiscordWebhookMessage struct {
-	Content string `json:"content"`
-}
+// Shared Discord webhook client, which follows Discord's rate limits
+var discordClient = &notify.DiscordClient{}
 
-// Global rate limiter for Discord webhooks
-// 5 requests per second max with a burst of 1
-var discordLimiter = rate.NewLimiter(rate.Every(time.Second/5), 1)
+// Durable queue the messages go through when DISCORD_OUTBOX is on; nil
+// sends them straight away
+var discordOutbox *notify.Outbox
 
 // Maximum Discord message size
-const maxDiscordMessageSize = 2000
+const maxDiscordMessageSize = notify.MaxContent
 
 // Maximum number of rooms to include in a single Discord message
 const maxRoomsPerMessage = 2
 
 // truncateMessage truncates a message to fit within Discord's message size limits
 func truncateMessage(message string, maxSize int) string {
-	if len(message) <= maxSize {
-		return message
-	}
-	// Keep some room for the truncation notice
-	return message[:maxSize-50] + "\n... [message truncated due to Discord size limits]"
-}
-
-// sendToDiscord sends a message to a Discord webhook
-func sendToDiscord(webhookURL string, message DiscordWebhookMessage) error {
-	payload, err := json.Marshal(message)
-	if err != nil {
-		return err
-	}
-
-	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("discord webhook returned status: %d", resp.StatusCode)
-	}
-
-	return nil
+	return notify.TruncateWith(message, maxSize, "\n... [message truncated due to Discord size limits]")
 }
 
 // formatRoomMessage formats a room update message for Discord
@@ -62,13 +33,7 @@ func formatRoomMessage(room Room, status string) string {
 	var msg string
 	
 	// Determine emoji based on status
-	emoji := "🔄"
-	switch status {
-	case "open":
-		emoji = "🟢"
-	case "closed":
-		emoji = "🔴"
-	}
+	emoji := statusEmoji(status)
 	
 	// Format the basic room info
 	msg = fmt.Sprintf("%s **Room Update: %s**\n", emoji, room.Name)
@@ -84,8 +49,10 @@ func formatRoomMessage(room Room, status string) string {
 	// Add created time
 	msg += fmt.Sprintf("**Created At:** %s\n", room.CreatedAt.Format(time.RFC1123))
 	
-	// Add service URL using room name
-	msg += fmt.Sprintf("**Join URL:** https://honey.hivetalk.org/meet/%s\n", url.PathEscape(room.Name))
+	// Add service URL using room name; private rooms are invite-only
+	if joinURL := roomJoinURL(room, status); joinURL != "" {
+		msg += fmt.Sprintf("**Join URL:** %s\n", joinURL)
+	}
 	
 	// Add separator
 	msg += "----------------------------\n"
@@ -93,9 +60,49 @@ func formatRoomMessage(room Room, status string) string {
 	return msg
 }
 
-// SendRoomUpdatesToDiscord sends room updates to Discord
+// roomEmbed is the rich embed for a room update: the title links to the
+// join URL, the color follows the status and the room's picture is the
+// thumbnail
+func roomEmbed(room Room, status string, ends time.Time) notify.DiscordEmbed {
+	embed := notify.DiscordEmbed{
+		Title: fmt.Sprintf("%s %s", statusEmoji(status), room.Name),
+		URL:   roomJoinURL(room, status),
+		Color: notify.StatusColor(status),
+	}
+	if room.Description != nil {
+		embed.Description = *room.Description
+	}
+	if room.PictureUrl != nil && *room.PictureUrl != "" {
+		embed.Thumbnail = &notify.DiscordEmbedImage{URL: *room.PictureUrl}
+	}
+	embed.AddField("Status", status, true)
+	embed.AddField("Participants", fmt.Sprint(room.NumParticipants), true)
+	embed.AddField("Room ID", room.Sid, true)
+	if !room.CreatedAt.IsZero() {
+		embed.AddField("Starts", notify.DiscordTimestamp(room.CreatedAt, 'F'), true)
+	}
+	if !ends.IsZero() {
+		embed.AddField("Ends", notify.DiscordTimestamp(ends, 'F'), true)
+	}
+	return embed
+}
+
+func statusEmoji(status string) string {
+	switch status {
+	case "open":
+		return "🟢"
+	case "private":
+		return "🔒"
+	case "closed":
+		return "🔴"
+	}
+	return "🔄"
+}
+
+// SendRoomUpdatesToDiscord sends room updates to Discord, as rich embeds
+// or as plain markdown when embeds is false
 // It handles batching messages to avoid Discord rate limits
-func SendRoomUpdatesToDiscord(ctx context.Context, webhookURL string, rooms []Room, statusChanges map[string]string) {
+func SendRoomUpdatesToDiscord(ctx context.Context, webhookURL string, rooms []Room, statusChanges map[string]string, embeds bool) {
 	if webhookURL == "" {
 		// Discord webhook URL not provided, skip
 		return
@@ -110,6 +117,7 @@ func SendRoomUpdatesToDiscord(ctx context.Context, webhookURL string, rooms []Ro
 	
 	// Group rooms by status for better organization
 	openRooms := []Room{}
+	privateRooms := []Room{}
 	closedRooms := []Room{}
 	
 	// Find rooms with status changes
@@ -117,15 +125,23 @@ func SendRoomUpdatesToDiscord(ctx context.Context, webhookURL string, rooms []Ro
 		if newStatus, ok := statusChanges[room.Sid]; ok {
 			if newStatus == "open" {
 				openRooms = append(openRooms, room)
+			} else if newStatus == "private" {
+				privateRooms = append(privateRooms, room)
 			} else if newStatus == "closed" {
 				closedRooms = append(closedRooms, room)
 			}
 		}
 	}
 	
-	// Add closed rooms that are no longer in the API response
-	for roomID, status := range statusChanges {
-		if status == "closed" {
+	// Add closed rooms that are no longer in the API response, in a
+	// stable order
+	roomIDs := make([]string, 0, len(statusChanges))
+	for roomID := range statusChanges {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+	for _, roomID := range roomIDs {
+		if status := statusChanges[roomID]; status == "closed" {
 			// Check if this room is already in closedRooms
 			found := false
 			for _, room := range closedRooms {
@@ -158,18 +174,41 @@ func SendRoomUpdatesToDiscord(ctx context.Context, webhookURL string, rooms []Ro
 	
 	// Send open room updates
 	if len(openRooms) > 0 {
-		sendRoomBatch(ctx, webhookURL, openRooms, "open")
+		sendRoomBatch(ctx, webhookURL, openRooms, "open", embeds)
+	}
+	
+	// Send private room updates
+	if len(privateRooms) > 0 {
+		sendRoomBatch(ctx, webhookURL, privateRooms, "private", embeds)
 	}
 	
 	// Send closed room updates
 	if len(closedRooms) > 0 {
-		sendRoomBatch(ctx, webhookURL, closedRooms, "closed")
+		sendRoomBatch(ctx, webhookURL, closedRooms, "closed", embeds)
 	}
 }
 
 // sendRoomBatch sends a batch of room updates to Discord
 // It splits messages if there are too many rooms to fit in one message
-func sendRoomBatch(ctx context.Context, webhookURL string, rooms []Room, status string) {
+func sendRoomBatch(ctx context.Context, webhookURL string, rooms []Room, status string, embeds bool) {
+	if embeds {
+		// Closed rooms ended when the poll that missed them ran
+		var ends time.Time
+		if status == "closed" {
+			ends = time.Now()
+		}
+		roomEmbeds := make([]notify.DiscordEmbed, 0, len(rooms))
+		for _, room := range rooms {
+			roomEmbeds = append(roomEmbeds, roomEmbed(room, status, ends))
+		}
+		for _, message := range notify.DiscordMessages(roomEmbeds) {
+			if postToDiscord(ctx, webhookURL, message) {
+				log.Printf("Successfully sent Discord message for %d rooms with status %s", len(message.Embeds), status)
+			}
+		}
+		return
+	}
+	
 	// Create batches of rooms
 	var batches [][]Room
 	for i := 0; i < len(rooms); i += maxRoomsPerMessage {
@@ -195,33 +234,119 @@ func sendRoomBatch(ctx context.Context, webhookURL string, rooms []Room, status
 			message = truncateMessage(message, maxDiscordMessageSize)
 		}
 		
-		// Create Discord message
-		discordMsg := DiscordWebhookMessage{
-			Content: message,
+		if postToDiscord(ctx, webhookURL, notify.DiscordWebhookMessage{Content: message}) {
+			log.Printf("Successfully sent Discord message for %d rooms with status %s", len(batch), status)
 		}
-		
-		// Wait for rate limiter
-		if err := discordLimiter.Wait(ctx); err != nil {
-			log.Printf("Error waiting for rate limiter: %v", err)
-			continue
+	}
+}
+
+// formatRenameMessage formats a room rename notice for Discord
+func formatRenameMessage(rename roomRename) string {
+	msg := fmt.Sprintf("✏️ **Room renamed from %s to %s**\n", rename.oldName, rename.room.Name)
+	msg += fmt.Sprintf("**Status:** %s\n", rename.status)
+	msg += fmt.Sprintf("**Room ID:** %s\n", rename.room.Sid)
+	if joinURL := roomJoinURL(rename.room, rename.status); joinURL != "" {
+		msg += fmt.Sprintf("**Join URL:** %s\n", joinURL)
+	}
+	msg += "----------------------------\n"
+	return msg
+}
+
+// renameEmbed is the rich embed for a rename notice
+func renameEmbed(rename roomRename) notify.DiscordEmbed {
+	embed := notify.DiscordEmbed{
+		Title: fmt.Sprintf("✏️ Room renamed to %s", rename.room.Name),
+		URL:   roomJoinURL(rename.room, rename.status),
+		Color: notify.StatusColor(rename.status),
+	}
+	embed.AddField("Previous name", rename.oldName, true)
+	embed.AddField("Status", rename.status, true)
+	embed.AddField("Room ID", rename.room.Sid, true)
+	return embed
+}
+
+// SendRoomRenamesToDiscord posts one notice per renamed room, so renames
+// stand apart from open and close updates
+func SendRoomRenamesToDiscord(ctx context.Context, webhookURL string, renames []roomRename, embeds bool) {
+	for _, rename := range renames {
+		message := notify.DiscordWebhookMessage{Content: truncateMessage(formatRenameMessage(rename), maxDiscordMessageSize)}
+		if embeds {
+			message = notify.DiscordMessages([]notify.DiscordEmbed{renameEmbed(rename)})[0]
 		}
-		
-		// Send to Discord with retries
-		for retries := 0; retries < 3; retries++ {
-			if err := sendToDiscord(webhookURL, discordMsg); err != nil {
-				if retries < 2 {
-					log.Printf("Failed to send to Discord: %v. Retrying in 2 seconds...", err)
-					time.Sleep(2 * time.Second)
-					continue
-				}
-				log.Printf("Failed to send to Discord after 3 attempts: %v", err)
-			} else {
-				log.Printf("Successfully sent Discord message for %d rooms with status %s", len(batch), status)
-				break
-			}
+		if postToDiscord(ctx, webhookURL, message) {
+			log.Printf("Successfully sent Discord rename notice for room %s", rename.room.Sid)
+		}
+	}
+}
+
+// postToDiscord sends a message, retrying as the client sees fit, or
+// queues it in the outbox. Reports whether it was delivered or queued.
+func postToDiscord(ctx context.Context, webhookURL string, discordMsg notify.DiscordWebhookMessage) bool {
+	if discordOutbox != nil {
+		if err := discordOutbox.Post(webhookURL, "", discordMsg); err != nil {
+			log.Printf("Failed to queue Discord message: %v", err)
+			return false
+		}
+		return true
+	}
+	if err := discordClient.Post(ctx, webhookURL, discordMsg); err != nil {
+		log.Printf("Failed to send to Discord: %v", err)
+		return false
+	}
+	return true
+}
+
+// postDiscordMessage posts a message and returns its ID, so it can be
+// edited later. The ID is empty if Discord didn't return one, or if the
+// message was queued in the outbox, which refers to it by key until it
+// has been posted.
+func postDiscordMessage(ctx context.Context, webhookURL, key string, discordMsg notify.DiscordWebhookMessage) (string, bool) {
+	if discordOutbox != nil {
+		if err := discordOutbox.Post(webhookURL, key, discordMsg); err != nil {
+			log.Printf("Failed to queue Discord message: %v", err)
+			return "", false
+		}
+		return "", true
+	}
+	messageID, err := discordClient.PostWait(ctx, webhookURL, discordMsg)
+	if err != nil {
+		log.Printf("Failed to send to Discord: %v", err)
+		return "", false
+	}
+	return messageID, true
+}
+
+// editDiscordMessage replaces a message posted through the webhook, given
+// by its ID or, while it is still in the outbox, by its key
+func editDiscordMessage(ctx context.Context, webhookURL, messageID, key string, discordMsg notify.DiscordWebhookMessage) error {
+	if discordOutbox != nil {
+		err := discordOutbox.Edit(webhookURL, messageID, key, discordMsg)
+		if err != nil {
+			log.Printf("Failed to queue edit of Discord message %s: %v", key, err)
+		}
+		return err
+	}
+	err := discordClient.Edit(ctx, webhookURL, messageID, discordMsg)
+	if err != nil {
+		log.Printf("Failed to edit Discord message %s: %v", messageID, err)
+	}
+	return err
+}
+
+// Log webhook delivery stats every interval until ctx is done; never
+// when interval is 0
+func logDiscordStats(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			discordClient.LogStats()
+		case <-ctx.Done():
+			return
 		}
-		
-		// Add delay between batches to avoid rate limiting
-		time.Sleep(1 * time.Second)
 	}
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
+)
+
+// DiscordSession is the Discord message announcing a room's current
+// session, from when it opened until it closes
+type DiscordSession struct {
+	MessageID string    `json:"message_id"`
+	OpenedAt  time.Time `json:"opened_at"`
+
+	// Outbox key of the message, which has no ID until it is delivered
+	Key string `json:"key,omitempty"`
+}
+
+// Outbox key of a session's message, unique to the room and its opening
+func discordSessionKey(roomID string, openedAt time.Time) string {
+	return fmt.Sprintf("%s@%d", roomID, openedAt.Unix())
+}
+
+// Record the Discord message of a room's session, nil once it is over
+func (db *RoomDatabase) setDiscordSession(roomID string, session *DiscordSession) {
+	info, exists := db.Rooms[roomID]
+	if !exists {
+		return
+	}
+	info.Discord = session
+	db.Rooms[roomID] = info
+	db.dirty = true
+}
+
+// Keep one Discord message per room session: post it when the room goes
+// live, edit it when the room changes status, is renamed or its
+// participant count is republished, and edit it a last time with the
+// duration and peak when it closes
+func (a *Announcer) updateDiscordSessions(ctx context.Context, rooms []Room, statusChanges map[string]string, updated []string) {
+	roomIDs := append([]string(nil), updated...)
+	for roomID := range statusChanges {
+		roomIDs = append(roomIDs, roomID)
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	sort.Strings(roomIDs)
+
+	snapshot := make(map[string]Room, len(rooms))
+	for _, room := range rooms {
+		snapshot[room.Sid] = room
+	}
+
+	now := a.db.Tracker.Now()
+	log.Printf("Updating %d room sessions on Discord", len(roomIDs))
+	for i, roomID := range roomIDs {
+		if i > 0 && roomID == roomIDs[i-1] {
+			continue
+		}
+		info, exists := a.db.Rooms[roomID]
+		if !exists {
+			continue
+		}
+
+		room := a.lookupRoom(roomID, snapshot, info)
+		message := sessionMessage(room, info, now, a.discordEmbeds)
+
+		session := info.Discord
+		if session != nil {
+			err := editDiscordMessage(ctx, a.discordURL, session.MessageID, session.Key, message)
+			if err == nil && discordOutbox != nil {
+				log.Printf("Queued edit of the Discord message for room %s (%s)", roomID, info.Status)
+			} else if err == nil {
+				log.Printf("Edited Discord message %s for room %s (%s)", session.MessageID, roomID, info.Status)
+			} else if notify.IsPermanent(err) {
+				// Deleted from the channel or otherwise beyond editing:
+				// a live room starts over with a new message
+				session = nil
+			}
+		}
+		switch {
+		case session != nil:
+			// Edited above
+		case engine.Live(info.Status):
+			key := discordSessionKey(roomID, now)
+			if messageID, ok := postDiscordMessage(ctx, a.discordURL, key, message); ok {
+				// Queued messages get their ID once delivered
+				if discordOutbox != nil {
+					log.Printf("Queued Discord message for room %s", roomID)
+				} else {
+					log.Printf("Posted Discord message %s for room %s", messageID, roomID)
+				}
+				if messageID != "" || discordOutbox != nil {
+					session = &DiscordSession{MessageID: messageID, OpenedAt: now, Key: key}
+				}
+			}
+		case statusChanges[roomID] != "":
+			// Closed without a session message, e.g. it opened before
+			// editing in place was turned on
+			postToDiscord(ctx, a.discordURL, message)
+		}
+		if !engine.Live(info.Status) {
+			session = nil
+		}
+		if session != info.Discord {
+			a.db.setDiscordSession(roomID, session)
+		}
+	}
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+}
+
+// The room to describe in a notification: from this snapshot, then the
+// last one; rooms that left the API response only have their stored name
+func (a *Announcer) lookupRoom(roomID string, snapshot map[string]Room, info RoomInfo) Room {
+	if room, seen := snapshot[roomID]; seen {
+		return room
+	}
+	if room, seen := a.rooms[roomID]; seen {
+		return room
+	}
+	return Room{Sid: roomID, Name: info.RoomName}
+}
+
+// Record the ID of a session message the outbox has delivered, so edits
+// no longer depend on the outbox remembering it
+func (a *Announcer) discordDelivered(entry notify.OutboxEntry, messageID string) {
+	if entry.Key == "" || messageID == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for roomID, info := range a.db.Rooms {
+		if info.Discord != nil && info.Discord.Key == entry.Key && info.Discord.MessageID == "" {
+			session := *info.Discord
+			session.MessageID = messageID
+			a.db.setDiscordSession(roomID, &session)
+		}
+	}
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+}
+
+// An edit the outbox couldn't deliver, most likely because the message was
+// deleted from the channel: a room that is still live starts over with a
+// new message, as it does when an edit fails without the outbox
+func (a *Announcer) discordFailed(entry notify.OutboxEntry, err error) {
+	if entry.Method != http.MethodPatch || entry.Key == "" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for roomID, info := range a.db.Rooms {
+		if info.Discord == nil || info.Discord.Key != entry.Key {
+			continue
+		}
+		if !engine.Live(info.Status) {
+			a.db.setDiscordSession(roomID, nil)
+			continue
+		}
+		log.Printf("Discord message for room %s can't be edited (%v), posting a new one", roomID, err)
+		now := a.db.Tracker.Now()
+		key := discordSessionKey(roomID, now)
+		message := sessionMessage(a.lookupRoom(roomID, nil, info), info, now, a.discordEmbeds)
+		var session *DiscordSession
+		if _, ok := postDiscordMessage(context.Background(), a.discordURL, key, message); ok {
+			session = &DiscordSession{OpenedAt: info.Discord.OpenedAt, Key: key}
+		}
+		a.db.setDiscordSession(roomID, session)
+	}
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+}
+
+// sessionMessage is a room's session message: the usual room update plus
+// the session's peak participants and, once closed, how long it ran
+func sessionMessage(room Room, info RoomInfo, now time.Time, embeds bool) notify.DiscordWebhookMessage {
+	var duration string
+	var ends time.Time
+	if !engine.Live(info.Status) {
+		ends = now
+		if info.Discord != nil {
+			duration = formatSessionDuration(now.Sub(info.Discord.OpenedAt))
+		}
+	}
+
+	if !embeds {
+		const separator = "----------------------------\n"
+		msg := strings.TrimSuffix(formatRoomMessage(room, info.Status), separator)
+		msg += fmt.Sprintf("**Peak Participants:** %d\n", info.Counts.Peak)
+		if duration != "" {
+			msg += fmt.Sprintf("**Duration:** %s\n", duration)
+		}
+		return notify.DiscordWebhookMessage{Content: truncateMessage(msg+separator, maxDiscordMessageSize)}
+	}
+
+	embed := roomEmbed(room, info.Status, ends)
+	embed.AddField("Peak participants", fmt.Sprint(info.Counts.Peak), true)
+	embed.AddField("Duration", duration, true)
+	return notify.DiscordMessages([]notify.DiscordEmbed{embed})[0]
+}
+
+// Session length to the minute, e.g. "1h 05m"
+func formatSessionDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "under a minute"
+	}
+	d = d.Round(time.Minute)
+	hours, minutes := int(d/time.Hour), int(d%time.Hour/time.Minute)
+	if hours == 0 {
+		return fmt.Sprintf("%dm", minutes)
+	}
+	return fmt.Sprintf("%dh %02dm", hours, minutes)
+}
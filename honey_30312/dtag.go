@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Move every room whose stored d tag differs from its derived one over to
+// the derived d tag. Open rooms are announced open under the new d tag
+// before their old event is closed. The poller must not be running.
+func migrateDTags(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-dtags", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migration without publishing or saving anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	baseURL := os.Getenv("BASE_URL")
+	relayURLs := engine.ParseRelayURLs(os.Getenv("RELAY_URLS"))
+	if baseURL == "" || len(relayURLs) == 0 {
+		return fmt.Errorf("BASE_URL and RELAY_URLS are required")
+	}
+	deriver, err := engine.NewDTagDeriverFromEnv(baseURL)
+	if err != nil {
+		return err
+	}
+	if deriver == nil {
+		return fmt.Errorf("set DTAG_MODE=hmac and DTAG_SECRET to migrate to derived d tags")
+	}
+
+	storeKind, statePath := engine.StatePathFromEnv("honey_rooms")
+	store, err := engine.OpenRoomStore[RoomInfo](storeKind, statePath)
+	if err != nil {
+		return fmt.Errorf("error opening room state store: %v", err)
+	}
+	defer store.Close()
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		return fmt.Errorf("error loading room database: %v", err)
+	}
+
+	roomIDs := []string{}
+	for roomID, info := range db.Rooms {
+		if info.DTag != deriver.Derive(roomID) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	sort.Strings(roomIDs)
+	log.Printf("%d of %d rooms need a new d tag", len(roomIDs), len(db.Rooms))
+	if *dryRun {
+		for _, roomID := range roomIDs {
+			info := db.Rooms[roomID]
+			fmt.Printf("%s\t%s\t%s -> %s\n", roomID, info.Status, info.DTag, deriver.Derive(roomID))
+		}
+		return nil
+	}
+	if len(roomIDs) == 0 {
+		return nil
+	}
+
+	signer, err := newSignerFromEnv(ctx)
+	if err != nil {
+		return fmt.Errorf("error setting up event signer: %v", err)
+	}
+	if site := os.Getenv("SITE_URL"); site != "" {
+		siteURL = strings.TrimRight(site, "/")
+	}
+	eventTemplate, err = loadEventTemplate(os.Getenv("EVENT_TEMPLATE"))
+	if err != nil {
+		return fmt.Errorf("error loading event template: %v", err)
+	}
+	heartbeat := engine.EnvDuration("HEARTBEAT_INTERVAL", 0)
+	publisher := engine.RelayPublisher{URLs: relayURLs}
+
+	for _, roomID := range roomIDs {
+		info := db.Rooms[roomID]
+		oldDTag, newDTag := info.DTag, deriver.Derive(roomID)
+		room := Room{Sid: roomID, Name: info.RoomName}
+
+		if engine.Live(info.Status) {
+			if err := publishEvent(ctx, signer, publisher, eventTemplate, newDTag, roomTemplateData(room, info.Status), info.Counts, engine.HeartbeatExpiration(time.Now(), heartbeat, info.Status), relayURLs); err != nil {
+				return fmt.Errorf("error announcing room %s under dTag %s: %v", roomID, newDTag, err)
+			}
+			if err := publishEvent(ctx, signer, publisher, eventTemplate, oldDTag, roomTemplateData(room, "closed"), info.Counts, time.Time{}, relayURLs); err != nil {
+				log.Printf("Error closing old dTag %s for room %s: %v", oldDTag, roomID, err)
+			}
+		}
+
+		// Save after every room so an interrupted migration can be resumed
+		info.DTag = newDTag
+		db.Rooms[roomID] = info
+		db.dirty = true
+		if err := db.commit(); err != nil {
+			return fmt.Errorf("error saving room database: %v", err)
+		}
+		log.Printf("Migrated room %s from dTag %s to %s", roomID, oldDTag, newDTag)
+	}
+	return nil
+}
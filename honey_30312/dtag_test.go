@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+)
+
+func TestMigrateDTags(t *testing.T) {
+	const baseURL = "https://honey.example"
+	relay := relaytest.New(t)
+	statePath := filepath.Join(t.TempDir(), "honey_rooms.json")
+	for key, value := range map[string]string{
+		"BASE_URL":       baseURL,
+		"NOSTR_PVT_KEY":  replayPrivateKey,
+		"RELAY_URLS":     relay.URL(),
+		"STATE_PATH":     statePath,
+		"STATE_STORE":    "json",
+		"EVENT_TEMPLATE": "",
+		"DTAG_MODE":      "hmac",
+		"DTAG_SECRET":    "dtag-secret",
+	} {
+		t.Setenv(key, value)
+	}
+	// The migration loads the site URL and template into the globals
+	oldSiteURL, oldTemplate := siteURL, eventTemplate
+	t.Cleanup(func() { siteURL, eventTemplate = oldSiteURL, oldTemplate })
+	deriver := engine.NewDTagDeriver("dtag-secret", baseURL)
+
+	store, err := engine.OpenRoomStore[RoomInfo]("json", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(map[string]RoomInfo{
+		"RM_lobby":   {DTag: "old-lobby", RoomName: "Lobby", RoomState: engine.RoomState{Status: "open"}},
+		"RM_archive": {DTag: "old-archive", RoomName: "Archive", RoomState: engine.RoomState{Status: "closed"}},
+	})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDTags(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	store, err = engine.OpenRoomStore[RoomInfo]("json", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	rooms, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for roomID, info := range rooms {
+		if info.DTag != deriver.Derive(roomID) {
+			t.Errorf("room %s has d tag %s, want the derived %s", roomID, info.DTag, deriver.Derive(roomID))
+		}
+	}
+
+	// Only the open room is announced again, opened under its new d tag
+	// and closed under its old one
+	status := map[string]string{}
+	for _, ev := range relay.Events() {
+		d, s := ev.Tags.GetFirst([]string{"d", ""}), ev.Tags.GetFirst([]string{"status", ""})
+		if d != nil && s != nil {
+			status[(*d)[1]] = (*s)[1]
+		}
+	}
+	if len(status) != 2 || status[deriver.Derive("RM_lobby")] != "open" || status["old-lobby"] != "closed" {
+		t.Errorf("published statuses %v, want RM_lobby open under its new d tag and closed under old-lobby", status)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Republish open and private rooms whose last announcement is a heartbeat
+// old, if the last successful poll saw them
+func (a *Announcer) republishOpen(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.db.Tracker.Now()
+	due := []string{}
+	for roomID, info := range a.db.Rooms {
+		if engine.HeartbeatDue(now, a.heartbeat, info.RoomState, info.LastPublished, a.lastPoll) {
+			due = append(due, roomID)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Strings(due)
+
+	for _, roomID := range due {
+		a.db.markPublished(roomID)
+	}
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	log.Printf("Heartbeat: republishing %d live rooms", len(due))
+	for _, roomID := range due {
+		info := a.db.Rooms[roomID]
+
+		// Prefer the last API snapshot, which carries the description and picture
+		room, seen := a.rooms[roomID]
+		if !seen {
+			room = Room{Sid: roomID, Name: info.RoomName}
+		}
+		data := roomTemplateData(room, info.Status)
+		if err := publishEvent(ctx, a.signer, a.publisher, eventTemplate, info.DTag, data, info.Counts, engine.HeartbeatExpiration(now, a.heartbeat, info.Status), a.relayURLs); err != nil {
+			log.Printf("Error republishing %s event for room %s: %v", info.Status, roomID, err)
+		}
+	}
+}
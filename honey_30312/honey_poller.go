@@ -8,11 +8,17 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
 	"github.com/joho/godotenv"
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -30,15 +36,45 @@ type Room struct {
 
 // Simple database to track rooms and their status
 type RoomDatabase struct {
-	Rooms map[string]RoomInfo
-	Path  string
+	Rooms   map[string]RoomInfo
+	Tracker engine.Tracker
+	store   engine.RoomStore[RoomInfo]
+	dirty   bool
+
+	// Derives d tags for new rooms; random d tags when nil
+	deriver *engine.DTagDeriver
 }
 
 type RoomInfo struct {
-	DTag      string    `json:"d_tag"`
-	RoomName  string    `json:"room_name"`
-	Status    string    `json:"status"`
-	LastSeen  time.Time `json:"last_seen"`
+	DTag     string `json:"d_tag"`
+	RoomName string `json:"room_name"`
+
+	// Names the room had before, oldest first
+	NameHistory []PreviousName `json:"name_history,omitempty"`
+
+	// Status, last seen and flap tracking (a room counts as missing while
+	// it is absent or empty), kept by the engine's Tracker
+	engine.RoomState
+
+	// When the room was last announced as open, for heartbeats
+	LastPublished time.Time `json:"last_published"`
+
+	// Discord message of the current session, edited in place until the
+	// room closes
+	Discord *DiscordSession `json:"discord,omitempty"`
+}
+
+// A name a room was known by until it was renamed
+type PreviousName struct {
+	Name      string    `json:"name"`
+	RenamedAt time.Time `json:"renamed_at"`
+}
+
+// A room rename, for notifications
+type roomRename struct {
+	room    Room
+	oldName string
+	status  string // status the room is announced with
 }
 
 // Global random source
@@ -54,43 +90,29 @@ func generateDTag() string {
 	return string(result)
 }
 
-// Load the room database from a file
-func loadRoomDatabase(path string) (*RoomDatabase, error) {
-	db := &RoomDatabase{
-		Rooms: make(map[string]RoomInfo),
-		Path:  path,
-	}
-
-	// Check if the file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		// Create a new file
-		return db, db.save()
-	}
-
-	// Read the file
-	data, err := os.ReadFile(path)
+// Load the room database from a store
+func loadRoomDatabase(store engine.RoomStore[RoomInfo]) (*RoomDatabase, error) {
+	rooms, err := store.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	// Unmarshal the data
-	if len(data) > 0 {
-		if err := json.Unmarshal(data, &db.Rooms); err != nil {
-			return nil, err
-		}
-	}
-
-	return db, nil
+	return &RoomDatabase{
+		Rooms: rooms,
+		store: store,
+	}, nil
 }
 
-// Save the room database to a file
-func (db *RoomDatabase) save() error {
-	data, err := json.MarshalIndent(db.Rooms, "", "  ")
-	if err != nil {
+// Commit pending changes to the store, once per poll cycle
+func (db *RoomDatabase) commit() error {
+	if !db.dirty {
+		return nil
+	}
+	if err := db.store.Save(db.Rooms); err != nil {
 		return err
 	}
-
-	return os.WriteFile(db.Path, data, 0644)
+	db.dirty = false
+	return nil
 }
 
 // Get the d tag for a room, creating one if it doesn't exist
@@ -101,28 +123,61 @@ func (db *RoomDatabase) getDTag(roomID string) string {
 
 	// Create a new d tag
 	dTag := generateDTag()
-	db.Rooms[roomID] = RoomInfo{
-		DTag:     dTag,
-		RoomName: "Unknown Room", // Default room name
-		Status:   "unknown",
-		LastSeen: time.Time{},
+	if db.deriver != nil {
+		dTag = db.deriver.Derive(roomID)
 	}
-	if err := db.save(); err != nil {
-		log.Printf("Error saving room database after creating dTag for room %s: %v", roomID, err)
+	db.Rooms[roomID] = RoomInfo{
+		DTag:      dTag,
+		RoomName:  "Unknown Room", // Default room name
+		RoomState: engine.RoomState{Status: "unknown"},
 	}
+	db.dirty = true
 	return dTag
 }
 
+// The poller's room database, shared with discord.go
+var roomDB *RoomDatabase
+
+// Event template and public site URL, shared with discord.go
+var (
+	eventTemplate *EventTemplate
+	siteURL       = "https://honey.hivetalk.org"
+)
+
+// Template data for a room with the given status
+func roomTemplateData(room Room, status string) TemplateData {
+	data := TemplateData{
+		RoomID:  room.Sid,
+		Name:    room.Name,
+		Status:  status,
+		BaseURL: siteURL,
+	}
+	if room.Description != nil {
+		data.Description = *room.Description
+	}
+	if room.PictureUrl != nil {
+		data.PictureUrl = *room.PictureUrl
+	}
+	return data
+}
+
+// Join URL for a room, as published in its service tag. Private rooms are
+// invite-only and have no public join URL.
+func roomJoinURL(room Room, status string) string {
+	if status == "private" {
+		return ""
+	}
+	return eventTemplate.serviceURL(roomTemplateData(room, status))
+}
+
 // Helper function to get room name from the database for use in discord.go
 func getRoomInfoFromDatabase(roomID string) string {
-	// Load the database
-	db, err := loadRoomDatabase("honey_rooms.json")
-	if err != nil {
+	if roomDB == nil {
 		return ""
 	}
 
 	// Get the room name
-	if info, exists := db.Rooms[roomID]; exists && info.RoomName != "" {
+	if info, exists := roomDB.Rooms[roomID]; exists && info.RoomName != "" {
 		return info.RoomName
 	}
 
@@ -133,37 +188,54 @@ func getRoomInfoFromDatabase(roomID string) string {
 func (db *RoomDatabase) updateRoomStatus(roomID, roomName, status string) bool {
 	info, exists := db.Rooms[roomID]
 	if !exists {
-		info = RoomInfo{
-			DTag:     db.getDTag(roomID),
-			RoomName: roomName,
-			Status:   status,
-			LastSeen: time.Now(),
-		}
-		db.Rooms[roomID] = info
-		if err := db.save(); err != nil {
-			log.Printf("Error saving room database after creating new room %s: %v", roomID, err)
-		}
-		return true // Status changed
+		info = RoomInfo{DTag: db.getDTag(roomID), RoomName: roomName}
 	}
+	changed := db.Tracker.Set(roomID, &info.RoomState, status)
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return changed || !exists
+}
 
-	if info.Status != status || info.RoomName != roomName {
-		info.Status = status
-		info.RoomName = roomName
-		info.LastSeen = time.Now()
-		db.Rooms[roomID] = info
-		if err := db.save(); err != nil {
-			log.Printf("Error saving room database after updating status for room %s: %v", roomID, err)
-		}
-		return true // Status or room name changed
+// Record a room's current name. Returns the old name when the room was
+// renamed; a room seen for the first time just takes the name.
+func (db *RoomDatabase) renameRoom(roomID, roomName string) (string, bool) {
+	info, exists := db.Rooms[roomID]
+	if exists && info.RoomName == roomName {
+		return "", false
+	}
+	if !exists {
+		info = RoomInfo{DTag: db.getDTag(roomID)}
 	}
 
-	// Update last seen time
-	info.LastSeen = time.Now()
-	db.Rooms[roomID] = info
-	if err := db.save(); err != nil {
-		log.Printf("Error saving room database after updating last seen time for room %s: %v", roomID, err)
+	oldName := info.RoomName
+	renamed := exists && info.Status != "unknown" && oldName != ""
+	if renamed {
+		info.NameHistory = append(info.NameHistory, PreviousName{Name: oldName, RenamedAt: db.Tracker.Now()})
+		log.Printf("Room %s renamed from %q to %q", roomID, oldName, roomName)
 	}
-	return false // Status didn't change
+	info.RoomName = roomName
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return oldName, renamed
+}
+
+// Record that a room is being announced as open now
+func (db *RoomDatabase) markPublished(roomID string) {
+	info := db.Rooms[roomID]
+	info.LastPublished = db.Tracker.Now()
+	db.Tracker.Announced(&info.RoomState)
+	db.Rooms[roomID] = info
+	db.dirty = true
+}
+
+// Record the number of participants in a live room, reporting whether the
+// change is due to be republished
+func (db *RoomDatabase) countParticipants(roomID string, count int) bool {
+	info := db.Rooms[roomID]
+	due := db.Tracker.Count(&info.RoomState, count)
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return due
 }
 
 // Check for rooms that have closed
@@ -178,7 +250,15 @@ func (db *RoomDatabase) checkClosedRooms(activeRoomIDs []string) []string {
 
 	// Check for rooms that were previously open but are not in the active list
 	for roomID, info := range db.Rooms {
-		if info.Status == "open" && !activeRoomMap[roomID] {
+		if activeRoomMap[roomID] {
+			continue
+		}
+		closeNow, changed := db.Tracker.Absent(roomID, &info.RoomState)
+		if changed {
+			db.Rooms[roomID] = info
+			db.dirty = true
+		}
+		if closeNow {
 			// Room is no longer active
 			closedRooms = append(closedRooms, roomID)
 			// For closed rooms, use the stored room name if available, otherwise use "Closed Room"
@@ -192,16 +272,28 @@ func (db *RoomDatabase) checkClosedRooms(activeRoomIDs []string) []string {
 		}
 	}
 
+	// Announce in a stable order rather than map order
+	sort.Strings(closedRooms)
 	return closedRooms
 }
 
+// Record a missed poll (or an empty room) for an open room and report
+// whether it has been missing long enough to be closed
+func (db *RoomDatabase) closeDue(roomID string) bool {
+	info := db.Rooms[roomID]
+	due := db.Tracker.Missing(roomID, &info.RoomState)
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return due
+}
+
 // Fetch rooms from the Honey API
-func fetchRooms(baseURL string) ([]Room, error) {
+func fetchRooms(ctx context.Context, baseURL string, recorder *engine.ResponseRecorder) ([]Room, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	req, err := http.NewRequest("GET", baseURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -222,6 +314,7 @@ func fetchRooms(baseURL string) ([]Room, error) {
 	if err != nil {
 		return nil, err
 	}
+	recorder.Record(body)
 
 	var rooms []Room
 	if err := json.Unmarshal(body, &rooms); err != nil {
@@ -231,30 +324,55 @@ func fetchRooms(baseURL string) ([]Room, error) {
 	return rooms, nil
 }
 
+// roomsSource lists the rooms on the Honey API
+type roomsSource struct {
+	baseURL  string
+	recorder *engine.ResponseRecorder // nil unless RECORD_DIR is set
+}
+
+func (r roomsSource) Name() string {
+	return r.baseURL
+}
+
+func (r roomsSource) Fetch(ctx context.Context) ([]Room, error) {
+	rooms, err := fetchRooms(ctx, r.baseURL, r.recorder)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found %d active rooms", len(rooms))
+	return rooms, nil
+}
+
 // Create and publish a 30312 event
-func publishEvent(ctx context.Context, privateKey, roomID, roomName, dTag, status, summary, imageURL, serviceURL string, relayURLs []string) error {
+func publishEvent(ctx context.Context, signer engine.Signer, publisher engine.Publisher, tmpl *EventTemplate, dTag string, data TemplateData, counts engine.ParticipantCounts, expiration time.Time, relayURLs []string) error {
+	roomID, status := data.RoomID, data.Status
 	log.Printf("Publishing %s event for room %s with dTag %s", status, roomID, dTag)
 	
-	// Get public key from private key
-	pubkey, err := nostr.GetPublicKey(privateKey)
+	pubkey := signer.PublicKey()
+	log.Printf("Using pubkey: %s", pubkey)
+
+	// Render the room, summary, image, service and t tags from the event template
+	descriptive, err := tmpl.render(data)
 	if err != nil {
-		return fmt.Errorf("error getting public key: %v", err)
+		return err
 	}
-	log.Printf("Using pubkey: %s", pubkey)
 
-	// Create event tags
-	tags := nostr.Tags{
-		nostr.Tag{"d", dTag},
-		nostr.Tag{"room", roomName}, // Use room name for the room tag
-		nostr.Tag{"summary", summary},
-		nostr.Tag{"status", status},
-		nostr.Tag{"image", imageURL},
-		nostr.Tag{"service", serviceURL},
+	// Invite-only rooms don't advertise a public join URL
+	if status == "private" {
+		descriptive = engine.WithoutTag(descriptive, "service")
 	}
 
-	// Add t tags
-	tags = append(tags, nostr.Tag{"t", "hivetalk-honey"})
-	tags = append(tags, nostr.Tag{"t", "interactive room"})
+	// Create event tags. The room ID tag lets lost room state be
+	// rebuilt from relays.
+	tags := nostr.Tags{nostr.Tag{"d", dTag}, engine.RoomIDTag(roomID, data.BaseURL)}
+	tags = append(tags, descriptive...)
+	tags = append(tags, nostr.Tag{"status", status})
+	tags = append(tags, engine.ParticipantTags(status, counts)...)
+
+	// Let relays drop the event if it isn't refreshed in time
+	if !expiration.IsZero() {
+		tags = append(tags, nostr.Tag{"expiration", strconv.FormatInt(expiration.Unix(), 10)})
+	}
 
 	// Add relays tag
 	relaysTag := []string{"relays"}
@@ -271,44 +389,373 @@ func publishEvent(ctx context.Context, privateKey, roomID, roomName, dTag, statu
 	}
 
 	// Sign the event
-	if err := ev.Sign(privateKey); err != nil {
+	if err := signer.SignEvent(ctx, &ev); err != nil {
 		return fmt.Errorf("error signing event: %v", err)
 	}
 	log.Printf("Event signed with ID: %s", ev.ID)
 
-	// Publish to each relay
-	for _, url := range relayURLs {
-		// Trim any whitespace
-		url = strings.TrimSpace(url)
-		log.Printf("Connecting to relay: %s", url)
+	return publisher.Publish(ctx, ev)
+}
 
-		// Create a timeout context for each relay connection
-		relayCtx, relayCancel := context.WithTimeout(ctx, 10*time.Second)
+// Announcer turns room observations into state transitions, 30312 events
+// and Discord notifications. The poll loop and the LiveKit webhook
+// receiver share one instance.
+type Announcer struct {
+	mu            sync.Mutex
+	db            *RoomDatabase
+	signer        engine.Signer // nil when Nostr is disabled
+	publisher     engine.Publisher
+	relayURLs     []string
+	discordURL    string
+	discordEmbeds bool               // rich embeds rather than plain markdown
+	discordEdit   bool               // one message per room session, edited in place
+	heartbeat     time.Duration      // republish interval for open rooms, 0 when off
+	statuses      *statusMapper      // maps Room.Status to NIP-53; defaults when nil
+	notifiers     *notify.Dispatcher // sinks from NOTIFY_SINKS, nil when none
+
+	// Reconcile room state with relays on the next full snapshot
+	reconcile bool
+
+	// Last API snapshot of each room, for heartbeat republishes, and when
+	// it started being applied; heartbeats only republish rooms it saw
+	rooms    map[string]Room
+	lastPoll time.Time
+}
 
-		relay, err := nostr.RelayConnect(relayCtx, url)
-		if err != nil {
-			log.Printf("Error connecting to relay %s: %v\n", url, err)
-			relayCancel() // Cancel context if connection fails
-			continue
+// Apply a set of rooms to the room database and announce any changes.
+// When complete is true the rooms are a full API snapshot, so open rooms
+// missing from it are considered for closing.
+func (a *Announcer) syncRooms(ctx context.Context, rooms []Room, complete bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	db := a.db
+	if complete {
+		a.lastPoll = db.Tracker.Now()
+	}
+
+	activeRoomIDs := []string{}
+
+	// Track status changes for Discord notifications
+	statusChanges := make(map[string]string)
+	changedRooms := []Room{}
+
+	// Live rooms republished without a status change, for a rename or a
+	// new participant count
+	republished := make(map[string]bool)
+	renames := []roomRename{}
+
+	// Process each room
+	for _, room := range rooms {
+		log.Printf("Processing room: %s - %s with %d participants", room.Sid, room.Name, room.NumParticipants)
+		activeRoomIDs = append(activeRoomIDs, room.Sid)
+		a.rooms[room.Sid] = room
+
+		// A status we can't map is left alone rather than published; the
+		// room still counts as present so it isn't closed either
+		var reported string
+		if room.Status != nil {
+			status, ok := a.statuses.normalize(*room.Status)
+			if !ok {
+				log.Printf("Room %s reported unknown status %q, leaving it unchanged", room.Sid, *room.Status)
+				continue
+			}
+			reported = status
 		}
 
-		publishStatus, err := relay.Publish(relayCtx, ev)
+		// A webhook snapshot usually lacks the status, which only comes
+		// with JSON room metadata. Keep the status the room is tracked
+		// with rather than take it for open; a closed room waits for the
+		// next poll to say how it reopened.
+		if reported == "" && !complete && room.NumParticipants > 0 {
+			if info, exists := db.Rooms[room.Sid]; exists {
+				if !engine.Live(info.Status) {
+					log.Printf("Room %s reopened without a status, leaving it to the next poll", room.Sid)
+					delete(a.rooms, room.Sid)
+					continue
+				}
+				reported = info.Status
+			}
+		}
 
-		// Always close the relay and cancel context when done
-		relay.Close()
-		relayCancel()
+		// Get or create d tag for this room
+		dTag := db.getDTag(room.Sid)
+		log.Printf("Using dTag %s for room %s", dTag, room.Sid)
+
+		// Determine room status
+		roomStatus := "open"
+		// If status is explicitly set, use its NIP-53 equivalent
+		if reported != "" {
+			roomStatus = reported
+		} else if room.NumParticipants == 0 {
+			// If no participants, treat as closed once the grace window has passed
+			if info, exists := db.Rooms[room.Sid]; exists && engine.Live(info.Status) && !db.closeDue(room.Sid) {
+				continue
+			}
+			roomStatus = "closed"
+			log.Printf("Room %s has 0 participants, marking as closed", room.Sid)
+		}
+		oldName, renamed := db.renameRoom(room.Sid, room.Name)
+		statusChanged := db.updateRoomStatus(room.Sid, room.Name, roomStatus)
+		live := engine.Live(db.Rooms[room.Sid].Status)
+		if renamed && live {
+			renames = append(renames, roomRename{room: room, oldName: oldName, status: db.Rooms[room.Sid].Status})
+		}
 
-		if err != nil {
-			log.Printf("Error publishing to %s: %v\n", url, err)
-			continue
+		// Track status changes for Discord notifications
+		if statusChanged {
+			statusChanges[room.Sid] = roomStatus
+		}
+
+		// Count participants for the session while the room is live
+		countChanged := false
+		if live {
+			countChanged = db.countParticipants(room.Sid, room.NumParticipants)
+		}
+
+		// Queue event if status, name or participant count changed
+		if statusChanged {
+			log.Printf("Room %s status changed to %s", room.Sid, roomStatus)
+			changedRooms = append(changedRooms, room)
+		} else if renamed && live {
+			log.Printf("Room %s renamed to %s, republishing", room.Sid, room.Name)
+			changedRooms = append(changedRooms, room)
+			republished[room.Sid] = true
+		} else if countChanged {
+			log.Printf("Room %s now has %d participants, republishing", room.Sid, room.NumParticipants)
+			changedRooms = append(changedRooms, room)
+			republished[room.Sid] = true
+		} else {
+			log.Printf("Room %s already %s, no event published", room.Sid, roomStatus)
 		}
-		log.Printf("Published event for room %s with status %s to %s, relay status: %v\n", roomID, status, url, publishStatus)
 	}
 
-	return nil
+	// Check for rooms that are no longer in the API response
+	closedRooms := []string{}
+	if complete {
+		closedRooms = db.checkClosedRooms(activeRoomIDs)
+		log.Printf("Found %d closed rooms", len(closedRooms))
+	}
+
+	// Status each changed room is announced with
+	announced := func(room Room) string {
+		if republished[room.Sid] {
+			return db.Rooms[room.Sid].Status
+		}
+		return statusChanges[room.Sid]
+	}
+
+	for _, room := range changedRooms {
+		if engine.Live(announced(room)) {
+			db.markPublished(room.Sid)
+		}
+	}
+
+	// Commit this cycle's state before announcing it, so a crash
+	// mid-publish never loses a d tag that is already on relays
+	if err := db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	for _, room := range changedRooms {
+		dTag := db.getDTag(room.Sid)
+		data := roomTemplateData(room, announced(room))
+
+		// publish everything both ephemeral and permanent rooms to all relays for rebroadcast
+		if a.signer != nil {
+			log.Printf("Publishing event for room %s", room.Sid)
+			if err := publishEvent(ctx, a.signer, a.publisher, eventTemplate, dTag, data, db.Rooms[room.Sid].Counts, engine.HeartbeatExpiration(db.Tracker.Now(), a.heartbeat, data.Status), a.relayURLs); err != nil {
+				log.Printf("Error publishing event for room %s: %v", room.Sid, err)
+			}
+		}
+
+		// Only publish to Nostr if enabled AND the room doesn't already have a status field with a value
+		// If the room has a status field with a value, it means the data is already being published elsewhere
+		// hasStatus := room.Status != nil && *room.Status != ""
+		// if nostrEnabled && !hasStatus {
+		// 	log.Printf("Publishing event for room %s", room.Sid)
+		// 	if err := publishEvent(ctx, privateKey, room.Sid, room.Name, dTag, roomStatus, summary, imageURL, serviceURL, relayURLs); err != nil {
+		// 		log.Printf("Error publishing event for room %s: %v", room.Sid, err)
+		// 	}
+		// } else if room.Status != nil && *room.Status != "" {
+		// 	log.Printf("Skipping Nostr publishing for room %s as it already has a status field: %s", room.Sid, *room.Status)
+		// }
+	}
+
+	updated := make([]string, 0, len(republished))
+	for roomID := range republished {
+		updated = append(updated, roomID)
+	}
+	sort.Strings(updated)
+
+	a.publishClosed(ctx, closedRooms, statusChanges)
+	a.notifyDiscord(ctx, rooms, statusChanges, updated)
+	a.notifyRenames(ctx, renames)
+	a.notifySinks(rooms, statusChanges, renames)
+}
+
+// Announce the changes in a full room snapshot. On the first snapshot
+// after start-up, room state is first reconciled with relays.
+func (a *Announcer) apply(ctx context.Context, rooms []Room) {
+	if a.reconcile {
+		a.reconcileWithRelays(ctx, rooms)
+		a.reconcile = false
+	}
+	a.syncRooms(ctx, rooms, true)
+}
+
+// Close rooms LiveKit reported as finished, without waiting out the grace window
+func (a *Announcer) endRooms(ctx context.Context, roomIDs []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	closedRooms := []string{}
+	for _, roomID := range roomIDs {
+		if info, exists := a.db.Rooms[roomID]; exists && engine.Live(info.Status) {
+			a.db.updateRoomStatus(roomID, info.RoomName, "closed")
+			closedRooms = append(closedRooms, roomID)
+		}
+	}
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	statusChanges := make(map[string]string)
+	a.publishClosed(ctx, closedRooms, statusChanges)
+	a.notifyDiscord(ctx, nil, statusChanges, nil)
+	a.notifySinks(nil, statusChanges, nil)
+}
+
+// Publish closed events for rooms already marked closed in the database
+func (a *Announcer) publishClosed(ctx context.Context, closedRooms []string, statusChanges map[string]string) {
+	for _, roomID := range closedRooms {
+		delete(a.rooms, roomID)
+		dTag := a.db.getDTag(roomID)
+		log.Printf("Room %s closed, publishing closed event with dTag %s", roomID, dTag)
+
+		// Track status changes for Discord notifications
+		statusChanges[roomID] = "closed"
+
+		// For closed rooms, get the stored room name from the database
+		roomName := "Unknown Room"
+		if info, exists := a.db.Rooms[roomID]; exists && info.RoomName != "" {
+			roomName = info.RoomName
+		}
+
+		// Use the actual room name for the event
+		data := roomTemplateData(Room{Sid: roomID, Name: roomName}, "closed")
+
+		// Only publish to Nostr if enabled
+		if a.signer != nil {
+			log.Printf("Publishing closed event for room %s", roomID)
+			if err := publishEvent(ctx, a.signer, a.publisher, eventTemplate, dTag, data, a.db.Rooms[roomID].Counts, time.Time{}, a.relayURLs); err != nil {
+				log.Printf("Error publishing closed event for room %s: %v", roomID, err)
+			}
+		}
+	}
+}
+
+// Send updates to Discord if enabled. Rooms republished without a status
+// change, in updated, only edit their session message.
+func (a *Announcer) notifyDiscord(ctx context.Context, rooms []Room, statusChanges map[string]string, updated []string) {
+	if a.discordURL == "" {
+		return
+	}
+	if a.discordEdit {
+		a.updateDiscordSessions(ctx, rooms, statusChanges, updated)
+		return
+	}
+	if len(statusChanges) > 0 {
+		log.Printf("Sending %d room updates to Discord", len(statusChanges))
+		SendRoomUpdatesToDiscord(ctx, a.discordURL, rooms, statusChanges, a.discordEmbeds)
+	}
+}
+
+// Tell Discord about renamed rooms if enabled
+func (a *Announcer) notifyRenames(ctx context.Context, renames []roomRename) {
+	if a.discordURL != "" && len(renames) > 0 {
+		log.Printf("Sending %d room renames to Discord", len(renames))
+		SendRoomRenamesToDiscord(ctx, a.discordURL, renames, a.discordEmbeds)
+	}
+}
+
+// Flush room state on shutdown. With closeRooms set, every room still
+// marked open is closed and announced as such, so relays and Discord
+// don't show it open forever if the poller never comes back.
+func (a *Announcer) shutdown(ctx context.Context, closeRooms bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	closedRooms := []string{}
+	if closeRooms {
+		for roomID, info := range a.db.Rooms {
+			if engine.Live(info.Status) {
+				a.db.updateRoomStatus(roomID, info.RoomName, "closed")
+				closedRooms = append(closedRooms, roomID)
+			}
+		}
+		sort.Strings(closedRooms)
+	}
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	statusChanges := make(map[string]string)
+	a.publishClosed(ctx, closedRooms, statusChanges)
+	a.notifyDiscord(ctx, nil, statusChanges, nil)
+	a.notifySinks(nil, statusChanges, nil)
+}
+
+// Create a signer from the environment. NOSTR_BUNKER_URI (a NIP-46
+// bunker:// URI) takes precedence over a raw NOSTR_PVT_KEY.
+func newSignerFromEnv(ctx context.Context) (engine.Signer, error) {
+	return engine.NewSigner(ctx, os.Getenv("NOSTR_PVT_KEY"), os.Getenv("NOSTR_BUNKER_URI"), os.Getenv("NOSTR_BUNKER_CLIENT_KEY"))
+}
+
+// Discord outbox directory from DISCORD_OUTBOX_DIR
+func discordOutboxDir() string {
+	if dir := os.Getenv("DISCORD_OUTBOX_DIR"); dir != "" {
+		return dir
+	}
+	return "discord_outbox"
+}
+
+// Run a one-off subcommand instead of the poller
+func runCommand(args []string) error {
+	// The .env file is optional for subcommands
+	godotenv.Load()
+
+	switch args[0] {
+	case "preview-template":
+		// preview-template [template.json]
+		path := os.Getenv("EVENT_TEMPLATE")
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if site := os.Getenv("SITE_URL"); site != "" {
+			siteURL = strings.TrimRight(site, "/")
+		}
+		return previewEventTemplate(path, siteURL)
+	case "migrate-dtags":
+		// migrate-dtags [-dry-run]
+		return migrateDTags(context.Background(), args[1:])
+	case "outbox":
+		// outbox list|replay|purge ...
+		return notify.OutboxCommand(discordOutboxDir(), args[1:], os.Stdout)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
+
 	// Load environment variables
 	if err := godotenv.Load(); err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
@@ -318,6 +765,7 @@ func main() {
 	// Get environment variables
 	baseURL := os.Getenv("BASE_URL")
 	privateKey := os.Getenv("NOSTR_PVT_KEY")
+	bunkerURI := os.Getenv("NOSTR_BUNKER_URI")
 	relayURLsStr := os.Getenv("RELAY_URLS")
 	discordURL := os.Getenv("DISCORD_URL")
 
@@ -327,9 +775,9 @@ func main() {
 	}
 
 	// Check if Nostr integration is enabled
-	nostrEnabled := privateKey != "" && relayURLsStr != ""
+	nostrEnabled := (privateKey != "" || bunkerURI != "") && relayURLsStr != ""
 	if !nostrEnabled {
-		log.Println("Nostr integration disabled - missing NOSTR_PVT_KEY or RELAY_URLS")
+		log.Println("Nostr integration disabled - missing NOSTR_PVT_KEY/NOSTR_BUNKER_URI or RELAY_URLS")
 	}
 
 	// Log integration status
@@ -347,13 +795,7 @@ func main() {
 	// Parse relay URLs if Nostr is enabled
 	relayURLs := []string{}
 	if nostrEnabled {
-		for _, url := range strings.Split(relayURLsStr, ",") {
-			url = strings.TrimSpace(url)
-			if url != "" {
-				relayURLs = append(relayURLs, url)
-			}
-		}
-
+		relayURLs = engine.ParseRelayURLs(relayURLsStr)
 		if len(relayURLs) == 0 {
 			log.Println("Warning: No valid relay URLs found. Nostr publishing will be disabled.")
 			nostrEnabled = false
@@ -362,142 +804,198 @@ func main() {
 		}
 	}
 
-	// Load or create the room database
-	db, err := loadRoomDatabase("honey_rooms.json")
-	if err != nil {
-		log.Fatalf("Error loading room database: %v", err)
-	}
-	log.Printf("Room database loaded with %d rooms", len(db.Rooms))
+	// Cancelled on SIGINT/SIGTERM, which stops polling and any in-flight
+	// relay publishes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Create context
-	ctx := context.Background()
+	// Sign with the NIP-46 bunker if configured, otherwise the local key
+	var signer engine.Signer
+	if nostrEnabled {
+		var err error
+		signer, err = newSignerFromEnv(ctx)
+		if err != nil {
+			log.Fatalf("Error setting up event signer: %v", err)
+		}
+		log.Printf("Signing events as %s", signer.PublicKey())
+	}
 
-	// Polling interval (60 seconds)
-	interval := 60 * time.Second
+	// Open the room state store
+	storeKind, statePath := engine.StatePathFromEnv("honey_rooms")
+	store, err := engine.OpenRoomStore[RoomInfo](storeKind, statePath)
+	if err != nil {
+		log.Fatalf("Error opening room state store: %v", err)
+	}
+	log.Printf("Using %s state store at %s", storeKind, statePath)
 
-	log.Printf("Polling %s every %v", baseURL, interval)
+	// Rebuild lost room state from relays once the first poll tells us
+	// which rooms are live
+	reconcile := nostrEnabled && engine.EnvBool("RECONCILE_FROM_RELAYS", true)
 
-	// Main polling loop
-	for {
-		log.Println("Polling for rooms...")
-		
-		// Fetch rooms
-		rooms, err := fetchRooms(baseURL)
-		if err != nil {
-			log.Printf("Error fetching rooms: %v", err)
-			time.Sleep(interval)
-			continue
+	// Load or create the room database
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		// Relays still hold the d tags we announced, so with reconciling
+		// on, start empty and rebuild from them. The old state is kept
+		// aside either way.
+		if !reconcile {
+			log.Fatalf("Error loading room database (enable Nostr and RECONCILE_FROM_RELAYS to rebuild it from relays): %v", err)
+		}
+		var aside string
+		if store, aside, err = engine.SetAsideRoomStore(store, storeKind, statePath); err != nil {
+			log.Fatalf("Error setting aside room database that failed to load: %v", err)
 		}
-		log.Printf("Found %d active rooms", len(rooms))
+		log.Printf("Room database failed to load, moved to %s; rebuilding from relays", aside)
+		db = &RoomDatabase{Rooms: make(map[string]RoomInfo), store: store, dirty: true}
+	}
+	defer store.Close()
+	db.Tracker.Policy = engine.ClosePolicy{
+		GracePolls:  engine.EnvInt("CLOSE_GRACE_POLLS", 2),
+		GracePeriod: engine.EnvDuration("CLOSE_GRACE_PERIOD", 0),
+		MinOpenTime: engine.EnvDuration("MIN_OPEN_TIME", 0),
+	}
+	db.Tracker.Throttle = engine.CountThrottle{
+		MinInterval: engine.EnvDuration("PARTICIPANT_UPDATE_INTERVAL", 2*time.Minute),
+		MinDelta:    engine.EnvInt("PARTICIPANT_UPDATE_DELTA", 1),
+	}
+	if db.deriver, err = engine.NewDTagDeriverFromEnv(baseURL); err != nil {
+		log.Fatalf("Error setting up d tags: %v", err)
+	}
+	if db.deriver != nil {
+		log.Printf("Deriving d tags for new rooms from DTAG_SECRET")
+	}
+	log.Printf("Closing rooms after %d missed poll(s) and at least %v; re-announcing after %v", db.Tracker.Policy.GracePolls, db.Tracker.Policy.GracePeriod, db.Tracker.Policy.MinOpenTime)
+	log.Printf("Republishing participant counts on changes of %d or more, at most every %v", db.Tracker.Throttle.MinDelta, db.Tracker.Throttle.MinInterval)
+	roomDB = db
+	log.Printf("Room database loaded with %d rooms", len(db.Rooms))
 
-		activeRoomIDs := []string{}
+	// Load and validate the 30312 event template
+	if site := os.Getenv("SITE_URL"); site != "" {
+		siteURL = strings.TrimRight(site, "/")
+	}
+	eventTemplate, err = loadEventTemplate(os.Getenv("EVENT_TEMPLATE"))
+	if err != nil {
+		log.Fatalf("Error loading event template: %v", err)
+	}
 
-		// Track status changes for Discord notifications
-		statusChanges := make(map[string]string)
-
-		// Process each room
-		for _, room := range rooms {
-			log.Printf("Processing room: %s - %s with %d participants", room.Sid, room.Name, room.NumParticipants)
-			activeRoomIDs = append(activeRoomIDs, room.Sid)
-			
-			// Get or create d tag for this room
-			dTag := db.getDTag(room.Sid)
-			log.Printf("Using dTag %s for room %s", dTag, room.Sid)
-
-			// Determine room status
-			roomStatus := "open"
-			// If status is explicitly set, use it
-			if room.Status != nil {
-				roomStatus = *room.Status
-			} else if room.NumParticipants == 0 {
-				// If no participants, treat as closed
-				roomStatus = "closed"
-				log.Printf("Room %s has 0 participants, marking as closed", room.Sid)
-			}
-			statusChanged := db.updateRoomStatus(room.Sid, room.Name, roomStatus)
+	announcer := &Announcer{
+		db:         db,
+		signer:     signer,
+		publisher:  engine.RelayPublisher{URLs: relayURLs},
+		relayURLs:  relayURLs,
+		discordURL: discordURL,
+		rooms:      make(map[string]Room),
 
-			// Track status changes for Discord notifications
-			if statusChanged {
-				statusChanges[room.Sid] = roomStatus
-			}
+		// Room updates as rich embeds, or the plain markdown of old
+		discordEmbeds: engine.EnvBool("DISCORD_EMBEDS", true),
 
-			// Publish event if status changed and Nostr is enabled
-			if statusChanged {
-				log.Printf("Room %s status changed to %s", room.Sid, roomStatus)
+		// Edit each room's Discord message over its session rather than
+		// posting every change
+		discordEdit: engine.EnvBool("DISCORD_EDIT_IN_PLACE", true),
 
-				// Construct service URL using room name
-				serviceURL := fmt.Sprintf("https://honey.hivetalk.org/meet/%s", url.PathEscape(room.Name))
+		reconcile: reconcile,
+	}
+	if nostrEnabled {
+		announcer.heartbeat = engine.EnvDuration("HEARTBEAT_INTERVAL", 0)
+	}
 
-				// Use description for summary tag and name for room tag
-				// Default summary to room name if description is nil
-				summary := room.Name
-				imageURL := "https://honey.hivetalk.org/logo.png"
-				if room.Description != nil {
-					summary = *room.Description
-				}
-				if room.PictureUrl != nil {
-					imageURL = *room.PictureUrl
-				}
+	// Map the statuses the API reports onto NIP-53 open/private/closed
+	if announcer.statuses, err = newStatusMapperFromEnv(); err != nil {
+		log.Fatalf("Error configuring room statuses: %v", err)
+	}
+	log.Printf("Mapping room statuses: %v", announcer.statuses)
+	if announcer.heartbeat > 0 {
+		if announcer.heartbeat < time.Minute {
+			log.Fatalf("HEARTBEAT_INTERVAL must be at least 1m")
+		}
+		log.Printf("Republishing open rooms every %v with a NIP-40 expiration", announcer.heartbeat)
+		go engine.RunHeartbeat(ctx, announcer.heartbeat, announcer.republishOpen)
+	}
 
-				// publish everything both ephemeral and permanent rooms to all relays for rebroadcast
-				log.Printf("Publishing event for room %s", room.Sid)
-				if err := publishEvent(ctx, privateKey, room.Sid, room.Name, dTag, roomStatus, summary, imageURL, serviceURL, relayURLs); err != nil {
-					log.Printf("Error publishing event for room %s: %v", room.Sid, err)
-				}
+	// Log Discord delivery stats now and then, and on shutdown
+	if discordURL != "" {
+		go logDiscordStats(ctx, engine.EnvDuration("DISCORD_STATS_INTERVAL", time.Hour))
+	}
 
-				// Only publish to Nostr if enabled AND the room doesn't already have a status field with a value
-				// If the room has a status field with a value, it means the data is already being published elsewhere
-				// hasStatus := room.Status != nil && *room.Status != ""
-				// if nostrEnabled && !hasStatus {
-				// 	log.Printf("Publishing event for room %s", room.Sid)
-				// 	if err := publishEvent(ctx, privateKey, room.Sid, room.Name, dTag, roomStatus, summary, imageURL, serviceURL, relayURLs); err != nil {
-				// 		log.Printf("Error publishing event for room %s: %v", room.Sid, err)
-				// 	}
-				// } else if room.Status != nil && *room.Status != "" {
-				// 	log.Printf("Skipping Nostr publishing for room %s as it already has a status field: %s", room.Sid, *room.Status)
-				// }
-			} else {
-				log.Printf("Room %s already %s, no event published", room.Sid, roomStatus)
-			}
+	// Send room updates to the sinks listed in NOTIFY_SINKS as well
+	if path := os.Getenv("NOTIFY_SINKS"); path != "" {
+		sinks, err := notify.LoadSinks(path, discordClient)
+		if err != nil {
+			log.Fatalf("Error loading notification sinks: %v", err)
+		}
+		if err := checkDiscordSinks(sinks, discordURL); err != nil {
+			log.Fatalf("Error loading notification sinks: %v", err)
 		}
+		for _, sink := range sinks {
+			log.Printf("Notifying %s (rate limit %v)", sink.Name, sink.Limit)
+		}
+		announcer.notifiers = notify.NewDispatcher(sinks)
+	}
 
-		// Check for rooms that are no longer in the API response
-		closedRooms := db.checkClosedRooms(activeRoomIDs)
-		log.Printf("Found %d closed rooms", len(closedRooms))
-		for _, roomID := range closedRooms {
-			dTag := db.getDTag(roomID)
-			log.Printf("Room %s closed, publishing closed event with dTag %s", roomID, dTag)
+	// Queue Discord messages on disk so they survive outages and restarts
+	if discordURL != "" && engine.EnvBool("DISCORD_OUTBOX", true) {
+		discordOutbox, err = notify.OpenOutbox(discordOutboxDir(), discordClient)
+		if err != nil {
+			log.Fatalf("Error opening Discord outbox: %v", err)
+		}
+		discordOutbox.MaxAge = engine.EnvDuration("DISCORD_OUTBOX_MAX_AGE", 24*time.Hour)
+		discordOutbox.Delivered = announcer.discordDelivered
+		discordOutbox.Failed = announcer.discordFailed
+		log.Printf("Queueing Discord messages in %s", discordOutbox.Dir)
+		go discordOutbox.Run(ctx)
+	}
+
+	// Polling interval (60 seconds), or a slower reconciliation interval
+	// when LiveKit pushes room events to us
+	interval := engine.EnvDuration("POLL_INTERVAL", 60*time.Second)
+
+	var webhookListener *http.Server
+	if listenAddr := os.Getenv("LIVEKIT_WEBHOOK_ADDR"); listenAddr != "" {
+		apiKey := os.Getenv("LIVEKIT_API_KEY")
+		apiSecret := os.Getenv("LIVEKIT_API_SECRET")
+		if apiKey == "" || apiSecret == "" {
+			log.Fatalf("LIVEKIT_API_KEY and LIVEKIT_API_SECRET are required when LIVEKIT_WEBHOOK_ADDR is set")
+		}
+		receiver := newLiveKitReceiver(ctx, apiKey, []byte(apiSecret), announcer)
+		webhookListener = &http.Server{Addr: listenAddr, Handler: receiver}
+		go func() {
+			log.Printf("Listening for LiveKit webhooks on %s", listenAddr)
+			if err := webhookListener.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("LiveKit webhook listener failed: %v", err)
+			}
+		}()
+		interval = engine.EnvDuration("POLL_INTERVAL", 10*time.Minute)
+	}
 
-			// Track status changes for Discord notifications
-			statusChanges[roomID] = "closed"
+	// Shutdown behaviour: a restart shouldn't close rooms, so closing
+	// them on exit is opt-in
+	closeOnShutdown := engine.EnvBool("CLOSE_ROOMS_ON_SHUTDOWN", false)
+	shutdownTimeout := engine.EnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
 
-			// For closed rooms, get the stored room name from the database
-			roomName := "Unknown Room"
-			if info, exists := db.Rooms[roomID]; exists && info.RoomName != "" {
-				roomName = info.RoomName
-			}
+	// Record raw API responses for replay tests if configured
+	loop := &engine.Loop[[]Room]{
+		Source:   roomsSource{baseURL: baseURL, recorder: engine.NewResponseRecorderFromEnv("")},
+		Apply:    announcer.apply,
+		Interval: interval,
+		// Retry failed fetches at the poll interval rather than backing off
+		MaxBackoff: interval,
+	}
+	loop.Run(ctx)
 
-			// Use the actual room name for the event
-			serviceURL := fmt.Sprintf("https://honey.hivetalk.org/meet/%s", url.PathEscape(roomName))
-			summary := fmt.Sprintf("%s is now closed", roomName)
-			
-			// Only publish to Nostr if enabled
-			if nostrEnabled {
-				log.Printf("Publishing closed event for room %s", roomID)
-				if err := publishEvent(ctx, privateKey, roomID, roomName, dTag, "closed", summary, "", serviceURL, relayURLs); err != nil {
-					log.Printf("Error publishing closed event for room %s: %v", roomID, err)
-				}
-			}
-		}
+	log.Printf("Shutting down (closing open rooms: %v, timeout %v)", closeOnShutdown, shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-		// Send updates to Discord if enabled
-		if discordURL != "" && len(statusChanges) > 0 {
-			log.Printf("Sending %d room updates to Discord", len(statusChanges))
-			SendRoomUpdatesToDiscord(ctx, discordURL, rooms, statusChanges)
+	if webhookListener != nil {
+		if err := webhookListener.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping LiveKit webhook listener: %v", err)
 		}
-
-		log.Printf("Sleeping for %v before next poll", interval)
-		// Wait for the next polling interval
-		time.Sleep(interval)
 	}
+	announcer.shutdown(shutdownCtx, closeOnShutdown)
+	announcer.notifiers.Close(shutdownCtx)
+	if discordOutbox != nil && !discordOutbox.Drain(shutdownCtx) {
+		log.Printf("Discord messages left in the outbox will be sent on the next start")
+	}
+	discordClient.LogStats()
+	log.Println("Shutdown complete")
 }
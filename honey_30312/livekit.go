@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Largest webhook body we accept
+const maxWebhookSize = 1 << 20
+
+// LiveKit webhook payload (protobuf JSON, so int64 fields arrive as strings)
+type liveKitWebhookEvent struct {
+	Event       string              `json:"event"`
+	ID          string              `json:"id"`
+	Room        *liveKitRoom        `json:"room,omitempty"`
+	Participant *liveKitParticipant `json:"participant,omitempty"`
+}
+
+type liveKitRoom struct {
+	Sid             string `json:"sid"`
+	Name            string `json:"name"`
+	NumParticipants int    `json:"numParticipants"`
+	CreationTime    string `json:"creationTime"`
+	Metadata        string `json:"metadata"`
+}
+
+type liveKitParticipant struct {
+	Sid      string `json:"sid"`
+	Identity string `json:"identity"`
+	Name     string `json:"name"`
+}
+
+// Room metadata, when set as JSON, may carry the same optional fields the
+// list-rooms API returns
+type liveKitRoomMetadata struct {
+	Description *string `json:"description,omitempty"`
+	PictureUrl  *string `json:"pictureUrl,omitempty"`
+	Status      *string `json:"status,omitempty"`
+}
+
+// liveKitReceiver validates LiveKit webhooks and feeds room transitions to
+// the shared Announcer in the order they arrive
+type liveKitReceiver struct {
+	apiKey    string
+	apiSecret []byte
+	announcer *Announcer
+	queue     chan liveKitWebhookEvent
+}
+
+func newLiveKitReceiver(ctx context.Context, apiKey string, apiSecret []byte, announcer *Announcer) *liveKitReceiver {
+	r := &liveKitReceiver{
+		apiKey:    apiKey,
+		apiSecret: apiSecret,
+		announcer: announcer,
+		queue:     make(chan liveKitWebhookEvent, 100),
+	}
+	go r.run(ctx)
+	return r
+}
+
+func (r *liveKitReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	if err := r.verify(body, req.Header.Get("Authorization")); err != nil {
+		log.Printf("Rejected LiveKit webhook from %s: %v", req.RemoteAddr, err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event liveKitWebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case r.queue <- event:
+		w.WriteHeader(http.StatusOK)
+	default:
+		// Polling will reconcile anything we drop here
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+}
+
+// Verify the HS256 JWT LiveKit sends in the Authorization header: it must
+// be signed with our API secret, issued by our API key, and carry the
+// base64 SHA-256 of the body in its sha256 claim
+func (r *liveKitReceiver) verify(body []byte, authHeader string) error {
+	token := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("missing or malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("bad token header: %v", err)
+	}
+	if header.Alg != "HS256" {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("bad token signature encoding: %v", err)
+	}
+	mac := hmac.New(sha256.New, r.apiSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("token signature mismatch")
+	}
+
+	var claims struct {
+		Iss    string `json:"iss"`
+		Exp    int64  `json:"exp"`
+		Nbf    int64  `json:"nbf"`
+		Sha256 string `json:"sha256"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("bad token claims: %v", err)
+	}
+	if claims.Iss != r.apiKey {
+		return fmt.Errorf("token issued by unknown key %q", claims.Iss)
+	}
+	// LiveKit always sets exp; a token without one could be replayed forever
+	now := time.Now().Unix()
+	if claims.Exp == 0 {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now > claims.Exp {
+		return fmt.Errorf("token expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return fmt.Errorf("token not yet valid")
+	}
+
+	sum := sha256.Sum256(body)
+	if claims.Sha256 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return fmt.Errorf("body hash mismatch")
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Apply queued webhooks one at a time so transitions stay in order
+func (r *liveKitReceiver) run(ctx context.Context) {
+	for {
+		select {
+		case event := <-r.queue:
+			r.apply(ctx, event)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *liveKitReceiver) apply(ctx context.Context, event liveKitWebhookEvent) {
+	if event.Room == nil || event.Room.Sid == "" {
+		log.Printf("Ignoring LiveKit %s webhook without a room", event.Event)
+		return
+	}
+	room := event.Room.toRoom()
+	log.Printf("Received LiveKit %s webhook for room %s - %s (%d participants)", event.Event, room.Sid, room.Name, room.NumParticipants)
+
+	switch event.Event {
+	case "room_started":
+		// An empty room isn't announced until someone joins
+		if room.NumParticipants > 0 {
+			r.announcer.syncRooms(ctx, []Room{room}, false)
+		}
+	case "participant_joined":
+		// The room snapshot may predate the join
+		if room.NumParticipants == 0 {
+			room.NumParticipants = 1
+		}
+		r.announcer.syncRooms(ctx, []Room{room}, false)
+	case "participant_left":
+		// The last participant leaving is settled by room_finished or the
+		// next poll, so the close grace window still applies
+		if room.NumParticipants > 0 {
+			r.announcer.syncRooms(ctx, []Room{room}, false)
+		}
+	case "room_finished":
+		r.announcer.endRooms(ctx, []string{room.Sid})
+	default:
+		log.Printf("Ignoring LiveKit %s webhook", event.Event)
+	}
+}
+
+// Convert a LiveKit room into the list-rooms API shape
+func (lr *liveKitRoom) toRoom() Room {
+	room := Room{
+		Name:            lr.Name,
+		Sid:             lr.Sid,
+		NumParticipants: lr.NumParticipants,
+		CreatedAt:       time.Now(),
+	}
+	if secs, err := strconv.ParseInt(lr.CreationTime, 10, 64); err == nil && secs > 0 {
+		room.CreatedAt = time.Unix(secs, 0).UTC()
+	}
+
+	var metadata liveKitRoomMetadata
+	if lr.Metadata != "" && json.Unmarshal([]byte(lr.Metadata), &metadata) == nil {
+		room.Description = metadata.Description
+		room.PictureUrl = metadata.PictureUrl
+		room.Status = metadata.Status
+	}
+	return room
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+)
+
+// Sign a LiveKit webhook token for body the way LiveKit does, without an
+// exp claim when exp is zero
+func liveKitToken(secret, apiKey string, body []byte, exp time.Time) string {
+	sum := sha256.Sum256(body)
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	fields := map[string]interface{}{
+		"iss":    apiKey,
+		"nbf":    time.Now().Add(-time.Minute).Unix(),
+		"sha256": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	if !exp.IsZero() {
+		fields["exp"] = exp.Unix()
+	}
+	claims, _ := json.Marshal(fields)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestLiveKitWebhookVerification(t *testing.T) {
+	r := &liveKitReceiver{apiKey: "APIkey", apiSecret: []byte("livekit-secret")}
+	body := []byte(`{"event":"room_started","room":{"sid":"RM_1","name":"Lobby"}}`)
+	later := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		want   string // error, empty if valid
+	}{
+		{"valid", "Bearer " + liveKitToken("livekit-secret", "APIkey", body, later), body, ""},
+		{"without Bearer", liveKitToken("livekit-secret", "APIkey", body, later), body, ""},
+		{"wrong key", "Bearer " + liveKitToken("other-secret", "APIkey", body, later), body, "signature mismatch"},
+		{"unknown issuer", "Bearer " + liveKitToken("livekit-secret", "other", body, later), body, "unknown key"},
+		{"expired", "Bearer " + liveKitToken("livekit-secret", "APIkey", body, time.Now().Add(-time.Second)), body, "expired"},
+		{"no expiry", "Bearer " + liveKitToken("livekit-secret", "APIkey", body, time.Time{}), body, "no expiry"},
+		{"tampered body", "Bearer " + liveKitToken("livekit-secret", "APIkey", body, later), []byte(strings.Replace(string(body), "Lobby", "Admin", 1)), "body hash mismatch"},
+		{"missing header", "", body, "missing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := r.verify(test.body, test.header)
+			if test.want == "" {
+				if err != nil {
+					t.Errorf("rejected: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("err = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+// A webhook snapshot without a status must not make a private room open
+func TestLiveKitWebhookKeepsPrivateRooms(t *testing.T) {
+	relay := relaytest.New(t)
+	store, err := engine.OpenRoomStore[RoomInfo]("json", filepath.Join(t.TempDir(), "honey_rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSiteURL, oldTemplate := siteURL, eventTemplate
+	t.Cleanup(func() { siteURL, eventTemplate = oldSiteURL, oldTemplate })
+	siteURL = replaySiteURL
+	if eventTemplate, err = loadEventTemplate(""); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := engine.NewLocalSigner(replayPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Announcer{
+		db:        db,
+		signer:    signer,
+		publisher: engine.RelayPublisher{URLs: []string{relay.URL()}},
+		relayURLs: []string{relay.URL()},
+		rooms:     make(map[string]Room),
+	}
+	r := &liveKitReceiver{announcer: a}
+	ctx := context.Background()
+
+	private := "private"
+	a.syncRooms(ctx, []Room{{Sid: "RM_core", Name: "Core Team", NumParticipants: 2, Status: &private}}, true)
+	r.apply(ctx, liveKitWebhookEvent{Event: "participant_joined", Room: &liveKitRoom{Sid: "RM_core", Name: "Core Team", NumParticipants: 3}})
+	// A room never seen before is open
+	r.apply(ctx, liveKitWebhookEvent{Event: "participant_joined", Room: &liveKitRoom{Sid: "RM_lobby", Name: "Lobby", NumParticipants: 1}})
+
+	statuses := map[string][]string{}
+	for _, ev := range relay.Events() {
+		room, status := ev.Tags.GetFirst([]string{"hivetalk_room", ""}), ev.Tags.GetFirst([]string{"status", ""})
+		if room == nil || status == nil {
+			t.Fatalf("event without a room or status: %v", ev.Tags)
+		}
+		statuses[(*room)[1]] = append(statuses[(*room)[1]], (*status)[1])
+		if (*room)[1] == "RM_core" && ev.Tags.GetFirst([]string{"service", ""}) != nil {
+			t.Errorf("private room published with its join URL: %v", ev.Tags)
+		}
+	}
+	if got := strings.Join(statuses["RM_core"], ","); got != "private,private" {
+		t.Errorf("private room published as %s, want private twice", got)
+	}
+	if got := strings.Join(statuses["RM_lobby"], ","); got != "open" {
+		t.Errorf("new room published as %s, want open", got)
+	}
+}
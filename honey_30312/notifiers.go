@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
+)
+
+// Tell the sinks in NOTIFY_SINKS about status changes and renames. The
+// dispatcher queues them per sink, so this never waits on a slow one.
+func (a *Announcer) notifySinks(rooms []Room, statusChanges map[string]string, renames []roomRename) {
+	if a.notifiers == nil {
+		return
+	}
+	snapshot := make(map[string]Room, len(rooms))
+	for _, room := range rooms {
+		snapshot[room.Sid] = room
+	}
+	roomIDs := make([]string, 0, len(statusChanges))
+	for roomID := range statusChanges {
+		roomIDs = append(roomIDs, roomID)
+	}
+	sort.Strings(roomIDs)
+
+	now := a.db.Tracker.Now()
+	for _, roomID := range roomIDs {
+		room := a.lookupRoom(roomID, snapshot, a.db.Rooms[roomID])
+		a.notifiers.Notify(roomNotification(room, statusChanges[roomID], now))
+	}
+	for _, rename := range renames {
+		a.notifiers.Notify(renameNotification(rename, now))
+	}
+}
+
+// Reject a discord sink on the DISCORD_URL webhook, which would post every
+// update to the channel twice: once in the edited session message and once
+// more from the sink. Other Discord webhooks are fine as sinks.
+func checkDiscordSinks(sinks []notify.Sink, discordURL string) error {
+	if discordURL == "" {
+		return nil
+	}
+	for _, sink := range sinks {
+		discord, ok := sink.Notifier.(*notify.DiscordNotifier)
+		if ok && notify.WebhookName(discord.WebhookURL) == notify.WebhookName(discordURL) {
+			return fmt.Errorf("sink %s posts to the DISCORD_URL webhook, which already gets room updates; remove one of them", sink.Name)
+		}
+	}
+	return nil
+}
+
+// roomNotification describes a room changing status, for any sink
+func roomNotification(room Room, status string, now time.Time) notify.Notification {
+	n := notify.Notification{
+		Kind:  status,
+		Title: fmt.Sprintf("%s %s", statusEmoji(status), room.Name),
+		URL:   roomJoinURL(room, status),
+		Color: notify.StatusColor(status),
+		Time:  now,
+	}
+	if room.Description != nil {
+		n.Description = *room.Description
+	}
+	if room.PictureUrl != nil {
+		n.Image = *room.PictureUrl
+	}
+	n.AddField("Status", status)
+	n.AddField("Participants", fmt.Sprint(room.NumParticipants))
+	n.AddField("Room ID", room.Sid)
+	if !room.CreatedAt.IsZero() {
+		n.AddField("Created", room.CreatedAt.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	return n
+}
+
+// renameNotification describes a room rename, for any sink
+func renameNotification(rename roomRename, now time.Time) notify.Notification {
+	n := notify.Notification{
+		Kind:  "renamed",
+		Title: fmt.Sprintf("✏️ Room renamed to %s", rename.room.Name),
+		URL:   roomJoinURL(rename.room, rename.status),
+		Color: notify.StatusColor(rename.status),
+		Time:  now,
+	}
+	n.AddField("Previous name", rename.oldName)
+	n.AddField("Status", rename.status)
+	n.AddField("Room ID", rename.room.Sid)
+	return n
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Rebuild room state the database has lost from what the bot already
+// announced on relays. Local state wins: only d tags the database doesn't
+// know are considered. A live room that the database lost is adopted with
+// its relay-side d tag and status; anything else relays still show open
+// is announced closed. Events from before the room ID tag only carry the
+// room name, so they are matched to the live room of that name, if just
+// one has it.
+func (a *Announcer) reconcileWithRelays(ctx context.Context, rooms []Room) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	announced, err := engine.FetchAnnouncedRooms(ctx, a.signer.PublicKey(), siteURL, a.relayURLs, eventTemplate.legacyRoomTag())
+	if err != nil {
+		log.Printf("Error fetching announced rooms from relays, skipping reconciliation: %v", err)
+		return
+	}
+
+	knownDTags := make(map[string]bool)
+	for _, info := range a.db.Rooms {
+		knownDTags[info.DTag] = true
+	}
+	live := make(map[string]bool)
+	byName := make(map[string][]string)
+	for _, room := range rooms {
+		live[room.Sid] = true
+		byName[room.Name] = append(byName[room.Name], room.Sid)
+	}
+
+	adopted := 0
+	stale := []engine.AnnouncedRoom{}
+	for _, room := range announced {
+		if knownDTags[room.DTag] {
+			continue
+		}
+		if room.Legacy {
+			room.RoomID = ""
+			if sids := byName[room.Name]; len(sids) == 1 {
+				room.RoomID = sids[0]
+			}
+		}
+		if _, tracked := a.db.Rooms[room.RoomID]; !live[room.RoomID] || tracked {
+			if engine.Live(room.Status) {
+				stale = append(stale, room)
+			}
+			continue
+		}
+
+		// The room tag is the name as the template rendered it, so the
+		// first poll fills in the name rather than see a rename
+		info := RoomInfo{
+			DTag: room.DTag,
+			RoomState: engine.RoomState{
+				Status:   room.Status,
+				LastSeen: room.CreatedAt.Time(),
+			},
+		}
+		if engine.Live(room.Status) {
+			info.PresentSince = a.db.Tracker.Now()
+		}
+		a.db.Rooms[room.RoomID] = info
+		a.db.dirty = true
+		adopted++
+		log.Printf("Recovered dTag %s for room %s - %s (%s on relays)", room.DTag, room.RoomID, room.Name, room.Status)
+	}
+	log.Printf("Reconciled with relays: %d announced rooms, %d recovered, %d to close", len(announced), adopted, len(stale))
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	for _, room := range stale {
+		log.Printf("Room %s - %s is still open on relays under dTag %s, publishing closed event", room.RoomID, room.Name, room.DTag)
+		data := roomTemplateData(Room{Sid: room.RoomID, Name: room.Name}, "closed")
+		if err := publishEvent(ctx, a.signer, a.publisher, eventTemplate, room.DTag, data, engine.ParticipantCounts{}, time.Time{}, a.relayURLs); err != nil {
+			log.Printf("Error publishing closed event for room %s: %v", room.RoomID, err)
+		}
+	}
+}
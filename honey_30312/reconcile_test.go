@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A lost database is rebuilt from events announced with a custom room
+// tag, and from events older than the room ID tag
+func TestReconcileWithRelays(t *testing.T) {
+	ctx := context.Background()
+	relay := relaytest.New(t)
+	store, err := engine.OpenRoomStore[RoomInfo]("json", filepath.Join(t.TempDir(), "honey_rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldSiteURL, oldTemplate := siteURL, eventTemplate
+	t.Cleanup(func() { siteURL, eventTemplate = oldSiteURL, oldTemplate })
+	siteURL = replaySiteURL
+	if eventTemplate, err = loadEventTemplate(""); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := engine.NewLocalSigner(replayPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Announcer{
+		db:        db,
+		signer:    signer,
+		publisher: engine.RelayPublisher{URLs: []string{relay.URL()}},
+		relayURLs: []string{relay.URL()},
+		rooms:     make(map[string]Room),
+	}
+
+	for _, tags := range []nostr.Tags{
+		{{"d", "core"}, engine.RoomIDTag("RM_core", replaySiteURL), {"room", "Core Team (honey)"}, {"status", "open"}},
+		{{"d", "lobby"}, {"room", "Lobby"}, {"status", "open"}},
+	} {
+		ev := nostr.Event{CreatedAt: nostr.Now(), Kind: 30312, Tags: tags}
+		if err := signer.SignEvent(ctx, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.publisher.Publish(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	published := len(relay.Events())
+
+	rooms := []Room{
+		{Sid: "RM_core", Name: "Core Team", NumParticipants: 2},
+		{Sid: "RM_lobby", Name: "Lobby", NumParticipants: 1},
+	}
+	a.reconcileWithRelays(ctx, rooms)
+	a.syncRooms(ctx, rooms, true)
+
+	if dTag := db.Rooms["RM_core"].DTag; dTag != "core" {
+		t.Errorf("RM_core has d tag %s, want core", dTag)
+	}
+	if dTag := db.Rooms["RM_lobby"].DTag; dTag != "lobby" {
+		t.Errorf("RM_lobby has d tag %s, want the legacy event's lobby", dTag)
+	}
+	if info := db.Rooms["RM_core"]; info.RoomName != "Core Team" || len(info.NameHistory) > 0 {
+		t.Errorf("RM_core named %q with history %v, want no rename", info.RoomName, info.NameHistory)
+	}
+	for _, ev := range relay.Events()[published:] {
+		if d := ev.Tags.GetFirst([]string{"d", ""}); d == nil || ((*d)[1] != "core" && (*d)[1] != "lobby") {
+			t.Errorf("room announced under a new d tag: %v", ev.Tags)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/bitcarrot/hivetalk/scheduler/notify"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected.json of each replay scenario")
+
+// Key the replayed events are signed with
+const replayPrivateKey = "5b5ec5f3c7a1e7f0b3a06dd93f0d51e0b2bd6ab7a0d2c6d9f9a1e1bd2b0c7e41"
+
+// Stand-in for the test relay's address, which changes every run
+const replayRelayURL = "wss://relay.test"
+
+// Public site URL the replayed rooms are announced under
+const replaySiteURL = "https://honey.test"
+
+// Discord shows when a room was created, which for rooms that already left
+// the API response is the time of the poll, in plain-text messages and in
+// the embeds' Created field
+var createdAtLine = regexp.MustCompile(`\*\*Created At:\*\* [^\n]*`)
+
+// What a replay scenario is expected to produce
+type replayExpected struct {
+	// Tags of every 30312 event published, in order, with d tags
+	// renumbered by first appearance
+	Events []nostr.Tags `json:"events"`
+
+	// Every Discord webhook post and edit, in order
+	Discord []discordPost `json:"discord"`
+}
+
+// A message posted to Discord, or an edit of one
+type discordPost struct {
+	// ID of the message edited; messages are numbered from 1 as posted
+	Edits string `json:"edits,omitempty"`
+	notify.DiscordWebhookMessage
+}
+
+// TestReplay replays each scenario under testdata/replay through the poll
+// loop. A scenario is a directory of list-rooms responses, poll-001.json,
+// poll-002.json and so on (as written with RECORD_DIR), and the
+// expected.json they must produce. Run with -update to rewrite
+// expected.json after an intended change. Each scenario also runs with
+// Discord messages going through the outbox, drained after every poll,
+// which must make no difference.
+func TestReplay(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/replay/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			replayScenario(t, dir, false)
+		})
+		if !*update {
+			t.Run(filepath.Base(dir)+"/outbox", func(t *testing.T) {
+				replayScenario(t, dir, true)
+			})
+		}
+	}
+}
+
+func replayScenario(t *testing.T, dir string, outbox bool) {
+	polls, err := filepath.Glob(filepath.Join(dir, "poll-*.json"))
+	if err != nil || len(polls) == 0 {
+		t.Fatalf("no recorded polls in %s", dir)
+	}
+
+	api := newReplayAPI(t, polls)
+	relay := relaytest.New(t)
+	discord := newTestDiscord(t)
+
+	store, err := engine.OpenRoomStore[RoomInfo]("json", filepath.Join(t.TempDir(), "honey_rooms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Tracker.Policy = engine.ClosePolicy{GracePolls: 2}
+	roomDB = db
+	siteURL = replaySiteURL
+	if eventTemplate, err = loadEventTemplate(""); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := engine.NewLocalSigner(replayPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Announcer{
+		db:         db,
+		signer:     signer,
+		publisher:  engine.RelayPublisher{URLs: []string{relay.URL()}},
+		relayURLs:  []string{relay.URL()},
+		discordURL: discord.server.URL,
+		rooms:      make(map[string]Room),
+		reconcile:  true,
+
+		discordEmbeds: true,
+		discordEdit:   true,
+	}
+	if outbox {
+		if discordOutbox, err = notify.OpenOutbox(t.TempDir(), discordClient); err != nil {
+			t.Fatal(err)
+		}
+		discordOutbox.Delivered = a.discordDelivered
+		defer func() { discordOutbox = nil }()
+	}
+	loop := &engine.Loop[[]Room]{
+		Source: roomsSource{baseURL: api.server.URL + "/api/list-rooms"},
+		Apply:  a.apply,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for range polls {
+		if err := loop.Poll(ctx); err != nil {
+			t.Fatalf("poll %d: %v", api.served(), err)
+		}
+		if outbox && !discordOutbox.Drain(ctx) {
+			t.Fatalf("poll %d: Discord outbox not drained", api.served())
+		}
+	}
+
+	got := replayExpected{Events: []nostr.Tags{}, Discord: []discordPost{}}
+	dTags := make(map[string]string)
+	for _, ev := range relay.Events() {
+		if ev.Kind != 30312 || ev.PubKey != signer.PublicKey() {
+			t.Fatalf("unexpected kind %d event from %s", ev.Kind, ev.PubKey)
+		}
+		got.Events = append(got.Events, normalizeReplayTags(ev.Tags, dTags, map[string]string{
+			relay.URL(): replayRelayURL,
+		}))
+	}
+	for _, message := range discord.Posts() {
+		message.Content = createdAtLine.ReplaceAllString(message.Content, "**Created At:** <created>")
+		for _, embed := range message.Embeds {
+			for i := range embed.Fields {
+				switch embed.Fields[i].Name {
+				case "Starts":
+					embed.Fields[i].Value = "<created>"
+				case "Ends":
+					embed.Fields[i].Value = "<ends>"
+				}
+			}
+		}
+		got.Discord = append(got.Discord, message)
+	}
+
+	expectedPath := filepath.Join(dir, "expected.json")
+	if *update {
+		data, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(expectedPath, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	var want replayExpected
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) != len(want.Events) {
+		t.Errorf("published %d events, want %d", len(got.Events), len(want.Events))
+	}
+	for i := 0; i < len(got.Events) && i < len(want.Events); i++ {
+		if !reflect.DeepEqual(got.Events[i], want.Events[i]) {
+			t.Errorf("event %d:\n got %v\nwant %v", i+1, got.Events[i], want.Events[i])
+		}
+	}
+	if len(got.Discord) != len(want.Discord) {
+		t.Errorf("posted %d Discord messages, want %d", len(got.Discord), len(want.Discord))
+	}
+	for i := 0; i < len(got.Discord) && i < len(want.Discord); i++ {
+		if !reflect.DeepEqual(got.Discord[i], want.Discord[i]) {
+			t.Errorf("Discord message %d:\n got %+v\nwant %+v", i+1, got.Discord[i], want.Discord[i])
+		}
+	}
+}
+
+// Rewrite the parts of an event's tags that change between runs: server
+// addresses, the expiration, and d tags, numbered in order of appearance
+func normalizeReplayTags(tags nostr.Tags, dTags map[string]string, urls map[string]string) nostr.Tags {
+	normalized := nostr.Tags{}
+	for _, tag := range tags {
+		tag = append(nostr.Tag(nil), tag...)
+		for i := 1; i < len(tag); i++ {
+			for from, to := range urls {
+				tag[i] = strings.ReplaceAll(tag[i], from, to)
+			}
+		}
+		switch {
+		case len(tag) > 1 && tag[0] == "d":
+			if _, seen := dTags[tag[1]]; !seen {
+				dTags[tag[1]] = fmt.Sprintf("d%d", len(dTags)+1)
+			}
+			tag[1] = dTags[tag[1]]
+		case len(tag) > 1 && tag[0] == "expiration":
+			tag[1] = "<expiration>"
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// replayAPI serves recorded list-rooms responses, one per request, and
+// keeps serving the last one once they run out
+type replayAPI struct {
+	server *httptest.Server
+	polls  [][]byte
+
+	mu sync.Mutex
+	n  int
+}
+
+func newReplayAPI(t *testing.T, paths []string) *replayAPI {
+	api := &replayAPI{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.polls = append(api.polls, data)
+	}
+	api.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/list-rooms" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		api.mu.Lock()
+		body := api.polls[len(api.polls)-1]
+		if api.n < len(api.polls) {
+			body = api.polls[api.n]
+		}
+		api.n++
+		api.mu.Unlock()
+		w.Header().Set("content-type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+// Number of responses served so far
+func (api *replayAPI) served() int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.n
+}
+
+// testDiscord is a stand-in for a Discord webhook that keeps every message
+// posted to it and every edit
+type testDiscord struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	posts []discordPost
+	ids   int
+}
+
+func newTestDiscord(t *testing.T) *testDiscord {
+	d := &testDiscord{}
+	d.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var post discordPost
+		if json.NewDecoder(r.Body).Decode(&post.DiscordWebhookMessage) != nil {
+			http.Error(w, "invalid message", http.StatusBadRequest)
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/":
+			d.ids++
+			d.posts = append(d.posts, post)
+			if r.URL.Query().Get("wait") != "true" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"id": fmt.Sprint(d.ids)})
+		case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/messages/"):
+			post.Edits = strings.TrimPrefix(r.URL.Path, "/messages/")
+			if n, err := strconv.Atoi(post.Edits); err != nil || n < 1 || n > d.ids {
+				http.Error(w, "unknown message", http.StatusNotFound)
+				return
+			}
+			d.posts = append(d.posts, post)
+			json.NewEncoder(w).Encode(map[string]string{"id": post.Edits})
+		default:
+			http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+// Messages posted and edited so far, in order
+func (d *testDiscord) Posts() []discordPost {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]discordPost(nil), d.posts...)
+}
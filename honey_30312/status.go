@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// API status values understood without configuration, by NIP-53 status
+var defaultStatusMap = map[string]string{
+	"open":        "open",
+	"live":        "open",
+	"private":     "private",
+	"invite-only": "private",
+	"closed":      "closed",
+	"ended":       "closed",
+}
+
+// statusMapper normalizes the status a honey room reports to one of
+// NIP-53's open, private and closed, so nonstandard values never reach
+// relays
+type statusMapper struct {
+	values map[string]string // lowercased API value -> NIP-53 status
+}
+
+// Set up the status mapping from STATUS_MAP, a comma-separated list of
+// value=status pairs (e.g. "started=open,members=private") that add to or
+// override the defaults
+func newStatusMapperFromEnv() (*statusMapper, error) {
+	return parseStatusMap(os.Getenv("STATUS_MAP"))
+}
+
+func parseStatusMap(value string) (*statusMapper, error) {
+	m := &statusMapper{values: make(map[string]string)}
+	for from, to := range defaultStatusMap {
+		m.values[from] = to
+	}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, found := strings.Cut(pair, "=")
+		from, to = strings.ToLower(strings.TrimSpace(from)), strings.TrimSpace(to)
+		if !found || from == "" {
+			return nil, fmt.Errorf("invalid STATUS_MAP entry %q: want value=status", pair)
+		}
+		switch to {
+		case "open", "private", "closed":
+		default:
+			return nil, fmt.Errorf("invalid STATUS_MAP entry %q: status must be open, private or closed", pair)
+		}
+		m.values[from] = to
+	}
+	return m, nil
+}
+
+// NIP-53 status for an API status value, false when it isn't mapped. A
+// nil mapper uses the defaults.
+func (m *statusMapper) normalize(value string) (string, bool) {
+	values := defaultStatusMap
+	if m != nil {
+		values = m.values
+	}
+	status, ok := values[strings.ToLower(strings.TrimSpace(value))]
+	return status, ok
+}
+
+// Mapped values, for logging the configuration
+func (m *statusMapper) String() string {
+	pairs := make([]string, 0, len(m.values))
+	for from, to := range m.values {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,421 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscordClient posts and edits Discord webhook messages. It follows
+// Discord's rate limits as the responses report them, per bucket and
+// globally, waiting exactly as long as Discord asks, retries failures
+// that may go away and gives up at once on ones that won't. The zero
+// value is ready to use and safe for concurrent use.
+type DiscordClient struct {
+	HTTP *http.Client // http.DefaultClient when nil
+
+	// Attempts per message, counting the first, 3 when unset
+	MaxAttempts int
+	// Wait before retrying a server or network error, 2s when unset
+	RetryDelay time.Duration
+
+	// Time and waiting, for tests; the real clock when nil
+	Now   func() time.Time
+	Sleep func(ctx context.Context, d time.Duration) error
+
+	mu      sync.Mutex
+	routes  map[string]string // route -> Discord's bucket ID
+	buckets map[string]rateBucket
+	global  time.Time // no requests at all before this
+	stats   map[string]*WebhookStats
+}
+
+// A rate limit bucket: requests left, and when it refills
+type rateBucket struct {
+	remaining int
+	reset     time.Time
+}
+
+// WebhookStats counts what happened to the messages sent to one webhook
+type WebhookStats struct {
+	Delivered   int // posted or edited
+	Failed      int // given up on
+	Retries     int // attempts after the first
+	RateLimited int // 429 responses
+
+	LastError    string
+	LastDelivery time.Time
+}
+
+// PermanentError is a webhook failure retrying won't fix: a deleted
+// webhook (404), a bad token (401, 403) or a payload Discord rejects (400)
+type PermanentError struct {
+	Status int
+	Body   string
+
+	// What returned it, "discord webhook" when empty
+	Service string
+}
+
+func (e *PermanentError) Error() string {
+	service := e.Service
+	if service == "" {
+		service = "discord webhook"
+	}
+	return fmt.Sprintf("%s returned status %d: %s", service, e.Status, e.Body)
+}
+
+// IsPermanent reports whether err is a PermanentError
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// A failure worth retrying, after wait when Discord said how long
+type retryableError struct {
+	err  error
+	wait time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Post posts a message to a webhook
+func (c *DiscordClient) Post(ctx context.Context, webhookURL string, message DiscordWebhookMessage) error {
+	return c.Send(ctx, http.MethodPost, webhookURL, message, nil)
+}
+
+// PostWait posts a message and returns its ID, so it can be edited later.
+// The ID is empty if the message was posted but Discord's reply couldn't
+// be read.
+func (c *DiscordClient) PostWait(ctx context.Context, webhookURL string, message DiscordWebhookMessage) (string, error) {
+	postURL, err := WebhookMessageURL(webhookURL, "")
+	if err != nil {
+		return "", err
+	}
+	var posted struct {
+		ID string `json:"id"`
+	}
+	err = c.Send(ctx, http.MethodPost, postURL, message, &posted)
+	return posted.ID, err
+}
+
+// Edit replaces a message posted through the webhook
+func (c *DiscordClient) Edit(ctx context.Context, webhookURL, messageID string, message DiscordWebhookMessage) error {
+	editURL, err := WebhookMessageURL(webhookURL, messageID)
+	if err != nil {
+		return err
+	}
+	return c.Send(ctx, http.MethodPatch, editURL, message, nil)
+}
+
+// Send makes a webhook request, decoding Discord's reply into reply when
+// it isn't nil. It waits out rate limits and retries rate limited, server
+// and network failures up to MaxAttempts; a PermanentError is returned at
+// once.
+func (c *DiscordClient) Send(ctx context.Context, method, webhookURL string, message DiscordWebhookMessage, reply interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	name := WebhookName(webhookURL)
+	route := method + " " + routeOf(webhookURL)
+
+	attempts := c.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	for attempt := 1; ; attempt++ {
+		if err := c.waitForLimits(ctx, route); err != nil {
+			return err
+		}
+		err = c.do(ctx, method, webhookURL, route, payload, reply)
+		if err == nil {
+			c.record(name, func(s *WebhookStats) {
+				s.Delivered++
+				s.LastDelivery = c.now()
+			})
+			return nil
+		}
+
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || attempt == attempts {
+			c.record(name, func(s *WebhookStats) {
+				s.Failed++
+				s.LastError = err.Error()
+			})
+			return err
+		}
+		wait := retryable.wait
+		if wait == 0 {
+			wait = c.RetryDelay
+			if wait <= 0 {
+				wait = 2 * time.Second
+			}
+		}
+		c.record(name, func(s *WebhookStats) { s.Retries++ })
+		log.Printf("Discord webhook %s: %v, retrying in %v", name, err, wait)
+		if err := c.sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// One request, updating the rate limit state from the response
+func (c *DiscordClient) do(ctx context.Context, method, webhookURL, route string, payload []byte, reply interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, webhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return withoutURL(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &retryableError{err: withoutURL(err)}
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	wait := c.updateLimits(route, resp, body)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		c.record(WebhookName(webhookURL), func(s *WebhookStats) { s.RateLimited++ })
+		return &retryableError{err: fmt.Errorf("rate limited for %v", wait), wait: wait}
+	case resp.StatusCode >= 500:
+		return &retryableError{err: fmt.Errorf("discord webhook returned status %d", resp.StatusCode)}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return &PermanentError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+
+	// The message is delivered even if the reply can't be read, so this
+	// mustn't be retried
+	if reply != nil {
+		if err := json.Unmarshal(body, reply); err != nil {
+			log.Printf("Error reading Discord response: %v", err)
+		}
+	}
+	return nil
+}
+
+// Record the rate limit headers of a response. For a 429 it returns how
+// long Discord asked us to wait.
+func (c *DiscordClient) updateLimits(route string, resp *http.Response, body []byte) time.Duration {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resetAfter, hasReset := parseSeconds(resp.Header.Get("X-RateLimit-Reset-After"))
+	if bucket := resp.Header.Get("X-RateLimit-Bucket"); bucket != "" {
+		if c.routes == nil {
+			c.routes = make(map[string]string)
+			c.buckets = make(map[string]rateBucket)
+		}
+		c.routes[route] = bucket
+		if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil && hasReset {
+			c.buckets[bucket] = rateBucket{remaining: remaining, reset: now.Add(resetAfter)}
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+
+	// How long to wait: the body's retry_after is the most precise, then
+	// the headers
+	var limited struct {
+		RetryAfter float64 `json:"retry_after"`
+		Global     bool    `json:"global"`
+	}
+	json.Unmarshal(body, &limited)
+	wait := time.Duration(limited.RetryAfter * float64(time.Second))
+	if wait <= 0 && hasReset {
+		wait = resetAfter
+	}
+	if wait <= 0 {
+		wait, _ = parseSeconds(resp.Header.Get("Retry-After"))
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	if limited.Global || resp.Header.Get("X-RateLimit-Global") == "true" || resp.Header.Get("X-RateLimit-Scope") == "global" {
+		c.global = now.Add(wait)
+	} else if bucket, ok := c.routes[route]; ok {
+		c.buckets[bucket] = rateBucket{remaining: 0, reset: now.Add(wait)}
+	}
+	return wait
+}
+
+// Wait until the route's bucket has requests left and no global limit
+// is in force
+func (c *DiscordClient) waitForLimits(ctx context.Context, route string) error {
+	for {
+		now := c.now()
+		c.mu.Lock()
+		until := c.global
+		if bucketID, ok := c.routes[route]; ok {
+			bucket := c.buckets[bucketID]
+			if bucket.remaining <= 0 && bucket.reset.After(until) {
+				until = bucket.reset
+			}
+			if bucket.remaining > 0 && now.Before(bucket.reset) {
+				// Spend one of the remaining requests
+				bucket.remaining--
+				c.buckets[bucketID] = bucket
+			}
+		}
+		c.mu.Unlock()
+
+		if !now.Before(until) {
+			return nil
+		}
+		if err := c.sleep(ctx, until.Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+// Errors from building and making requests quote the URL, which for a
+// webhook or the Telegram API holds a token. Keep only what went wrong, so
+// tokens don't end up in logs or an outbox entry's LastError.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
+
+// Stats returns delivery stats by webhook, keyed by WebhookName
+func (c *DiscordClient) Stats() map[string]WebhookStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := make(map[string]WebhookStats, len(c.stats))
+	for name, s := range c.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// LogStats logs one line of delivery stats per webhook used so far
+func (c *DiscordClient) LogStats() {
+	stats := c.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := stats[name]
+		log.Printf("Discord webhook %s: %d delivered, %d failed, %d retries, %d rate limited, last error: %q",
+			name, s.Delivered, s.Failed, s.Retries, s.RateLimited, s.LastError)
+	}
+}
+
+func (c *DiscordClient) record(name string, update func(*WebhookStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]*WebhookStats)
+	}
+	s, ok := c.stats[name]
+	if !ok {
+		s = &WebhookStats{}
+		c.stats[name] = s
+	}
+	update(s)
+}
+
+func (c *DiscordClient) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *DiscordClient) sleep(ctx context.Context, d time.Duration) error {
+	if c.Sleep != nil {
+		return c.Sleep(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WebhookMessageURL is the URL of a message posted through a webhook, to
+// edit it, or with no message ID the webhook URL with wait=true, so
+// Discord returns the message it posts
+func WebhookMessageURL(webhookURL, messageID string) (string, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", err
+	}
+	if messageID != "" {
+		u.Path = strings.TrimRight(u.Path, "/") + "/messages/" + url.PathEscape(messageID)
+		return u.String(), nil
+	}
+	query := u.Query()
+	query.Set("wait", "true")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// WebhookName identifies a webhook in logs and stats without its token:
+// the webhook ID for Discord URLs, otherwise the host and path
+func WebhookName(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "invalid webhook URL"
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, part := range parts {
+		if part == "webhooks" && i+1 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return u.Host + strings.TrimRight(u.Path, "/")
+}
+
+// The webhook a request goes to with message IDs left out, since Discord
+// shares rate limits between a webhook's messages
+func routeOf(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return webhookURL
+	}
+	path := u.Path
+	if i := strings.Index(path, "/messages/"); i >= 0 {
+		path = path[:i] + "/messages/:id"
+	}
+	return u.Host + path
+}
+
+// Seconds as Discord sends them, e.g. "1" or "0.352"
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTime is a clock that only moves when the client sleeps
+type fakeTime struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (f *fakeTime) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeTime) Sleep(ctx context.Context, d time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.slept = append(f.slept, d)
+	return nil
+}
+
+// Client against a webhook answering with the given handlers in turn
+func newTestClient(t *testing.T, handlers ...http.HandlerFunc) (*DiscordClient, *fakeTime, string, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests >= len(handlers) {
+			t.Errorf("unexpected request %d: %s %s", requests+1, r.Method, r.URL)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		requests++
+		handlers[requests-1](w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	client := &DiscordClient{Now: clock.Now, Sleep: clock.Sleep}
+	return client, clock, server.URL + "/api/webhooks/1234/secret-token", &requests
+}
+
+func respond(status int, headers map[string]string, body interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(status)
+		if body != nil {
+			json.NewEncoder(w).Encode(body)
+		}
+	}
+}
+
+func TestClientWaitsAsLongAsDiscordSays(t *testing.T) {
+	client, clock, webhook, requests := newTestClient(t,
+		respond(http.StatusTooManyRequests, map[string]string{
+			"Retry-After":        "2",
+			"X-RateLimit-Bucket": "abc",
+		}, map[string]interface{}{"retry_after": 1.5, "global": false}),
+		respond(http.StatusOK, map[string]string{
+			"X-RateLimit-Bucket":      "abc",
+			"X-RateLimit-Remaining":   "0",
+			"X-RateLimit-Reset-After": "0.25",
+		}, map[string]string{"id": "42"}),
+		respond(http.StatusNoContent, nil, nil),
+	)
+
+	id, err := client.PostWait(context.Background(), webhook, DiscordWebhookMessage{Content: "hi"})
+	if err != nil || id != "42" {
+		t.Fatalf("PostWait = %q, %v", id, err)
+	}
+	// The bucket is empty, so the edit waits for it to refill
+	if err := client.Edit(context.Background(), webhook, id, DiscordWebhookMessage{Content: "edited"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []time.Duration{1500 * time.Millisecond}; !reflect.DeepEqual(clock.slept, want) {
+		t.Errorf("slept %v, want %v", clock.slept, want)
+	}
+	if *requests != 3 {
+		t.Errorf("made %d requests, want 3", *requests)
+	}
+	stats := client.Stats()["1234"]
+	if stats.Delivered != 2 || stats.RateLimited != 1 || stats.Retries != 1 || stats.Failed != 0 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestClientWaitsForEmptyBucket(t *testing.T) {
+	client, clock, webhook, _ := newTestClient(t,
+		respond(http.StatusNoContent, map[string]string{
+			"X-RateLimit-Bucket":      "abc",
+			"X-RateLimit-Remaining":   "0",
+			"X-RateLimit-Reset-After": "0.75",
+		}, nil),
+		respond(http.StatusNoContent, nil, nil),
+	)
+	for i := 0; i < 2; i++ {
+		if err := client.Post(context.Background(), webhook, DiscordWebhookMessage{Content: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []time.Duration{750 * time.Millisecond}; !reflect.DeepEqual(clock.slept, want) {
+		t.Errorf("slept %v, want %v", clock.slept, want)
+	}
+}
+
+func TestClientPermanentFailures(t *testing.T) {
+	client, _, webhook, requests := newTestClient(t,
+		respond(http.StatusNotFound, nil, map[string]interface{}{"message": "Unknown Webhook", "code": 10015}),
+	)
+	err := client.Post(context.Background(), webhook, DiscordWebhookMessage{Content: "hi"})
+	if !IsPermanent(err) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+	if *requests != 1 {
+		t.Errorf("a deleted webhook was retried: %d requests", *requests)
+	}
+	if stats := client.Stats()["1234"]; stats.Failed != 1 || stats.LastError == "" {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	client, clock, webhook, requests := newTestClient(t,
+		respond(http.StatusBadGateway, nil, nil),
+		respond(http.StatusInternalServerError, nil, nil),
+		respond(http.StatusServiceUnavailable, nil, nil),
+	)
+	err := client.Post(context.Background(), webhook, DiscordWebhookMessage{Content: "hi"})
+	if err == nil || IsPermanent(err) {
+		t.Fatalf("err = %v, want a retryable error", err)
+	}
+	if *requests != 3 || len(clock.slept) != 2 || clock.slept[0] != 2*time.Second {
+		t.Errorf("%d requests, slept %v", *requests, clock.slept)
+	}
+}
+
+func TestNetworkErrorsLeaveOutTheToken(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	webhook := server.URL + "/api/webhooks/1234/secret-token"
+
+	client := &DiscordClient{MaxAttempts: 1}
+	err := client.Post(context.Background(), webhook, DiscordWebhookMessage{Content: "hi"})
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("discord: err = %v", err)
+	}
+
+	telegram := &TelegramNotifier{Token: "123:secret-token", ChatID: "1", APIURL: server.URL, Delivery: Delivery{MaxAttempts: 1}}
+	err = telegram.Notify(context.Background(), testNotification())
+	if err == nil || strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("telegram: err = %v", err)
+	}
+}
+
+func TestWebhookURLs(t *testing.T) {
+	webhook := "https://discord.com/api/webhooks/1234/token?thread_id=9"
+	if got, _ := WebhookMessageURL(webhook, ""); got != "https://discord.com/api/webhooks/1234/token?thread_id=9&wait=true" {
+		t.Errorf("post URL = %s", got)
+	}
+	if got, _ := WebhookMessageURL(webhook, "77"); got != "https://discord.com/api/webhooks/1234/token/messages/77?thread_id=9" {
+		t.Errorf("edit URL = %s", got)
+	}
+	if got := WebhookName(webhook); got != "1234" {
+		t.Errorf("WebhookName = %s, want the ID without the token", got)
+	}
+}
@@ -0,0 +1,206 @@
+// Package notify holds what the pollers and the Discord listener share
+// for posting notifications: Discord webhook messages with rich embeds,
+// and the limits Discord puts on them, and notifiers that send the same
+// notification to Discord, Slack, Matrix, Telegram or a signed JSON
+// webhook.
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Discord's limits, in characters
+// (https://discord.com/developers/docs/resources/message#embed-object-embed-limits)
+const (
+	MaxContent          = 2000
+	MaxEmbeds           = 10 // per message
+	MaxEmbedTitle       = 256
+	MaxEmbedDescription = 4096
+	MaxEmbedFields      = 25
+	MaxFieldName        = 256
+	MaxFieldValue       = 1024
+	MaxFooterText       = 2048
+	MaxEmbedsTotal      = 6000 // all titles, descriptions, fields and footers of a message
+)
+
+// Embed colors by room status
+const (
+	ColorOpen    = 0x2ecc71
+	ColorPrivate = 0x9b59b6
+	ColorClosed  = 0xe74c3c
+	ColorPlanned = 0x3498db
+	ColorOther   = 0x95a5a6
+)
+
+// DiscordWebhookMessage is the body of a Discord webhook post. Content is
+// shown above the embeds, and on its own by clients and notifications
+// that don't render them.
+type DiscordWebhookMessage struct {
+	Content string         `json:"content,omitempty"`
+	Embeds  []DiscordEmbed `json:"embeds,omitempty"`
+}
+
+// DiscordEmbed is a rich embed. Title links to URL when set.
+type DiscordEmbed struct {
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	URL         string              `json:"url,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Timestamp   string              `json:"timestamp,omitempty"` // RFC 3339
+	Thumbnail   *DiscordEmbedImage  `json:"thumbnail,omitempty"`
+	Fields      []DiscordEmbedField `json:"fields,omitempty"`
+	Footer      *DiscordEmbedFooter `json:"footer,omitempty"`
+}
+
+type DiscordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+type DiscordEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"`
+}
+
+type DiscordEmbedFooter struct {
+	Text string `json:"text"`
+}
+
+// StatusColor is the embed color for a NIP-53 status, or a live activity's
+// live/planned/ended
+func StatusColor(status string) int {
+	switch status {
+	case "open", "live":
+		return ColorOpen
+	case "private":
+		return ColorPrivate
+	case "closed", "ended":
+		return ColorClosed
+	case "planned":
+		return ColorPlanned
+	}
+	return ColorOther
+}
+
+// DiscordTimestamp formats t so Discord shows it in each reader's own
+// time zone. Style is one of Discord's t, T, d, D, f, F or R.
+func DiscordTimestamp(t time.Time, style byte) string {
+	return fmt.Sprintf("<t:%d:%c>", t.Unix(), style)
+}
+
+// AddField appends a field, skipping empty values, which Discord rejects
+func (e *DiscordEmbed) AddField(name, value string, inline bool) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+	e.Fields = append(e.Fields, DiscordEmbedField{Name: name, Value: value, Inline: inline})
+}
+
+// Characters of the embed counted towards MaxEmbedsTotal
+func (e DiscordEmbed) size() int {
+	n := utf8.RuneCountInString(e.Title) + utf8.RuneCountInString(e.Description)
+	for _, field := range e.Fields {
+		n += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+	}
+	if e.Footer != nil {
+		n += utf8.RuneCountInString(e.Footer.Text)
+	}
+	return n
+}
+
+// Fit shortens the embed to Discord's limits: each part is truncated to
+// its own limit, fields past MaxEmbedFields are dropped, and if it's still
+// over MaxEmbedsTotal trailing fields go first, then description and
+// footer text are cut.
+func (e DiscordEmbed) Fit() DiscordEmbed {
+	e.Title = Truncate(e.Title, MaxEmbedTitle)
+	e.Description = Truncate(e.Description, MaxEmbedDescription)
+	fields := e.Fields
+	if len(fields) > MaxEmbedFields {
+		fields = fields[:MaxEmbedFields]
+	}
+	e.Fields = make([]DiscordEmbedField, len(fields))
+	for i, field := range fields {
+		e.Fields[i] = DiscordEmbedField{
+			Name:   Truncate(field.Name, MaxFieldName),
+			Value:  Truncate(field.Value, MaxFieldValue),
+			Inline: field.Inline,
+		}
+	}
+	if e.Footer != nil {
+		e.Footer = &DiscordEmbedFooter{Text: Truncate(e.Footer.Text, MaxFooterText)}
+	}
+
+	for e.size() > MaxEmbedsTotal && len(e.Fields) > 0 {
+		e.Fields = e.Fields[:len(e.Fields)-1]
+	}
+	if over := e.size() - MaxEmbedsTotal; over > 0 {
+		e.Description = Truncate(e.Description, utf8.RuneCountInString(e.Description)-over)
+	}
+	if over := e.size() - MaxEmbedsTotal; over > 0 && e.Footer != nil {
+		e.Footer.Text = Truncate(e.Footer.Text, utf8.RuneCountInString(e.Footer.Text)-over)
+	}
+	return e
+}
+
+// DiscordMessages packs embeds, in order, into as few webhook messages as
+// Discord accepts: at most MaxEmbeds embeds and MaxEmbedsTotal characters
+// each. Each message's content lists the titles and links of its embeds as
+// a plain-text fallback.
+func DiscordMessages(embeds []DiscordEmbed) []DiscordWebhookMessage {
+	messages := []DiscordWebhookMessage{}
+	var current []DiscordEmbed
+	size := 0
+	for _, embed := range embeds {
+		embed = embed.Fit()
+		if len(current) == MaxEmbeds || (len(current) > 0 && size+embed.size() > MaxEmbedsTotal) {
+			messages = append(messages, DiscordWebhookMessage{Content: fallbackContent(current), Embeds: current})
+			current, size = nil, 0
+		}
+		current = append(current, embed)
+		size += embed.size()
+	}
+	if len(current) > 0 {
+		messages = append(messages, DiscordWebhookMessage{Content: fallbackContent(current), Embeds: current})
+	}
+	return messages
+}
+
+// One line per embed with its title and link. The link is in angle
+// brackets so Discord doesn't add a preview of its own.
+func fallbackContent(embeds []DiscordEmbed) string {
+	lines := make([]string, 0, len(embeds))
+	for _, embed := range embeds {
+		line := embed.Title
+		if embed.URL != "" {
+			line += " <" + embed.URL + ">"
+		}
+		lines = append(lines, line)
+	}
+	return Truncate(strings.Join(lines, "\n"), MaxContent)
+}
+
+// Truncate shortens s to at most max characters, ending it with an
+// ellipsis when anything was cut
+func Truncate(s string, max int) string {
+	return TruncateWith(s, max, "…")
+}
+
+// TruncateWith shortens s to at most max characters including suffix,
+// which is added when anything was cut. It never splits a character.
+func TruncateWith(s string, max int, suffix string) string {
+	if max <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	keep := max - utf8.RuneCountInString(suffix)
+	if keep <= 0 {
+		return string([]rune(suffix)[:max])
+	}
+	return string([]rune(s)[:keep]) + suffix
+}
@@ -0,0 +1,82 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateKeepsCharactersWhole(t *testing.T) {
+	tests := []struct {
+		s    string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer title", 8, "a longe…"},
+		{"🟢🟢🟢🟢", 3, "🟢🟢…"},
+		{"anything", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := Truncate(tt.s, tt.max); got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.s, tt.max, got, tt.want)
+		}
+	}
+	if got := TruncateWith("hello world", 8, " [cut]"); got != "he [cut]" {
+		t.Errorf("TruncateWith = %q", got)
+	}
+}
+
+func TestFitEnforcesLimits(t *testing.T) {
+	embed := DiscordEmbed{
+		Title:       strings.Repeat("t", 300),
+		Description: strings.Repeat("d", 5000),
+		Footer:      &DiscordEmbedFooter{Text: "footer"},
+	}
+	for i := 0; i < 30; i++ {
+		embed.AddField(strings.Repeat("n", 300), strings.Repeat("v", 2000), true)
+	}
+	embed.AddField("Empty", " ", false)
+
+	fitted := embed.Fit()
+	if n := utf8.RuneCountInString(fitted.Title); n != MaxEmbedTitle {
+		t.Errorf("title has %d characters, want %d", n, MaxEmbedTitle)
+	}
+	for _, field := range fitted.Fields {
+		if utf8.RuneCountInString(field.Name) > MaxFieldName || utf8.RuneCountInString(field.Value) > MaxFieldValue {
+			t.Fatalf("field over its limits: %d/%d", len(field.Name), len(field.Value))
+		}
+	}
+	if fitted.size() > MaxEmbedsTotal {
+		t.Errorf("fitted embed has %d characters, over %d", fitted.size(), MaxEmbedsTotal)
+	}
+	// Fields give way before the description does
+	if len(fitted.Fields) != 1 || fitted.Footer.Text != "footer" {
+		t.Errorf("kept %d fields and footer %q", len(fitted.Fields), fitted.Footer.Text)
+	}
+	if len(embed.Fields) != 30 {
+		t.Errorf("Fit changed the original embed's fields")
+	}
+}
+
+func TestDiscordMessagesSplitsByCountAndSize(t *testing.T) {
+	embeds := []DiscordEmbed{}
+	for i := 0; i < 12; i++ {
+		embeds = append(embeds, DiscordEmbed{Title: "Room", URL: "https://honey.test/room"})
+	}
+	messages := DiscordMessages(embeds)
+	if len(messages) != 2 || len(messages[0].Embeds) != MaxEmbeds || len(messages[1].Embeds) != 2 {
+		t.Fatalf("12 small embeds packed as %d messages", len(messages))
+	}
+	if want := "Room <https://honey.test/room>\nRoom <https://honey.test/room>"; messages[1].Content != want {
+		t.Errorf("fallback content = %q, want %q", messages[1].Content, want)
+	}
+
+	// Two embeds of 4000 characters can't share a message
+	big := DiscordEmbed{Title: "Big", Description: strings.Repeat("x", 3997)}
+	messages = DiscordMessages([]DiscordEmbed{big, big})
+	if len(messages) != 2 {
+		t.Errorf("oversized pair packed as %d messages, want 2", len(messages))
+	}
+}
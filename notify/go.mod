@@ -0,0 +1,3 @@
+module github.com/bitcarrot/hivetalk/scheduler/notify
+
+go 1.19
@@ -0,0 +1,369 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notifier delivers notifications to one place: a Discord or Slack
+// webhook, a Matrix room, a Telegram chat or any HTTP endpoint
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notification is what happened, in a form every Notifier can render the
+// way its platform shows it best
+type Notification struct {
+	// What happened, e.g. "open", "closed" or "renamed", for receivers
+	// that handle kinds differently and for filtering sinks
+	Kind string `json:"kind"`
+
+	Title       string              `json:"title"`
+	URL         string              `json:"url,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Fields      []NotificationField `json:"fields,omitempty"`
+	Color       int                 `json:"color,omitempty"`
+	Image       string              `json:"image,omitempty"`
+	Time        time.Time           `json:"time"`
+}
+
+// NotificationField is a labelled value, e.g. Status: open
+type NotificationField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// AddField appends a field, skipping blank values
+func (n *Notification) AddField(name, value string) {
+	if strings.TrimSpace(value) == "" {
+		return
+	}
+	n.Fields = append(n.Fields, NotificationField{Name: name, Value: value})
+}
+
+// PlainText renders the notification without markup: the title, the
+// description, one line per field and the link
+func (n Notification) PlainText() string {
+	lines := []string{n.Title}
+	if n.Description != "" {
+		lines = append(lines, n.Description)
+	}
+	for _, field := range n.Fields {
+		lines = append(lines, field.Name+": "+field.Value)
+	}
+	if n.URL != "" {
+		lines = append(lines, n.URL)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Format is how a notifier renders notifications: in its platform's rich
+// formatting unless Plain is set, with the plain text from Template when
+// there is one
+type Format struct {
+	Plain    bool
+	Template *template.Template
+}
+
+// Text is a notification's plain text, from the template if there is one
+func (f Format) Text(n Notification) string {
+	if f.Template == nil {
+		return n.PlainText()
+	}
+	var text strings.Builder
+	if err := f.Template.Execute(&text, n); err != nil {
+		log.Printf("Error rendering notification template %s: %v", f.Template.Name(), err)
+		return n.PlainText()
+	}
+	return text.String()
+}
+
+// Delivery is how the HTTP notifiers other than Discord's send requests:
+// rate limited, server and network failures are retried up to MaxAttempts,
+// after the wait the service asks for or RetryDelay; any other failure is
+// a PermanentError
+type Delivery struct {
+	HTTP *http.Client // http.DefaultClient when nil
+
+	// Attempts per notification, counting the first, 3 when unset
+	MaxAttempts int
+	// Wait before retrying when the service doesn't say, 2s when unset
+	RetryDelay time.Duration
+}
+
+// An HTTP request to make, and how to read how long a 429 asks to wait
+type deliveryRequest struct {
+	service string // for errors and logs, e.g. "slack webhook"
+	method  string
+	url     string
+	header  http.Header
+	body    []byte
+
+	// Wait asked for in a rate limited response's body, 0 for the
+	// Retry-After header
+	retryAfter func(body []byte) time.Duration
+}
+
+func (d Delivery) send(ctx context.Context, req deliveryRequest) error {
+	attempts := d.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	for attempt := 1; ; attempt++ {
+		wait, err := d.do(ctx, req)
+		if err == nil || wait < 0 || attempt == attempts {
+			return err
+		}
+		if wait == 0 {
+			wait = d.RetryDelay
+			if wait <= 0 {
+				wait = 2 * time.Second
+			}
+		}
+		log.Printf("%s: %v, retrying in %v", req.service, err, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// One attempt. The wait is how long to wait before retrying, 0 when the
+// service didn't say and -1 when the request mustn't be retried.
+func (d Delivery) do(ctx context.Context, req deliveryRequest) (time.Duration, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, req.url, bytes.NewReader(req.body))
+	if err != nil {
+		return -1, withoutURL(err)
+	}
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	client := d.HTTP
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, withoutURL(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		var wait time.Duration
+		if req.retryAfter != nil {
+			wait = req.retryAfter(body)
+		}
+		if wait <= 0 {
+			wait, _ = parseSeconds(resp.Header.Get("Retry-After"))
+		}
+		if wait <= 0 {
+			wait = time.Second
+		}
+		return wait, fmt.Errorf("rate limited for %v", wait)
+	case resp.StatusCode >= 500:
+		return 0, fmt.Errorf("%s returned status %d", req.service, resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return -1, &PermanentError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body)), Service: req.service}
+	}
+	return 0, nil
+}
+
+// Sink is a notifier as configured: named for logs, limited to Limit and,
+// when Kinds isn't empty, only sent notifications of those kinds
+type Sink struct {
+	Name     string
+	Notifier Notifier
+	Limit    Limit
+	Kinds    []string
+}
+
+// Limit allows N notifications in any period of Per; no limit when N is 0
+type Limit struct {
+	N   int
+	Per time.Duration
+}
+
+func (l Limit) String() string {
+	if l.N <= 0 {
+		return "none"
+	}
+	return fmt.Sprintf("%d/%v", l.N, l.Per)
+}
+
+// Sliding window of the last Limit.N send times
+type rateLimiter struct {
+	limit Limit
+	sent  []time.Time
+}
+
+// How long to wait at now before sending the next notification
+func (r *rateLimiter) wait(now time.Time) time.Duration {
+	if r.limit.N <= 0 || len(r.sent) < r.limit.N {
+		return 0
+	}
+	if wait := r.sent[0].Add(r.limit.Per).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Record a send at now
+func (r *rateLimiter) record(now time.Time) {
+	if r.limit.N <= 0 {
+		return
+	}
+	r.sent = append(r.sent, now)
+	if len(r.sent) > r.limit.N {
+		r.sent = r.sent[len(r.sent)-r.limit.N:]
+	}
+}
+
+// Notifications waiting per sink before new ones are dropped
+const dispatchQueueSize = 100
+
+// Dispatcher sends each notification to every sink that wants it. Every
+// sink has its own queue and worker, so a slow or rate limited sink holds
+// up neither the others nor the caller. A nil Dispatcher does nothing.
+type Dispatcher struct {
+	queues []*sinkQueue
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// Guards the queues being closed, so a Notify racing Close, say from a
+	// webhook handler still running during shutdown, drops its
+	// notification instead of sending on a closed channel
+	mu     sync.RWMutex
+	closed bool
+}
+
+type sinkQueue struct {
+	Sink
+	queue   chan Notification
+	limiter rateLimiter
+}
+
+// NewDispatcher starts a worker per sink
+func NewDispatcher(sinks []Sink) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{cancel: cancel}
+	for _, sink := range sinks {
+		q := &sinkQueue{
+			Sink:    sink,
+			queue:   make(chan Notification, dispatchQueueSize),
+			limiter: rateLimiter{limit: sink.Limit},
+		}
+		d.queues = append(d.queues, q)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			q.run(ctx)
+		}()
+	}
+	return d
+}
+
+// Notify queues a notification for every sink that wants it. It never
+// blocks: a sink whose queue is full misses the notification, as does
+// every sink once the dispatcher is closed.
+func (d *Dispatcher) Notify(n Notification) {
+	if d == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		log.Printf("Notifiers closed, dropping %q", n.Title)
+		return
+	}
+	for _, q := range d.queues {
+		if !q.wants(n.Kind) {
+			continue
+		}
+		select {
+		case q.queue <- n:
+		default:
+			log.Printf("Notifier %s: queue full, dropping %q", q.Name, n.Title)
+		}
+	}
+}
+
+// Close stops taking notifications and waits for the queued ones to be
+// sent, or for ctx to be done
+func (d *Dispatcher) Close(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.closed = true
+	for _, q := range d.queues {
+		close(q.queue)
+	}
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Notifiers: giving up on queued notifications: %v", ctx.Err())
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+}
+
+func (q *sinkQueue) wants(kind string) bool {
+	if len(q.Kinds) == 0 {
+		return true
+	}
+	for _, k := range q.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *sinkQueue) run(ctx context.Context) {
+	for n := range q.queue {
+		if ctx.Err() != nil {
+			continue
+		}
+		if wait := q.limiter.wait(time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				continue
+			}
+		}
+		q.limiter.record(time.Now())
+		if err := q.Notifier.Notify(ctx, n); err != nil {
+			log.Printf("Notifier %s: failed to send %q: %v", q.Name, n.Title, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request a sink made
+type sinkRequest struct {
+	method, path string
+	header       http.Header
+	body         []byte
+	raw          []byte // as sent, for signatures
+}
+
+// newTestSink serves the given status and body, recording requests
+func newTestSink(t *testing.T, status int, reply string) (*httptest.Server, func() []sinkRequest) {
+	var mu sync.Mutex
+	var requests []sinkRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		// Undo encoding/json's escaping of HTML, to compare bodies as written
+		body := []byte(strings.NewReplacer(`\u003c`, "<", `\u003e`, ">", `\u0026`, "&").Replace(string(raw)))
+		mu.Lock()
+		requests = append(requests, sinkRequest{method: r.Method, path: r.URL.EscapedPath(), header: r.Header, body: body, raw: raw})
+		mu.Unlock()
+		w.WriteHeader(status)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []sinkRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]sinkRequest(nil), requests...)
+	}
+}
+
+func testNotification() Notification {
+	n := Notification{
+		Kind:  "open",
+		Title: "🟢 Bitcoin & Beer",
+		URL:   "https://honey.test/room/abc",
+		Color: ColorOpen,
+		Image: "https://honey.test/abc.png",
+		Time:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+	}
+	n.AddField("Status", "open")
+	n.AddField("Participants", "3")
+	n.AddField("Topic", " ")
+	return n
+}
+
+func TestSinkRequests(t *testing.T) {
+	n := testNotification()
+	tests := []struct {
+		name     string
+		notifier func(url string) Notifier
+		path     string
+		want     []string // in the body
+	}{
+		{
+			name:     "slack",
+			notifier: func(url string) Notifier { return &SlackNotifier{WebhookURL: url + "/services/x"} },
+			path:     "/services/x",
+			want:     []string{`"text":"*<https://honey.test/room/abc|🟢 Bitcoin &amp; Beer>*"`, `"text":"*Participants*\n3"`, `"accessory"`},
+		},
+		{
+			name: "matrix",
+			notifier: func(url string) Notifier {
+				return &MatrixNotifier{Homeserver: url, RoomID: "!room:matrix.test", AccessToken: "secret"}
+			},
+			path: "/_matrix/client/v3/rooms/%21room:matrix.test/send/m.room.message/",
+			want: []string{`"msgtype":"m.notice"`, `<b>Status:</b> open`, `"body":"🟢 Bitcoin & Beer\nStatus: open\nParticipants: 3\nhttps://honey.test/room/abc"`},
+		},
+		{
+			name:     "telegram",
+			notifier: func(url string) Notifier { return &TelegramNotifier{Token: "123:abc", ChatID: "@hive", APIURL: url} },
+			path:     "/bot123:abc/sendMessage",
+			want:     []string{`"chat_id":"@hive"`, `"parse_mode":"HTML"`, `<a href=\"https://honey.test/room/abc\">🟢 Bitcoin &amp; Beer</a>`},
+		},
+		{
+			name:     "discord",
+			notifier: func(url string) Notifier { return &DiscordNotifier{WebhookURL: url + "/api/webhooks/1/t"} },
+			path:     "/api/webhooks/1/t",
+			want:     []string{`"embeds":[{"title":"🟢 Bitcoin & Beer"`, `"timestamp":"2024-01-01T12:00:00Z"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newTestSink(t, http.StatusOK, `{"ok":true}`)
+			if err := test.notifier(server.URL).Notify(context.Background(), n); err != nil {
+				t.Fatal(err)
+			}
+			got := requests()
+			if len(got) != 1 || !strings.HasPrefix(got[0].path, test.path) {
+				t.Fatalf("requests %+v, want one to %s", got, test.path)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(string(got[0].body), want) {
+					t.Errorf("body %s\nmissing %s", got[0].body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPlainFormatAndTemplate(t *testing.T) {
+	server, requests := newTestSink(t, http.StatusOK, "")
+	config := SinkConfig{Type: "slack", URL: server.URL, Format: "plain", Template: "{{.Title}} is {{.Kind}}"}
+	sink, err := config.Sink(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Notifier.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	if body := string(requests()[0].body); body != `{"text":"🟢 Bitcoin &amp; Beer is open"}` {
+		t.Errorf("body %s", body)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server, requests := newTestSink(t, http.StatusNoContent, "")
+	notifier := &WebhookNotifier{URL: server.URL, Secret: "s3cret"}
+	if err := notifier.Notify(context.Background(), testNotification()); err != nil {
+		t.Fatal(err)
+	}
+	got := requests()[0]
+	timestamp := got.header.Get("X-Webhook-Timestamp")
+	if want := "sha256=" + WebhookSignature("s3cret", timestamp, got.raw); got.header.Get("X-Webhook-Signature") != want {
+		t.Errorf("signature %q, want %q", got.header.Get("X-Webhook-Signature"), want)
+	}
+	var payload struct {
+		Kind   string              `json:"kind"`
+		Fields []NotificationField `json:"fields"`
+		Text   string              `json:"text"`
+	}
+	if err := json.Unmarshal(got.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Kind != "open" || len(payload.Fields) != 2 || !strings.HasPrefix(payload.Text, "🟢 Bitcoin & Beer\n") {
+		t.Errorf("payload %+v", payload)
+	}
+}
+
+func TestSinkFailures(t *testing.T) {
+	server, requests := newTestSink(t, http.StatusBadGateway, "")
+	notifier := &TelegramNotifier{Token: "t", ChatID: "1", APIURL: server.URL, Delivery: Delivery{MaxAttempts: 2, RetryDelay: time.Millisecond}}
+	if err := notifier.Notify(context.Background(), testNotification()); err == nil || IsPermanent(err) {
+		t.Errorf("failed twice: err = %v", err)
+	}
+	if n := len(requests()); n != 2 {
+		t.Errorf("made %d attempts, want 2", n)
+	}
+
+	server, requests = newTestSink(t, http.StatusForbidden, `{"errcode":"M_FORBIDDEN"}`)
+	matrix := &MatrixNotifier{Homeserver: server.URL, RoomID: "!r:m", AccessToken: "bad"}
+	err := matrix.Notify(context.Background(), testNotification())
+	if !IsPermanent(err) || !strings.HasPrefix(err.Error(), "matrix homeserver returned status 403") {
+		t.Errorf("forbidden: err = %v", err)
+	}
+	if n := len(requests()); n != 1 {
+		t.Errorf("retried a permanent failure: %d attempts", n)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := rateLimiter{limit: Limit{N: 2, Per: time.Minute}}
+	limiter.record(start)
+	limiter.record(start.Add(10 * time.Second))
+	if wait := limiter.wait(start.Add(20 * time.Second)); wait != 40*time.Second {
+		t.Errorf("third send waits %v, want 40s", wait)
+	}
+	limiter.record(start.Add(time.Minute))
+	if wait := limiter.wait(start.Add(time.Minute)); wait != 10*time.Second {
+		t.Errorf("fourth send waits %v, want 10s", wait)
+	}
+}
+
+func TestParseLimit(t *testing.T) {
+	for value, want := range map[string]Limit{
+		"20/1m": {N: 20, Per: time.Minute},
+		"1/s":   {N: 1, Per: time.Second},
+		"none":  {},
+	} {
+		if got, err := ParseLimit(value); err != nil || got != want {
+			t.Errorf("ParseLimit(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"20", "0/1m", "5/soon"} {
+		if _, err := ParseLimit(value); err == nil {
+			t.Errorf("ParseLimit(%q) succeeded", value)
+		}
+	}
+}
+
+func TestLoadSinks(t *testing.T) {
+	os.Setenv("TEST_TELEGRAM_TOKEN", "123:abc")
+	defer os.Unsetenv("TEST_TELEGRAM_TOKEN")
+	path := filepath.Join(t.TempDir(), "sinks.json")
+	os.WriteFile(path, []byte(`[
+		{"type": "telegram", "name": "tg", "token": "${TEST_TELEGRAM_TOKEN}", "chat": "@hive"},
+		{"type": "webhook", "url": "https://example.test", "rate": "5/1m", "kinds": ["open"]}
+	]`), 0600)
+	sinks, err := LoadSinks(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sinks) != 2 || sinks[0].Notifier.(*TelegramNotifier).Token != "123:abc" || sinks[0].Limit != defaultLimits["telegram"] {
+		t.Errorf("telegram sink %+v", sinks[0])
+	}
+	if sinks[1].Name != "webhook" || sinks[1].Limit != (Limit{N: 5, Per: time.Minute}) {
+		t.Errorf("webhook sink %+v", sinks[1])
+	}
+
+	os.WriteFile(path, []byte(`[{"type": "matrix", "url": "https://matrix.test"}]`), 0600)
+	if _, err := LoadSinks(path, nil); err == nil || !strings.Contains(err.Error(), "needs room") {
+		t.Errorf("matrix sink without a room: err = %v", err)
+	}
+}
+
+// Records notifications instead of sending them
+type recordingNotifier struct {
+	mu    sync.Mutex
+	kinds []string
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds = append(r.kinds, n.Kind)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	all, opens := &recordingNotifier{}, &recordingNotifier{}
+	d := NewDispatcher([]Sink{
+		{Name: "all", Notifier: all},
+		{Name: "opens", Notifier: opens, Kinds: []string{"open"}},
+	})
+	for _, kind := range []string{"open", "closed", "renamed", "open"} {
+		d.Notify(Notification{Kind: kind})
+	}
+	d.Close(context.Background())
+
+	if got := strings.Join(all.kinds, ","); got != "open,closed,renamed,open" {
+		t.Errorf("all got %s", got)
+	}
+	if got := strings.Join(opens.kinds, ","); got != "open,open" {
+		t.Errorf("opens got %s", got)
+	}
+
+	// Late notifications, e.g. from a webhook during shutdown, are dropped
+	d.Notify(Notification{Kind: "open"})
+	d.Close(context.Background())
+	if len(all.kinds) != 4 {
+		t.Errorf("all got %d notifications after Close", len(all.kinds)-4)
+	}
+
+	var none *Dispatcher
+	none.Notify(Notification{Kind: "open"})
+	none.Close(context.Background())
+}
@@ -0,0 +1,582 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbox is a durable queue of Discord webhook requests. Messages are
+// written to disk before anything is sent and delivered in order by Run,
+// which retries with exponential backoff, so nothing is lost while Discord
+// is down or the process restarts. An entry that Discord rejects for good,
+// or that is older than MaxAge, is moved aside to the dead letters, where
+// it can be inspected and replayed.
+//
+// Entries live as one JSON file each under Dir/queue and Dir/dead, and in
+// memory. Whenever Run has been idle for a while it rereads them from
+// disk, so changes the outbox command makes while the service is running
+// are picked up within outboxIdlePoll. Delivery is at least once: a message
+// sent just before a crash is sent again. Keyed posts, once delivered, are
+// kept under Dir/posted with the message ID Discord gave them, for MaxAge,
+// so edits queued by key after a restart still find their message.
+type Outbox struct {
+	Dir    string
+	Client *DiscordClient
+
+	// Entries older than this are dead-lettered rather than sent, 24h
+	// when unset
+	MaxAge time.Duration
+	// Backoff after a failed attempt, doubling from MinBackoff up to
+	// MaxBackoff; 5s and 10m when unset
+	MinBackoff, MaxBackoff time.Duration
+
+	// Called after a queued post is delivered, with the ID Discord gave
+	// the message when the entry has a key
+	Delivered func(entry OutboxEntry, messageID string)
+	// Called after Discord rejects an entry for good, e.g. an edit of a
+	// message that was deleted from the channel, once it is dead-lettered
+	Failed func(entry OutboxEntry, err error)
+
+	// Time, for tests; time.Now when nil
+	Now func() time.Time
+
+	mu       sync.Mutex
+	lastID   int64
+	inFlight string                 // ID of the entry being sent
+	posted   map[string]OutboxEntry // key -> delivered post, with its MessageID
+	wake     chan struct{}
+
+	// Entries by folder and ID, as on disk when last loaded and since
+	// written by this Outbox
+	index  map[string]map[string]OutboxEntry
+	loaded time.Time
+}
+
+// OutboxEntry is one queued webhook request
+type OutboxEntry struct {
+	ID      string `json:"id"` // orders the queue
+	Webhook string `json:"webhook"`
+	Method  string `json:"method"` // POST, or PATCH to edit a message
+
+	// Message to edit. A PATCH with a Key but no MessageID edits the
+	// message the queued POST with that Key creates.
+	MessageID string `json:"message_id,omitempty"`
+	// Ties a post to later edits of the message it creates
+	Key string `json:"key,omitempty"`
+
+	Message DiscordWebhookMessage `json:"message"`
+
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// How long Run waits for new entries before rereading the outbox from
+// disk, to pick up changes made by the outbox command
+const outboxIdlePoll = 30 * time.Second
+
+// Outbox folders: queued entries, dead letters and delivered keyed posts
+var outboxFolders = []string{"queue", "dead", "posted"}
+
+// OpenOutbox creates the outbox directories under dir if needed and loads
+// the entries in them
+func OpenOutbox(dir string, client *DiscordClient) (*Outbox, error) {
+	for _, sub := range outboxFolders {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	o := &Outbox{Dir: dir, Client: client, wake: make(chan struct{}, 1)}
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Post queues a message for a webhook. With a key, the message's ID is
+// passed to Delivered and later edits with the same key can refer to it.
+func (o *Outbox) Post(webhookURL, key string, message DiscordWebhookMessage) error {
+	return o.Enqueue(OutboxEntry{Webhook: webhookURL, Method: http.MethodPost, Key: key, Message: message})
+}
+
+// Edit queues an edit of a message, given by its ID or, while that isn't
+// known yet, by the key it was posted with
+func (o *Outbox) Edit(webhookURL, messageID, key string, message DiscordWebhookMessage) error {
+	return o.Enqueue(OutboxEntry{Webhook: webhookURL, Method: http.MethodPatch, MessageID: messageID, Key: key, Message: message})
+}
+
+// Enqueue writes an entry to the queue and wakes Run. An entry with a key
+// replaces the message of the last queued entry with that key that isn't
+// being sent yet, so a backlog holds only the latest version of a message.
+func (o *Outbox) Enqueue(entry OutboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := o.now()
+	if entry.Method == http.MethodPatch && entry.MessageID == "" {
+		entry.MessageID = o.posted[entry.Key].MessageID
+	}
+	if entry.Key != "" && entry.Method == http.MethodPatch {
+		queued := o.read("queue")
+		for i := len(queued) - 1; i >= 0; i-- {
+			last := queued[i]
+			if last.Key != entry.Key {
+				continue
+			}
+			// A queued post or edit of the same message, not yet sent,
+			// can just carry the new version
+			if last.ID != o.inFlight {
+				last.Message = entry.Message
+				return o.write("queue", last)
+			}
+			break
+		}
+	}
+
+	id := now.UnixNano()
+	if id <= o.lastID {
+		id = o.lastID + 1
+	}
+	o.lastID = id
+	entry.ID = fmt.Sprintf("%019d", id)
+	entry.Created = now
+	entry.NextAttempt = now
+	if err := o.write("queue", entry); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued entries until ctx is done
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		wait, _ := o.deliver(ctx)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-o.wake:
+		case <-timer.C:
+			o.reload()
+		}
+		timer.Stop()
+	}
+}
+
+// Drain delivers the entries that are due until the queue is empty, an
+// entry has to wait for a retry, or ctx is done. Reports whether the queue
+// is empty.
+func (o *Outbox) Drain(ctx context.Context) bool {
+	_, empty := o.deliver(ctx)
+	return empty
+}
+
+// Deliver due entries in order. Returns how long until the head of the
+// queue is due, and whether the queue is empty.
+func (o *Outbox) deliver(ctx context.Context) (time.Duration, bool) {
+	for ctx.Err() == nil {
+		o.mu.Lock()
+		queued := o.read("queue")
+		if len(queued) == 0 {
+			o.mu.Unlock()
+			return outboxIdlePoll, true
+		}
+		entry := queued[0]
+		now := o.now()
+		if age := now.Sub(entry.Created); age > o.maxAge() {
+			entry.LastError = fmt.Sprintf("expired after %v undelivered (last error: %s)", age.Round(time.Second), entry.LastError)
+			o.bury(entry)
+			o.mu.Unlock()
+			continue
+		}
+		if entry.NextAttempt.After(now) {
+			o.mu.Unlock()
+			return entry.NextAttempt.Sub(now), false
+		}
+		o.inFlight = entry.ID
+		o.mu.Unlock()
+
+		messageID, err := o.send(ctx, entry)
+
+		o.mu.Lock()
+		o.inFlight = ""
+		// The entry may have been purged or its message replaced meanwhile
+		current, stillQueued := o.index["queue"][entry.ID]
+		switch {
+		case !stillQueued:
+		case err == nil:
+			o.remove("queue", entry.ID)
+			if entry.Key != "" && messageID != "" {
+				o.resolve(entry, messageID)
+			}
+		case IsPermanent(err):
+			current.LastError = err.Error()
+			current.Attempts++
+			o.bury(current)
+			// The message is gone, so later edits by key must not find it
+			if current.Method == http.MethodPatch && current.Key != "" {
+				o.forget(current.Key)
+			}
+		case ctx.Err() != nil:
+		default:
+			current.Attempts++
+			current.LastError = err.Error()
+			current.NextAttempt = o.now().Add(o.backoff(current.Attempts))
+			if writeErr := o.write("queue", current); writeErr != nil {
+				log.Printf("Error updating Discord outbox entry %s: %v", current.ID, writeErr)
+			}
+			log.Printf("Discord outbox: entry %s failed %d times, retrying at %s: %v",
+				current.ID, current.Attempts, current.NextAttempt.Format(time.RFC3339), err)
+		}
+		o.mu.Unlock()
+
+		if err == nil && stillQueued && entry.Method == http.MethodPost && o.Delivered != nil {
+			o.Delivered(entry, messageID)
+		}
+		if IsPermanent(err) && stillQueued && o.Failed != nil {
+			o.Failed(current, err)
+		}
+	}
+	return 0, false
+}
+
+// Send one entry, returning the posted message's ID for keyed posts
+func (o *Outbox) send(ctx context.Context, entry OutboxEntry) (string, error) {
+	client := o.Client
+	if client == nil {
+		client = &DiscordClient{}
+	}
+	switch {
+	case entry.Method == http.MethodPatch && entry.MessageID == "":
+		return "", &PermanentError{Status: http.StatusNotFound, Body: "the message to edit was never posted"}
+	case entry.Method == http.MethodPatch:
+		return "", client.Edit(ctx, entry.Webhook, entry.MessageID, entry.Message)
+	case entry.Key != "":
+		return client.PostWait(ctx, entry.Webhook, entry.Message)
+	default:
+		return "", client.Post(ctx, entry.Webhook, entry.Message)
+	}
+}
+
+// Fill in the message ID of queued edits waiting for the post with key,
+// and of edits queued from now on, also after a restart
+func (o *Outbox) resolve(post OutboxEntry, messageID string) {
+	key := post.Key
+	o.forget(key)
+	post.MessageID = messageID
+	if err := o.write("posted", post); err != nil {
+		log.Printf("Error recording Discord message %s: %v", messageID, err)
+	}
+	if o.posted == nil {
+		o.posted = make(map[string]OutboxEntry)
+	}
+	o.posted[key] = post
+	o.prunePosted()
+
+	for _, entry := range o.read("queue") {
+		if entry.Key == key && entry.Method == http.MethodPatch && entry.MessageID == "" {
+			entry.MessageID = messageID
+			if err := o.write("queue", entry); err != nil {
+				log.Printf("Error updating Discord outbox entry %s: %v", entry.ID, err)
+			}
+		}
+	}
+}
+
+// Forget the message posted with key
+func (o *Outbox) forget(key string) {
+	if post, ok := o.posted[key]; ok {
+		o.remove("posted", post.ID)
+		delete(o.posted, key)
+	}
+}
+
+// Forget posts older than MaxAge; their edits are sent by message ID
+func (o *Outbox) prunePosted() {
+	now := o.now()
+	for key, post := range o.posted {
+		if now.Sub(post.Created) > o.maxAge() {
+			o.forget(key)
+		}
+	}
+}
+
+// Move an entry to the dead letters
+func (o *Outbox) bury(entry OutboxEntry) {
+	log.Printf("Discord outbox: giving up on entry %s: %s", entry.ID, entry.LastError)
+	if err := o.write("dead", entry); err != nil {
+		log.Printf("Error writing Discord outbox dead letter %s: %v", entry.ID, err)
+		return
+	}
+	o.remove("queue", entry.ID)
+}
+
+func (o *Outbox) backoff(attempts int) time.Duration {
+	min, max := o.MinBackoff, o.MaxBackoff
+	if min <= 0 {
+		min = 5 * time.Second
+	}
+	if max <= 0 {
+		max = 10 * time.Minute
+	}
+	wait := min
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+func (o *Outbox) maxAge() time.Duration {
+	if o.MaxAge <= 0 {
+		return 24 * time.Hour
+	}
+	return o.MaxAge
+}
+
+func (o *Outbox) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// Entries lists the queue, or the dead letters, oldest first
+func (o *Outbox) Entries(dead bool) ([]OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.read(outboxFolder(dead)), nil
+}
+
+// Replay moves dead letters back into the queue as new, all of them when
+// ids is empty, and makes queued entries among ids due now. Returns how
+// many entries it changed.
+func (o *Outbox) Replay(ids []string) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	replayed := 0
+	now := o.now()
+	for _, entry := range o.read("dead") {
+		if len(ids) > 0 && !containsID(ids, entry.ID) {
+			continue
+		}
+		entry.Created, entry.NextAttempt = now, now
+		entry.Attempts, entry.LastError = 0, ""
+		if err := o.write("queue", entry); err != nil {
+			return replayed, err
+		}
+		o.remove("dead", entry.ID)
+		replayed++
+	}
+	if len(ids) > 0 {
+		for _, entry := range o.read("queue") {
+			if containsID(ids, entry.ID) && entry.NextAttempt.After(now) {
+				entry.NextAttempt = now
+				if err := o.write("queue", entry); err != nil {
+					return replayed, err
+				}
+				replayed++
+			}
+		}
+	}
+	if replayed > 0 && o.wake != nil {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+	return replayed, nil
+}
+
+// Purge deletes queued entries, or dead letters, by ID, or all of them
+// when ids is empty. Returns how many it deleted.
+func (o *Outbox) Purge(dead bool, ids []string) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	folder := outboxFolder(dead)
+	purged := 0
+	for _, entry := range o.read(folder) {
+		if len(ids) > 0 && !containsID(ids, entry.ID) {
+			continue
+		}
+		if err := os.Remove(o.path(folder, entry.ID)); err != nil {
+			return purged, err
+		}
+		delete(o.index[folder], entry.ID)
+		purged++
+	}
+	return purged, nil
+}
+
+func outboxFolder(dead bool) string {
+	if dead {
+		return "dead"
+	}
+	return "queue"
+}
+
+func containsID(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outbox) path(folder, id string) string {
+	return filepath.Join(o.Dir, folder, id+".json")
+}
+
+// Entries of a folder in ID order
+func (o *Outbox) read(folder string) []OutboxEntry {
+	entries := make([]OutboxEntry, 0, len(o.index[folder]))
+	for _, entry := range o.index[folder] {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// Reread the outbox from disk if it hasn't been for outboxIdlePoll
+func (o *Outbox) reload() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Since(o.loaded) < outboxIdlePoll {
+		return
+	}
+	if err := o.load(); err != nil {
+		log.Printf("Error reading Discord outbox: %v", err)
+	}
+}
+
+// Read every folder from disk into the index. Unreadable files are
+// skipped, and temporary files left by a crash mid-write removed once
+// they are too old to belong to a write still in progress.
+func (o *Outbox) load() error {
+	index := make(map[string]map[string]OutboxEntry, len(outboxFolders))
+	for _, folder := range outboxFolders {
+		files, err := os.ReadDir(filepath.Join(o.Dir, folder))
+		if err != nil {
+			return err
+		}
+		index[folder] = make(map[string]OutboxEntry, len(files))
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasSuffix(name, ".tmp") {
+				if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > outboxIdlePoll {
+					os.Remove(filepath.Join(o.Dir, folder, name))
+				}
+				continue
+			}
+			if file.IsDir() || !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			id := strings.TrimSuffix(name, ".json")
+			entry, err := o.readEntry(folder, id)
+			if err != nil {
+				log.Printf("Skipping Discord outbox entry %s: %v", name, err)
+				continue
+			}
+			index[folder][id] = entry
+		}
+	}
+	o.index = index
+	o.loaded = time.Now()
+	o.posted = make(map[string]OutboxEntry, len(index["posted"]))
+	for _, entry := range index["posted"] {
+		o.posted[entry.Key] = entry
+	}
+	return nil
+}
+
+func (o *Outbox) readEntry(folder, id string) (OutboxEntry, error) {
+	var entry OutboxEntry
+	data, err := os.ReadFile(o.path(folder, id))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+	if entry.ID != id {
+		return entry, errors.New("entry ID doesn't match its file name")
+	}
+	return entry, nil
+}
+
+// Write an entry through a temporary file of its own, synced before it is
+// renamed into place and the rename synced after, so neither a crash nor
+// the outbox command writing the same entry leaves half of one behind.
+// Webhook URLs carry their token, so only the owner can read them.
+func (o *Outbox) write(folder string, entry OutboxEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(o.Dir, folder)
+	tmp, err := os.CreateTemp(dir, entry.ID+".*.tmp") // created 0600
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), o.path(folder, entry.ID)); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if o.index[folder] == nil {
+		o.index[folder] = make(map[string]OutboxEntry)
+	}
+	o.index[folder][entry.ID] = entry
+	return nil
+}
+
+// Make a rename or removal in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (o *Outbox) remove(folder, id string) {
+	delete(o.index[folder], id)
+	if err := os.Remove(o.path(folder, id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing Discord outbox entry %s: %v", id, err)
+	}
+}
@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// OutboxCommand runs the outbox subcommand of a program with an outbox in
+// dir:
+//
+//	outbox list [-dead]              show queued entries, or dead letters
+//	outbox replay [id ...]           requeue dead letters, all without ids,
+//	                                 and retry the given queued entries now
+//	outbox purge [-dead] -all|id ... delete queued entries or dead letters
+//
+// It can run alongside the service using the outbox.
+func OutboxCommand(dir string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: outbox list|replay|purge")
+	}
+	outbox, err := OpenOutbox(dir, nil)
+	if err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("outbox "+args[0], flag.ContinueOnError)
+	dead := flags.Bool("dead", false, "the dead letters rather than the queue")
+	all := flags.Bool("all", false, "purge every entry")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	ids := flags.Args()
+
+	switch args[0] {
+	case "list":
+		entries, err := outbox.Entries(*dead)
+		if err != nil {
+			return err
+		}
+		printOutboxEntries(out, entries, outbox.now())
+	case "replay":
+		n, err := outbox.Replay(ids)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Replayed %d entries\n", n)
+	case "purge":
+		if len(ids) == 0 && !*all {
+			return fmt.Errorf("give the IDs of the entries to purge, or -all")
+		}
+		n, err := outbox.Purge(*dead, ids)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Purged %d entries\n", n)
+	default:
+		return fmt.Errorf("unknown outbox command %q (expected list, replay or purge)", args[0])
+	}
+	return nil
+}
+
+func printOutboxEntries(out io.Writer, entries []OutboxEntry, now time.Time) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAGE\tATTEMPTS\tNEXT\tREQUEST\tWEBHOOK\tMESSAGE\tLAST ERROR")
+	for _, entry := range entries {
+		request := entry.Method
+		if entry.MessageID != "" {
+			request += " " + entry.MessageID
+		} else if entry.Key != "" {
+			request += " " + entry.Key
+		}
+		next := "now"
+		if entry.NextAttempt.After(now) {
+			next = "in " + entry.NextAttempt.Sub(now).Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			entry.ID, now.Sub(entry.Created).Round(time.Second), entry.Attempts, next,
+			request, WebhookName(entry.Webhook), outboxSummary(entry.Message), entry.LastError)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d entries\n", len(entries))
+}
+
+// First line of a message, short enough for a table
+func outboxSummary(message DiscordWebhookMessage) string {
+	summary := message.Content
+	if summary == "" && len(message.Embeds) > 0 {
+		summary = message.Embeds[0].Title
+	}
+	summary = strings.TrimSpace(summary)
+	if i := strings.IndexByte(summary, '\n'); i >= 0 {
+		summary = summary[:i]
+	}
+	return Truncate(summary, 50)
+}
@@ -0,0 +1,258 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhook records requests and answers with status, 200 with a
+// message ID for posts with wait=true
+type testWebhook struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []string // method, path and content
+}
+
+func newTestWebhook(t *testing.T) *testWebhook {
+	h := &testWebhook{status: http.StatusNoContent}
+	h.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message DiscordWebhookMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.requests = append(h.requests, r.Method+" "+r.URL.Path+" "+message.Content)
+		if h.status != http.StatusNoContent {
+			w.WriteHeader(h.status)
+			return
+		}
+		if r.URL.Query().Get("wait") == "true" {
+			json.NewEncoder(w).Encode(map[string]string{"id": "m1"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(h.server.Close)
+	return h
+}
+
+func (h *testWebhook) respond(status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = status
+}
+
+func (h *testWebhook) Requests() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.requests...)
+}
+
+func newTestOutbox(t *testing.T, dir string, clock *fakeTime) *Outbox {
+	outbox, err := OpenOutbox(dir, &DiscordClient{MaxAttempts: 1, Now: clock.Now, Sleep: clock.Sleep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Now = clock.Now
+	return outbox
+}
+
+func TestOutboxSurvivesOutagesAndRestarts(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	webhook.respond(http.StatusBadGateway)
+
+	outbox := newTestOutbox(t, dir, clock)
+	if err := outbox.Post(webhook.server.URL, "", DiscordWebhookMessage{Content: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := outbox.Post(webhook.server.URL, "", DiscordWebhookMessage{Content: "second"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backing off 5s, then 10s, without reaching the second entry
+	for _, wait := range []time.Duration{5 * time.Second, 10 * time.Second} {
+		if outbox.Drain(context.Background()) {
+			t.Fatal("queue drained while Discord is down")
+		}
+		entries, _ := outbox.Entries(false)
+		if len(entries) != 2 || entries[0].NextAttempt != clock.Now().Add(wait) {
+			t.Fatalf("head of the queue due at %v, want in %v", entries[0].NextAttempt, wait)
+		}
+		clock.now = clock.now.Add(wait)
+	}
+
+	// A new process picks up where the old one left off
+	webhook.respond(http.StatusNoContent)
+	restarted := newTestOutbox(t, dir, clock)
+	if !restarted.Drain(context.Background()) {
+		t.Fatal("queue not drained once Discord is back")
+	}
+	requests := webhook.Requests()
+	if got := strings.Join(requests[len(requests)-2:], "|"); got != "POST / first|POST / second" {
+		t.Errorf("delivered %q, want both messages in order", got)
+	}
+}
+
+func TestOutboxEditsFollowTheirPost(t *testing.T) {
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	outbox := newTestOutbox(t, t.TempDir(), clock)
+	delivered := map[string]string{}
+	outbox.Delivered = func(entry OutboxEntry, messageID string) {
+		delivered[entry.Key] = messageID
+	}
+
+	// An edit queued before the post went out just updates the post
+	outbox.Post(webhook.server.URL, "room@1", DiscordWebhookMessage{Content: "open"})
+	outbox.Edit(webhook.server.URL, "", "room@1", DiscordWebhookMessage{Content: "open, 3 people"})
+	outbox.Drain(context.Background())
+
+	// Later edits find the message by its key
+	outbox.Edit(webhook.server.URL, "", "room@1", DiscordWebhookMessage{Content: "closed"})
+	outbox.Drain(context.Background())
+
+	want := "POST / open, 3 people|PATCH /messages/m1 closed"
+	if got := strings.Join(webhook.Requests(), "|"); got != want {
+		t.Errorf("requests %q, want %q", got, want)
+	}
+	if delivered["room@1"] != "m1" {
+		t.Errorf("Delivered got message ID %q, want m1", delivered["room@1"])
+	}
+}
+
+func TestOutboxRemembersPostsAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	outbox := newTestOutbox(t, dir, clock)
+	outbox.Post(webhook.server.URL, "room@1", DiscordWebhookMessage{Content: "open"})
+	outbox.Drain(context.Background())
+
+	// An edit by key after a restart still finds the message
+	restarted := newTestOutbox(t, dir, clock)
+	restarted.Edit(webhook.server.URL, "", "room@1", DiscordWebhookMessage{Content: "closed"})
+	restarted.Drain(context.Background())
+
+	want := "POST / open|PATCH /messages/m1 closed"
+	if got := strings.Join(webhook.Requests(), "|"); got != want {
+		t.Errorf("requests %q, want %q", got, want)
+	}
+}
+
+func TestOutboxReportsPermanentFailures(t *testing.T) {
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	outbox := newTestOutbox(t, t.TempDir(), clock)
+	var failed []OutboxEntry
+	outbox.Failed = func(entry OutboxEntry, err error) {
+		if !IsPermanent(err) {
+			t.Errorf("Failed called with %v", err)
+		}
+		failed = append(failed, entry)
+	}
+	outbox.Post(webhook.server.URL, "room@1", DiscordWebhookMessage{Content: "open"})
+	outbox.Drain(context.Background())
+
+	// The message was deleted from the channel
+	webhook.respond(http.StatusNotFound)
+	outbox.Edit(webhook.server.URL, "", "room@1", DiscordWebhookMessage{Content: "3 people"})
+	outbox.Drain(context.Background())
+	if len(failed) != 1 || failed[0].Key != "room@1" || failed[0].Method != http.MethodPatch {
+		t.Fatalf("Failed got %+v, want the edit", failed)
+	}
+
+	// Later edits by key no longer point at the deleted message
+	outbox.Edit(webhook.server.URL, "", "room@1", DiscordWebhookMessage{Content: "closed"})
+	queued, _ := outbox.Entries(false)
+	if len(queued) != 1 || queued[0].MessageID != "" {
+		t.Errorf("queued %+v, want an edit without a message ID", queued)
+	}
+}
+
+func TestOutboxPicksUpChangesFromTheCommand(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	service := newTestOutbox(t, dir, clock)
+
+	// The outbox command queues a message while the service runs
+	command := newTestOutbox(t, dir, clock)
+	if err := command.Post(webhook.server.URL, "", DiscordWebhookMessage{Content: "queued by hand"}); err != nil {
+		t.Fatal(err)
+	}
+	service.loaded = time.Time{} // idle for long enough
+	service.reload()
+	if !service.Drain(context.Background()) {
+		t.Fatal("queue not drained")
+	}
+	if got := strings.Join(webhook.Requests(), "|"); got != "POST / queued by hand" {
+		t.Errorf("requests %q, want the message queued by the command", got)
+	}
+
+	// Every write went through a temporary file that is gone again
+	for _, folder := range outboxFolders {
+		tmps, _ := filepath.Glob(filepath.Join(dir, folder, "*.tmp"))
+		if len(tmps) > 0 {
+			t.Errorf("temporary files left behind: %v", tmps)
+		}
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	clock := &fakeTime{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	webhook := newTestWebhook(t)
+	outbox := newTestOutbox(t, t.TempDir(), clock)
+	outbox.MaxAge = time.Hour
+
+	// Too old to be worth sending
+	webhook.respond(http.StatusBadGateway)
+	outbox.Post(webhook.server.URL, "", DiscordWebhookMessage{Content: "stale"})
+	outbox.Drain(context.Background())
+	clock.now = clock.now.Add(2 * time.Hour)
+	// Rejected outright
+	webhook.respond(http.StatusNotFound)
+	outbox.Post(webhook.server.URL, "", DiscordWebhookMessage{Content: "rejected"})
+	if !outbox.Drain(context.Background()) {
+		t.Fatal("dead entries left in the queue")
+	}
+	dead, _ := outbox.Entries(true)
+	if len(dead) != 2 || !strings.HasPrefix(dead[0].LastError, "expired") || !strings.Contains(dead[1].LastError, "404") {
+		t.Fatalf("dead letters %+v", dead)
+	}
+
+	// Replaying one puts it back in the queue as new
+	webhook.respond(http.StatusNoContent)
+	if n, err := outbox.Replay([]string{dead[1].ID}); n != 1 || err != nil {
+		t.Fatalf("Replay = %d, %v", n, err)
+	}
+	outbox.Drain(context.Background())
+	requests := webhook.Requests()
+	if last := requests[len(requests)-1]; last != "POST / rejected" {
+		t.Errorf("last request %q, want the replayed message", last)
+	}
+
+	var out bytes.Buffer
+	if err := OutboxCommand(outbox.Dir, []string{"list", "-dead"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "stale") || !strings.Contains(out.String(), "1 entries") {
+		t.Errorf("list -dead printed:\n%s", out.String())
+	}
+	if err := OutboxCommand(outbox.Dir, []string{"purge", "-dead"}, &out); err == nil {
+		t.Error("purge without IDs or -all should be refused")
+	}
+	if n, _ := outbox.Purge(true, nil); n != 1 {
+		t.Errorf("purged %d dead letters, want 1", n)
+	}
+}
@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SinkConfig is one entry of a sinks file, a JSON list such as
+//
+//	[
+//	  {"type": "slack", "url": "https://hooks.slack.com/services/..."},
+//	  {"type": "telegram", "token": "${TELEGRAM_TOKEN}", "chat": "@hivetalk", "format": "plain"},
+//	  {"type": "webhook", "url": "https://example.com/hook", "secret": "${HOOK_SECRET}", "kinds": ["open"]}
+//	]
+//
+// ${VAR} in any value is replaced with the environment variable, so the
+// file needn't hold tokens.
+type SinkConfig struct {
+	Type string `json:"type"` // discord, slack, matrix, telegram or webhook
+	Name string `json:"name"` // for logs, the type when empty
+
+	URL    string `json:"url"`    // discord, slack and webhook; the homeserver for matrix
+	Room   string `json:"room"`   // matrix room ID
+	Token  string `json:"token"`  // matrix access token, telegram bot token
+	Chat   string `json:"chat"`   // telegram chat ID or @channel
+	Secret string `json:"secret"` // webhook signing key, unsigned when empty
+
+	// rich (the default) or plain, and a text/template over the
+	// Notification for the plain text
+	Format   string `json:"format"`
+	Template string `json:"template"`
+
+	// At most N notifications per period, e.g. "20/1m"; the platform's
+	// own limit when empty, "none" for no limit
+	Rate string `json:"rate"`
+
+	// Notification kinds to send, e.g. ["open", "closed"]; all when empty
+	Kinds []string `json:"kinds"`
+}
+
+// What each platform allows before it starts rate limiting. Discord's
+// client follows Discord's own headers, and plain webhooks are up to the
+// receiver.
+var defaultLimits = map[string]Limit{
+	"slack":    {N: 1, Per: time.Second},
+	"matrix":   {N: 10, Per: 10 * time.Second},
+	"telegram": {N: 20, Per: time.Minute}, // per group chat
+}
+
+// LoadSinks reads a sinks file. Discord sinks post through client.
+func LoadSinks(path string, client *DiscordClient) ([]Sink, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []SinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	sinks := make([]Sink, 0, len(configs))
+	for i, config := range configs {
+		sink, err := config.expandEnv().Sink(client)
+		if err != nil {
+			return nil, fmt.Errorf("%s: sink %d: %w", path, i+1, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func (c SinkConfig) expandEnv() SinkConfig {
+	for _, value := range []*string{&c.Name, &c.URL, &c.Room, &c.Token, &c.Chat, &c.Secret} {
+		*value = os.ExpandEnv(*value)
+	}
+	return c
+}
+
+// Sink builds the configured notifier
+func (c SinkConfig) Sink(client *DiscordClient) (Sink, error) {
+	sink := Sink{Name: c.Name, Kinds: c.Kinds}
+	if sink.Name == "" {
+		sink.Name = c.Type
+	}
+
+	var format Format
+	switch c.Format {
+	case "", "rich":
+	case "plain":
+		format.Plain = true
+	default:
+		return sink, fmt.Errorf("unknown format %q (expected rich or plain)", c.Format)
+	}
+	if c.Template != "" {
+		tmpl, err := template.New(sink.Name).Parse(c.Template)
+		if err != nil {
+			return sink, err
+		}
+		format.Template = tmpl
+	}
+
+	require := func(values ...string) error {
+		for i := 0; i < len(values); i += 2 {
+			if values[i+1] == "" {
+				return fmt.Errorf("%s sink needs %s", c.Type, values[i])
+			}
+		}
+		return nil
+	}
+	var err error
+	switch c.Type {
+	case "discord":
+		err = require("url", c.URL)
+		sink.Notifier = &DiscordNotifier{WebhookURL: c.URL, Client: client, Format: format}
+	case "slack":
+		err = require("url", c.URL)
+		sink.Notifier = &SlackNotifier{WebhookURL: c.URL, Format: format}
+	case "matrix":
+		err = require("url", c.URL, "room", c.Room, "token", c.Token)
+		sink.Notifier = &MatrixNotifier{Homeserver: c.URL, RoomID: c.Room, AccessToken: c.Token, Format: format}
+	case "telegram":
+		err = require("token", c.Token, "chat", c.Chat)
+		sink.Notifier = &TelegramNotifier{Token: c.Token, ChatID: c.Chat, Format: format}
+	case "webhook":
+		err = require("url", c.URL)
+		sink.Notifier = &WebhookNotifier{URL: c.URL, Secret: c.Secret, Format: format}
+	default:
+		return sink, fmt.Errorf("unknown sink type %q (expected discord, slack, matrix, telegram or webhook)", c.Type)
+	}
+	if err != nil {
+		return sink, err
+	}
+
+	sink.Limit = defaultLimits[c.Type]
+	if c.Rate != "" {
+		if sink.Limit, err = ParseLimit(c.Rate); err != nil {
+			return sink, err
+		}
+	}
+	return sink, nil
+}
+
+// ParseLimit parses a rate limit such as "20/1m" or "1/s", or "none"
+func ParseLimit(value string) (Limit, error) {
+	if value == "none" {
+		return Limit{}, nil
+	}
+	n, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate %q (expected e.g. 20/1m)", value)
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate %q: count must be a positive number", value)
+	}
+	// "1/s" reads more naturally than "1/1s"
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	period, err := time.ParseDuration(per)
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate %q: period must be a duration such as 1m", value)
+	}
+	return Limit{N: count, Per: period}, nil
+}
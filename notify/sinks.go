@@ -0,0 +1,300 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// DiscordNotifier posts notifications to a Discord webhook, as embeds
+// unless the format is plain
+type DiscordNotifier struct {
+	WebhookURL string
+	Client     *DiscordClient // shared with the rest of the program's Discord posts
+	Format
+}
+
+func (d *DiscordNotifier) Notify(ctx context.Context, n Notification) error {
+	message := DiscordWebhookMessage{Content: Truncate(d.Text(n), MaxContent)}
+	if !d.Plain {
+		embed := DiscordEmbed{
+			Title:       n.Title,
+			Description: n.Description,
+			URL:         n.URL,
+			Color:       n.Color,
+		}
+		if !n.Time.IsZero() {
+			embed.Timestamp = n.Time.UTC().Format(time.RFC3339)
+		}
+		if n.Image != "" {
+			embed.Thumbnail = &DiscordEmbedImage{URL: n.Image}
+		}
+		for _, field := range n.Fields {
+			embed.AddField(field.Name, field.Value, true)
+		}
+		message = DiscordMessages([]DiscordEmbed{embed})[0]
+	}
+	client := d.Client
+	if client == nil {
+		client = &DiscordClient{}
+	}
+	return client.Post(ctx, d.WebhookURL, message)
+}
+
+// Slack's limits on Block Kit messages
+// (https://api.slack.com/reference/block-kit/blocks#section)
+const (
+	slackMaxText        = 3000
+	slackMaxFields      = 10
+	slackMaxFieldText   = 2000
+	slackMaxMessageText = 40000
+)
+
+// SlackNotifier posts notifications to a Slack incoming webhook, as Block
+// Kit sections unless the format is plain
+type SlackNotifier struct {
+	WebhookURL string
+	Format
+	Delivery
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, n Notification) error {
+	message := map[string]interface{}{
+		"text": Truncate(slackEscape(s.Text(n)), slackMaxMessageText),
+	}
+	if !s.Plain {
+		message["blocks"] = slackBlocks(n)
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, deliveryRequest{
+		service: "slack webhook",
+		method:  http.MethodPost,
+		url:     s.WebhookURL,
+		body:    body,
+	})
+}
+
+// A section with the linked title and description, the image alongside,
+// then a section of fields
+func slackBlocks(n Notification) []interface{} {
+	title := "*" + slackEscape(n.Title) + "*"
+	if n.URL != "" {
+		title = "*<" + n.URL + "|" + slackEscape(n.Title) + ">*"
+	}
+	text := title
+	if n.Description != "" {
+		text += "\n" + slackEscape(n.Description)
+	}
+	section := map[string]interface{}{
+		"type": "section",
+		"text": map[string]string{"type": "mrkdwn", "text": Truncate(text, slackMaxText)},
+	}
+	if n.Image != "" {
+		section["accessory"] = map[string]string{"type": "image", "image_url": n.Image, "alt_text": n.Title}
+	}
+	blocks := []interface{}{section}
+
+	fields := []map[string]string{}
+	for _, field := range n.Fields {
+		if len(fields) == slackMaxFields {
+			break
+		}
+		fields = append(fields, map[string]string{
+			"type": "mrkdwn",
+			"text": Truncate("*"+slackEscape(field.Name)+"*\n"+slackEscape(field.Value), slackMaxFieldText),
+		})
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+	}
+	return blocks
+}
+
+// Escape the characters Slack reads as markup
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// MatrixNotifier sends notifications to a Matrix room through the
+// client-server API, as HTML unless the format is plain. Messages are
+// notices, so bots in the room don't answer them.
+type MatrixNotifier struct {
+	Homeserver  string // e.g. https://matrix.org
+	RoomID      string // e.g. !abc123:matrix.org
+	AccessToken string
+	Format
+	Delivery
+}
+
+// Transaction IDs, unique within the process; Matrix drops a repeated one
+// for the same access token, so a retried send isn't posted twice
+var matrixTxn int64
+
+func (m *MatrixNotifier) Notify(ctx context.Context, n Notification) error {
+	message := map[string]string{
+		"msgtype": "m.notice",
+		"body":    m.Text(n),
+	}
+	if !m.Plain {
+		message["format"] = "org.matrix.custom.html"
+		message["formatted_body"] = htmlMessage(n, "<br>")
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	txnID := fmt.Sprintf("%d.%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxn, 1))
+	return m.send(ctx, deliveryRequest{
+		service: "matrix homeserver",
+		method:  http.MethodPut,
+		url: strings.TrimRight(m.Homeserver, "/") + "/_matrix/client/v3/rooms/" +
+			url.PathEscape(m.RoomID) + "/send/m.room.message/" + txnID,
+		header: http.Header{"Authorization": {"Bearer " + m.AccessToken}},
+		body:   body,
+		retryAfter: func(body []byte) time.Duration {
+			var limited struct {
+				RetryAfterMs int64 `json:"retry_after_ms"`
+			}
+			json.Unmarshal(body, &limited)
+			return time.Duration(limited.RetryAfterMs) * time.Millisecond
+		},
+	})
+}
+
+// Telegram's limit on message text, in characters after entities are
+// parsed (https://core.telegram.org/bots/api#sendmessage)
+const telegramMaxText = 4096
+
+// TelegramNotifier sends notifications to a Telegram chat through the Bot
+// API, as HTML unless the format is plain
+type TelegramNotifier struct {
+	Token  string // from @BotFather
+	ChatID string // e.g. -1001234567890 or @channelname
+	Format
+	Delivery
+
+	// Bot API address, for tests; https://api.telegram.org when empty
+	APIURL string
+}
+
+func (t *TelegramNotifier) Notify(ctx context.Context, n Notification) error {
+	message := map[string]interface{}{
+		"chat_id": t.ChatID,
+		"text":    Truncate(t.Text(n), telegramMaxText),
+	}
+	if !t.Plain {
+		// Markup doesn't count towards the limit, but cutting it could
+		// leave a tag open, so rich messages drop fields until they fit
+		text := htmlMessage(n, "\n")
+		for len(n.Fields) > 0 && utf8.RuneCountInString(text) > telegramMaxText {
+			n.Fields = n.Fields[:len(n.Fields)-1]
+			text = htmlMessage(n, "\n")
+		}
+		if utf8.RuneCountInString(text) <= telegramMaxText {
+			message["text"] = text
+			message["parse_mode"] = "HTML"
+		}
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	apiURL := t.APIURL
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	return t.send(ctx, deliveryRequest{
+		service: "telegram bot API",
+		method:  http.MethodPost,
+		url:     strings.TrimRight(apiURL, "/") + "/bot" + t.Token + "/sendMessage",
+		body:    body,
+		retryAfter: func(body []byte) time.Duration {
+			var limited struct {
+				Parameters struct {
+					RetryAfter int `json:"retry_after"`
+				} `json:"parameters"`
+			}
+			json.Unmarshal(body, &limited)
+			return time.Duration(limited.Parameters.RetryAfter) * time.Second
+		},
+	})
+}
+
+// The HTML both Matrix and Telegram understand: a bold linked title, the
+// description and bold field names, separated by br
+func htmlMessage(n Notification, br string) string {
+	title := "<b>" + html.EscapeString(n.Title) + "</b>"
+	if n.URL != "" {
+		title = `<b><a href="` + html.EscapeString(n.URL) + `">` + html.EscapeString(n.Title) + "</a></b>"
+	}
+	lines := []string{title}
+	if n.Description != "" {
+		lines = append(lines, html.EscapeString(n.Description))
+	}
+	for _, field := range n.Fields {
+		lines = append(lines, "<b>"+html.EscapeString(field.Name)+":</b> "+html.EscapeString(field.Value))
+	}
+	return strings.Join(lines, br)
+}
+
+// WebhookNotifier posts notifications as JSON to any HTTP endpoint. With
+// a Secret, each request is signed so the receiver can check it came from
+// us: X-Webhook-Timestamp holds the Unix time and X-Webhook-Signature is
+// "sha256=" and the hex HMAC-SHA256, keyed with the secret, of the
+// timestamp, a dot and the body. Receivers should reject old timestamps
+// to stop replays.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Format
+	Delivery
+}
+
+// The JSON a WebhookNotifier posts: the notification and its plain text
+type webhookPayload struct {
+	Notification
+	Text string `json:"text"`
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(webhookPayload{Notification: n, Text: w.Text(n)})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if w.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set("X-Webhook-Timestamp", timestamp)
+		header.Set("X-Webhook-Signature", "sha256="+WebhookSignature(w.Secret, timestamp, body))
+	}
+	return w.send(ctx, deliveryRequest{
+		service: "webhook " + WebhookName(w.URL),
+		method:  http.MethodPost,
+		url:     w.URL,
+		header:  header,
+		body:    body,
+	})
+}
+
+// WebhookSignature is the hex HMAC-SHA256 a WebhookNotifier signs a
+// request with, for receivers to compare against in constant time
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
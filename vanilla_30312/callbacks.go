@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers carrying when the callback was sent, in unix seconds, and the
+// hex HMAC-SHA256 of "<timestamp>.<body>", as "sha256=<hex>"
+const (
+	callbackTimestampHeader = "X-HiveTalk-Timestamp"
+	callbackSignatureHeader = "X-HiveTalk-Signature"
+)
+
+// Callbacks timestamped further than this from our clock, either way, are
+// rejected as replays
+const callbackMaxSkew = 5 * time.Minute
+
+// Largest callback body we accept
+const maxCallbackSize = 1 << 20
+
+// RoomCallback is a room lifecycle notification pushed by the HiveTalk SFU
+type RoomCallback struct {
+	Event  string `json:"event"` // room_created, peer_joined, peer_left or room_ended
+	RoomID string `json:"roomId"`
+	Peer   *Peer  `json:"peer,omitempty"`
+	Peers  []Peer `json:"peers,omitempty"` // full peer list, when the SFU includes it
+}
+
+// callbackServer verifies room callbacks and replays them, in order, as
+// meeting changes on the shared Announcer. It keeps its own view of the
+// live meetings, which each poll replaces with the API's snapshot.
+type callbackServer struct {
+	secret    []byte
+	announcer *Announcer
+	queue     chan RoomCallback
+
+	mu       sync.Mutex
+	meetings map[string]*Meeting
+	partial  map[string]bool // rooms whose peers the poll hasn't listed yet
+}
+
+func newCallbackServer(ctx context.Context, secret []byte, announcer *Announcer) *callbackServer {
+	s := &callbackServer{
+		secret:    secret,
+		announcer: announcer,
+		queue:     make(chan RoomCallback, 100),
+		meetings:  make(map[string]*Meeting),
+		partial:   make(map[string]bool),
+	}
+	go s.run(ctx)
+	return s
+}
+
+func (s *callbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackSize))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+
+	timestamp := r.Header.Get(callbackTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		log.Printf("Rejected room callback from %s: missing timestamp", r.RemoteAddr)
+		http.Error(w, "missing timestamp", http.StatusUnauthorized)
+		return
+	}
+	if !s.validSignature(timestamp, body, r.Header.Get(callbackSignatureHeader)) {
+		log.Printf("Rejected room callback from %s: bad signature", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if skew := time.Since(time.Unix(sent, 0)); skew > callbackMaxSkew || skew < -callbackMaxSkew {
+		log.Printf("Rejected room callback from %s: timestamp %d is %v off", r.RemoteAddr, sent, skew.Round(time.Second))
+		http.Error(w, "stale callback", http.StatusUnauthorized)
+		return
+	}
+
+	var cb RoomCallback
+	if err := json.Unmarshal(body, &cb); err != nil || cb.RoomID == "" {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+	switch cb.Event {
+	case "room_created", "peer_joined", "peer_left", "room_ended":
+	default:
+		http.Error(w, "unknown event", http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case s.queue <- cb:
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		// Polling will reconcile anything we drop here
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}
+}
+
+// Check the timestamp and body against their "sha256=<hex>" HMAC header.
+// Signing the timestamp keeps a captured callback from being replayed
+// with a fresh one.
+func (s *callbackServer) validSignature(timestamp string, body []byte, header string) bool {
+	got, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	return hmac.Equal(got, callbackSignature(s.secret, timestamp, body))
+}
+
+// HMAC-SHA256 of "<timestamp>.<body>", as the SFU signs callbacks
+func callbackSignature(secret []byte, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Apply queued callbacks one at a time so transitions stay in order
+func (s *callbackServer) run(ctx context.Context) {
+	for {
+		select {
+		case cb := <-s.queue:
+			s.apply(ctx, cb)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *callbackServer) apply(ctx context.Context, cb RoomCallback) {
+	log.Printf("Received %s callback for room %s", cb.Event, cb.RoomID)
+
+	if cb.Event == "room_ended" {
+		s.mu.Lock()
+		delete(s.meetings, cb.RoomID)
+		s.mu.Unlock()
+		s.announcer.endRooms(ctx, []string{cb.RoomID})
+		return
+	}
+
+	s.mu.Lock()
+	meeting, exists := s.meetings[cb.RoomID]
+	if !exists {
+		meeting = &Meeting{RoomID: cb.RoomID}
+		s.meetings[cb.RoomID] = meeting
+		// A peer callback for a room we haven't seen, say after a
+		// restart, only tells us about that one peer
+		if cb.Event != "room_created" {
+			s.partial[cb.RoomID] = true
+		}
+	}
+
+	switch {
+	case cb.Peers != nil:
+		meeting.Peers = cb.Peers
+		delete(s.partial, cb.RoomID)
+	case cb.Peer != nil && cb.Event == "peer_left":
+		meeting.Peers = removePeer(meeting.Peers, *cb.Peer)
+	case cb.Peer != nil:
+		meeting.Peers = append(meeting.Peers, *cb.Peer)
+	}
+	snapshot := Meeting{RoomID: meeting.RoomID, Peers: append([]Peer(nil), meeting.Peers...)}
+	partial := s.partial[cb.RoomID]
+	s.mu.Unlock()
+
+	// Announcing the peers we know of would drop the others from the
+	// event, so the next poll announces the room instead
+	if partial {
+		log.Printf("Room %s isn't known yet, leaving it to the next poll", cb.RoomID)
+		return
+	}
+
+	s.announcer.syncMeetings(ctx, []Meeting{snapshot}, false)
+}
+
+// Replace the live meeting view with a full API snapshot
+func (s *callbackServer) resetMeetings(meetings []Meeting) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.meetings = make(map[string]*Meeting, len(meetings))
+	s.partial = make(map[string]bool)
+	for i := range meetings {
+		meeting := meetings[i]
+		s.meetings[meeting.RoomID] = &meeting
+	}
+}
+
+// Remove the first peer matching left's name and pubkey
+func removePeer(peers []Peer, left Peer) []Peer {
+	for i, peer := range peers {
+		if peer.Name == left.Name && stringPtrEqual(peer.Pubkey, left.Pubkey) {
+			return append(peers[:i:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
+
+func stringPtrEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+)
+
+func TestCallbackVerification(t *testing.T) {
+	secret := []byte("callback-secret")
+	body := `{"event":"room_created","roomId":"56377RedLizard"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(10*time.Minute).Unix(), 10)
+	sign := func(timestamp string) string {
+		return "sha256=" + hex.EncodeToString(callbackSignature(secret, timestamp, []byte(body)))
+	}
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		want      int
+	}{
+		{"valid", now, sign(now), http.StatusAccepted},
+		{"bad signature", now, "sha256=" + strings.Repeat("ab", 32), http.StatusUnauthorized},
+		{"missing timestamp", "", sign(""), http.StatusUnauthorized},
+		{"stale timestamp", stale, sign(stale), http.StatusUnauthorized},
+		{"timestamp from the future", future, sign(future), http.StatusUnauthorized},
+		{"timestamp swapped after signing", stale, sign(now), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &callbackServer{secret: secret, queue: make(chan RoomCallback, 1)}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			if test.timestamp != "" {
+				req.Header.Set(callbackTimestampHeader, test.timestamp)
+			}
+			req.Header.Set(callbackSignatureHeader, test.signature)
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			if w.Code != test.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+			if queued := len(s.queue) == 1; queued != (test.want == http.StatusAccepted) {
+				t.Errorf("callback queued: %v", queued)
+			}
+		})
+	}
+}
+
+// A single peer's callback for a room the poller hasn't seen must not
+// announce the room with just that peer
+func TestCallbackForAnUnknownRoom(t *testing.T) {
+	t.Setenv("DTAG_MODE", "random")
+	t.Setenv("PRESENCE_SECRET", "")
+
+	dir := t.TempDir()
+	poll := filepath.Join(dir, "poll-001.json")
+	if err := os.WriteFile(poll, []byte(`{"meetings":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	api := newReplayAPI(t, []string{poll})
+	relay := relaytest.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := newPollServer(ctx, ServerConfig{
+		BaseURL:        api.server.URL,
+		APIKey:         "replay-api-key",
+		NostrPvtKey:    replayPrivateKey,
+		RelayURLs:      []string{relay.URL()},
+		StatePath:      filepath.Join(dir, "rooms.json"),
+		CallbackSecret: "callback-secret",
+	}, pollOptions{storeKind: "json", closePolicy: engine.ClosePolicy{GracePolls: 1}, callbacks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.store.Close()
+	if err := s.loop.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	giraffe := "51e4b4648a549a62bd3e6670122b931cebc8723bc0ff7e8032fe087b00eb3dbd"
+	zebra := "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	presenter := Peer{Name: "giraffe", Presenter: true, Pubkey: &giraffe}
+	s.callbacks.apply(ctx, RoomCallback{Event: "peer_joined", RoomID: "Lobby", Peer: &presenter})
+	s.callbacks.apply(ctx, RoomCallback{Event: "peer_joined", RoomID: "Lobby", Peer: &Peer{Name: "guest"}})
+	if n := len(relay.Events()); n != 0 {
+		t.Fatalf("published %d events from single peer callbacks", n)
+	}
+
+	// A full peer list is enough to announce it
+	s.callbacks.apply(ctx, RoomCallback{Event: "peer_joined", RoomID: "Lobby", Peers: []Peer{presenter, {Name: "zebra", Pubkey: &zebra}}})
+	events := relay.Events()
+	if len(events) != 1 {
+		t.Fatalf("published %d events from a full peer list, want 1", len(events))
+	}
+	if p := events[0].Tags.GetAll([]string{"p", ""}); len(p) != 2 {
+		t.Errorf("announced with %d p tags, want 2", len(p))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Move every room whose stored d tag differs from its derived one over to
+// the derived d tag. Open rooms are announced open under the new d tag
+// before their old event is closed. The poller must not be running.
+func migrateDTags(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-dtags", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the migration without publishing or saving anything")
+	serverName := flags.String("server", "", "server to migrate, by name in SERVERS_FILE")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := serverConfigByName(*serverName)
+	if err != nil {
+		return err
+	}
+	baseURL, relayURLs := cfg.BaseURL, cfg.RelayURLs
+	deriver, err := engine.NewDTagDeriverFromEnv(baseURL)
+	if err != nil {
+		return err
+	}
+	if deriver == nil {
+		return fmt.Errorf("set DTAG_MODE=hmac and DTAG_SECRET to migrate to derived d tags")
+	}
+
+	storeKind, _ := engine.StatePathFromEnv("rooms")
+	store, err := engine.OpenRoomStore[RoomInfo](storeKind, cfg.StatePath)
+	if err != nil {
+		return fmt.Errorf("error opening room state store: %v", err)
+	}
+	defer store.Close()
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		return fmt.Errorf("error loading room database: %v", err)
+	}
+
+	roomIDs := []string{}
+	for roomID, info := range db.Rooms {
+		if info.DTag != deriver.Derive(roomID) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	sort.Strings(roomIDs)
+	log.Printf("%d of %d rooms need a new d tag", len(roomIDs), len(db.Rooms))
+	if *dryRun {
+		for _, roomID := range roomIDs {
+			info := db.Rooms[roomID]
+			fmt.Printf("%s\t%s\t%s -> %s\n", roomID, info.Status, info.DTag, deriver.Derive(roomID))
+		}
+		return nil
+	}
+	if len(roomIDs) == 0 {
+		return nil
+	}
+
+	signer, err := engine.NewSigner(ctx, cfg.NostrPvtKey, cfg.BunkerURI, cfg.BunkerClientKey)
+	if err != nil {
+		return fmt.Errorf("error setting up event signer: %v", err)
+	}
+	tmpl, err := loadEventTemplate(cfg.EventTemplate)
+	if err != nil {
+		return fmt.Errorf("error loading event template: %v", err)
+	}
+	heartbeat := engine.EnvDuration("HEARTBEAT_INTERVAL", 0)
+	publisher := engine.RelayPublisher{URLs: relayURLs}
+	zaps, err := newZapTaggerFromEnv()
+	if err != nil {
+		return fmt.Errorf("error setting up zap tags: %v", err)
+	}
+	var policy *policyEngine
+	if policyPath := os.Getenv("POLICY_FILE"); policyPath != "" {
+		if policy, err = newPolicyEngine(policyPath); err != nil {
+			return fmt.Errorf("error loading room policy: %v", err)
+		}
+	}
+
+	for _, roomID := range roomIDs {
+		info := db.Rooms[roomID]
+		oldDTag, newDTag := info.DTag, deriver.Derive(roomID)
+
+		if engine.Live(info.Status) {
+			overrides := policy.lookup(roomID, info.Presenter).Tags
+			opened := roomEvent{
+				roomID:       roomID,
+				dTag:         newDTag,
+				status:       info.Status,
+				participants: info.Participants,
+				counts:       info.Counts,
+				expiration:   engine.HeartbeatExpiration(time.Now(), heartbeat, info.Status),
+				overrides:    overrides,
+				zaps:         zaps.recipients(info.Participants),
+			}
+			if err := publishEvent(ctx, signer, publisher, tmpl, opened, relayURLs, baseURL); err != nil {
+				return fmt.Errorf("error announcing room %s under dTag %s: %v", roomID, newDTag, err)
+			}
+			closed := roomEvent{roomID: roomID, dTag: oldDTag, status: "closed", overrides: overrides}
+			if err := publishEvent(ctx, signer, publisher, tmpl, closed, relayURLs, baseURL); err != nil {
+				log.Printf("Error closing old dTag %s for room %s: %v", oldDTag, roomID, err)
+			}
+		}
+
+		// Save after every room so an interrupted migration can be resumed
+		info.DTag = newDTag
+		db.Rooms[roomID] = info
+		db.dirty = true
+		if err := db.commit(); err != nil {
+			return fmt.Errorf("error saving room database: %v", err)
+		}
+		log.Printf("Migrated room %s from dTag %s to %s", roomID, oldDTag, newDTag)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+)
+
+func TestMigrateDTags(t *testing.T) {
+	const baseURL = "https://hivetalk.example"
+	relay := relaytest.New(t)
+	statePath := filepath.Join(t.TempDir(), "rooms.json")
+	for key, value := range map[string]string{
+		"BASE_URL":         baseURL,
+		"HIVETALK_API_KEY": "replay-api-key",
+		"NOSTR_PVT_KEY":    replayPrivateKey,
+		"RELAY_URLS":       relay.URL(),
+		"STATE_PATH":       statePath,
+		"STATE_STORE":      "json",
+		"SERVERS_FILE":     "",
+		"POLICY_FILE":      "",
+		"DTAG_MODE":        "hmac",
+		"DTAG_SECRET":      "dtag-secret",
+	} {
+		t.Setenv(key, value)
+	}
+	deriver := engine.NewDTagDeriver("dtag-secret", baseURL)
+
+	store, err := engine.OpenRoomStore[RoomInfo]("json", statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(map[string]RoomInfo{
+		"Lobby":   {DTag: "old-lobby", RoomState: engine.RoomState{Status: "open"}},
+		"Archive": {DTag: "old-archive", RoomState: engine.RoomState{Status: "closed"}},
+		"Derived": {DTag: deriver.Derive("Derived"), RoomState: engine.RoomState{Status: "open"}},
+	})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func() map[string]RoomInfo {
+		store, err := engine.OpenRoomStore[RoomInfo]("json", statePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		rooms, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rooms
+	}
+	ctx := context.Background()
+
+	// A dry run changes nothing
+	if err := migrateDTags(ctx, []string{"-dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	if rooms := load(); rooms["Lobby"].DTag != "old-lobby" || len(relay.Events()) != 0 {
+		t.Fatalf("dry run moved Lobby to %s and published %d events", rooms["Lobby"].DTag, len(relay.Events()))
+	}
+
+	if err := migrateDTags(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	rooms := load()
+	for _, roomID := range []string{"Lobby", "Archive", "Derived"} {
+		if rooms[roomID].DTag != deriver.Derive(roomID) {
+			t.Errorf("room %s has d tag %s, want the derived %s", roomID, rooms[roomID].DTag, deriver.Derive(roomID))
+		}
+	}
+
+	// Only the open room is announced again, opened under its new d tag
+	// and closed under its old one
+	status := map[string]string{}
+	for _, ev := range relay.Events() {
+		d, s := ev.Tags.GetFirst([]string{"d", ""}), ev.Tags.GetFirst([]string{"status", ""})
+		if d != nil && s != nil {
+			status[(*d)[1]] = (*s)[1]
+		}
+	}
+	want := map[string]string{deriver.Derive("Lobby"): "open", "old-lobby": "closed"}
+	if len(status) != len(want) || status[deriver.Derive("Lobby")] != "open" || status["old-lobby"] != "closed" {
+		t.Errorf("published statuses %v, want %v", status, want)
+	}
+
+	// Running it again has nothing left to do
+	published := len(relay.Events())
+	if err := migrateDTags(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(relay.Events()); n != published {
+		t.Errorf("second migration published %d more events", n-published)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Republish open and private rooms whose last announcement is a heartbeat
+// old, if the last successful poll saw them
+func (a *Announcer) republishOpen(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.db.Tracker.Now()
+	due := []string{}
+	for roomID, info := range a.db.Rooms {
+		if engine.HeartbeatDue(now, a.heartbeat, info.RoomState, info.LastPublished, a.lastPoll) {
+			due = append(due, roomID)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Strings(due)
+
+	for _, roomID := range due {
+		a.db.markPublished(roomID)
+	}
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	log.Printf("Heartbeat: republishing %d live rooms", len(due))
+	for _, roomID := range due {
+		info := a.db.Rooms[roomID]
+		room := roomEvent{
+			roomID:       roomID,
+			dTag:         info.DTag,
+			status:       info.Status,
+			participants: info.Participants,
+			counts:       info.Counts,
+			expiration:   engine.HeartbeatExpiration(now, a.heartbeat, info.Status),
+			overrides:    a.overrides(roomID),
+			zaps:         a.zaps.recipients(info.Participants),
+		}
+		if err := publishEvent(ctx, a.signer, a.publisher, a.template, room, a.relayURLs, a.baseURL); err != nil {
+			log.Printf("Error republishing %s event for room %s: %v", info.Status, roomID, err)
+		}
+	}
+}
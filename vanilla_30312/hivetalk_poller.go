@@ -9,9 +9,15 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
 	"github.com/joho/godotenv"
 	"github.com/nbd-wtf/go-nostr"
 )
@@ -36,14 +42,93 @@ type Peer struct {
 
 // Simple database to track rooms and their status
 type RoomDatabase struct {
-	Rooms map[string]RoomInfo
-	Path  string
+	Rooms   map[string]RoomInfo
+	Tracker engine.Tracker
+	store   engine.RoomStore[RoomInfo]
+	dirty   bool
+
+	// Derives d tags for new rooms; random d tags when nil
+	deriver *engine.DTagDeriver
 }
 
 type RoomInfo struct {
-	DTag      string    `json:"d_tag"`
-	Status    string    `json:"status"`
-	LastSeen  time.Time `json:"last_seen"`
+	DTag string `json:"d_tag"`
+
+	// Status, last seen and flap tracking, kept by the engine's Tracker
+	engine.RoomState
+
+	// Identified peers last announced for the room
+	Participants []Participant `json:"participants,omitempty"`
+
+	// When the room was last announced as open, for heartbeats
+	LastPublished time.Time `json:"last_published"`
+
+	// Presenter pubkey last seen, for policy lookups
+	Presenter string `json:"presenter,omitempty"`
+}
+
+// An identified peer, published as a NIP-53 p tag with its role
+type Participant struct {
+	Pubkey    string `json:"pubkey"`
+	Role      string `json:"role"`
+	Lnaddress string `json:"lnaddress,omitempty"` // hosts only, for zap tags
+}
+
+// A 30312 announcement for one room
+type roomEvent struct {
+	roomID       string
+	dTag         string
+	status       string
+	participants []Participant
+	counts       engine.ParticipantCounts
+	expiration   time.Time  // NIP-40 expiration, zero for none
+	overrides    nostr.Tags // policy tags replacing rendered ones
+	zaps         []string   // pubkeys that zaps to the room are split between
+}
+
+// Role for peers that are not presenters ("Participant" or "Speaker")
+var peerRole = "Participant"
+
+// Build the list of identified peers in a meeting. Presenters are hosts,
+// everyone else gets peerRole. A pubkey that joined more than once is
+// listed once with its highest role. Hosts keep their lightning address
+// for zap tags.
+func identifiedParticipants(peers []Peer) []Participant {
+	roles := make(map[string]string)
+	lnaddresses := make(map[string]string)
+	for _, peer := range peers {
+		if peer.Pubkey == nil || *peer.Pubkey == "" {
+			continue
+		}
+		pubkey := *peer.Pubkey
+		if peer.Presenter {
+			roles[pubkey] = "Host"
+			if peer.Lnaddress != nil && *peer.Lnaddress != "" {
+				lnaddresses[pubkey] = strings.TrimSpace(*peer.Lnaddress)
+			}
+		} else if _, seen := roles[pubkey]; !seen {
+			roles[pubkey] = peerRole
+		}
+	}
+
+	participants := make([]Participant, 0, len(roles))
+	for pubkey, role := range roles {
+		participant := Participant{Pubkey: pubkey, Role: role}
+		if role == "Host" {
+			participant.Lnaddress = lnaddresses[pubkey]
+		}
+		participants = append(participants, participant)
+	}
+
+	// Hosts first, then by pubkey, so the list compares stably between polls
+	sort.Slice(participants, func(i, j int) bool {
+		hi, hj := participants[i].Role == "Host", participants[j].Role == "Host"
+		if hi != hj {
+			return hi
+		}
+		return participants[i].Pubkey < participants[j].Pubkey
+	})
+	return participants
 }
 
 // Global random source
@@ -59,43 +144,29 @@ func generateDTag() string {
 	return string(result)
 }
 
-// Load the room database from a file
-func loadRoomDatabase(path string) (*RoomDatabase, error) {
-	db := &RoomDatabase{
-		Rooms: make(map[string]RoomInfo),
-		Path:  path,
-	}
-
-	// Check if the file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		// Create a new file
-		return db, db.save()
-	}
-
-	// Read the file
-	data, err := os.ReadFile(path)
+// Load the room database from a store
+func loadRoomDatabase(store engine.RoomStore[RoomInfo]) (*RoomDatabase, error) {
+	rooms, err := store.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	// Unmarshal the data
-	if len(data) > 0 {
-		if err := json.Unmarshal(data, &db.Rooms); err != nil {
-			return nil, err
-		}
-	}
-
-	return db, nil
+	return &RoomDatabase{
+		Rooms: rooms,
+		store: store,
+	}, nil
 }
 
-// Save the room database to a file
-func (db *RoomDatabase) save() error {
-	data, err := json.MarshalIndent(db.Rooms, "", "  ")
-	if err != nil {
+// Commit pending changes to the store, once per poll cycle
+func (db *RoomDatabase) commit() error {
+	if !db.dirty {
+		return nil
+	}
+	if err := db.store.Save(db.Rooms); err != nil {
 		return err
 	}
-
-	return os.WriteFile(db.Path, data, 0644)
+	db.dirty = false
+	return nil
 }
 
 // Get the d tag for a room, creating one if it doesn't exist
@@ -106,14 +177,14 @@ func (db *RoomDatabase) getDTag(roomID string) string {
 
 	// Create a new d tag
 	dTag := generateDTag()
-	db.Rooms[roomID] = RoomInfo{
-		DTag:     dTag,
-		Status:   "unknown",
-		LastSeen: time.Time{},
+	if db.deriver != nil {
+		dTag = db.deriver.Derive(roomID)
 	}
-	if err := db.save(); err != nil {
-		log.Printf("Error saving room database after creating dTag for room %s: %v", roomID, err)
+	db.Rooms[roomID] = RoomInfo{
+		DTag:      dTag,
+		RoomState: engine.RoomState{Status: "unknown"},
 	}
+	db.dirty = true
 	return dTag
 }
 
@@ -121,35 +192,59 @@ func (db *RoomDatabase) getDTag(roomID string) string {
 func (db *RoomDatabase) updateRoomStatus(roomID, status string) bool {
 	info, exists := db.Rooms[roomID]
 	if !exists {
-		info = RoomInfo{
-			DTag:     db.getDTag(roomID),
-			Status:   status,
-			LastSeen: time.Now(),
-		}
-		db.Rooms[roomID] = info
-		if err := db.save(); err != nil {
-			log.Printf("Error saving room database after creating new room %s: %v", roomID, err)
-		}
-		return true // Status changed
+		info = RoomInfo{DTag: db.getDTag(roomID)}
 	}
+	changed := db.Tracker.Set(roomID, &info.RoomState, status)
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return changed || !exists
+}
 
-	if info.Status != status {
-		info.Status = status
-		info.LastSeen = time.Now()
-		db.Rooms[roomID] = info
-		if err := db.save(); err != nil {
-			log.Printf("Error saving room database after updating status for room %s: %v", roomID, err)
-		}
-		return true // Status changed
+// Record the identified participants of a room, reporting whether they
+// differ from the ones last announced
+func (db *RoomDatabase) updateParticipants(roomID string, participants []Participant) bool {
+	info := db.Rooms[roomID]
+	changed := len(info.Participants) != len(participants)
+	for i := 0; !changed && i < len(participants); i++ {
+		changed = info.Participants[i] != participants[i]
 	}
+	if !changed {
+		return false
+	}
+
+	info.Participants = participants
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return true
+}
 
-	// Update last seen time
-	info.LastSeen = time.Now()
+// Record that a room is being announced as open now
+func (db *RoomDatabase) markPublished(roomID string) {
+	info := db.Rooms[roomID]
+	info.LastPublished = db.Tracker.Now()
+	db.Tracker.Announced(&info.RoomState)
 	db.Rooms[roomID] = info
-	if err := db.save(); err != nil {
-		log.Printf("Error saving room database after updating last seen time for room %s: %v", roomID, err)
+	db.dirty = true
+}
+
+// Record a room's presenter pubkey
+func (db *RoomDatabase) setPresenter(roomID, presenter string) {
+	info := db.Rooms[roomID]
+	if info.Presenter != presenter {
+		info.Presenter = presenter
+		db.Rooms[roomID] = info
+		db.dirty = true
 	}
-	return false // Status didn't change
+}
+
+// Record the number of peers in a room, reporting whether the change is
+// due to be republished
+func (db *RoomDatabase) countPeers(roomID string, count int) bool {
+	info := db.Rooms[roomID]
+	due := db.Tracker.Count(&info.RoomState, count)
+	db.Rooms[roomID] = info
+	db.dirty = true
+	return due
 }
 
 // Check for rooms that have closed
@@ -164,23 +259,34 @@ func (db *RoomDatabase) checkClosedRooms(activeRoomIDs []string) []string {
 
 	// Check for rooms that were previously open but are not in the active list
 	for roomID, info := range db.Rooms {
-		if info.Status == "open" && !activeRoomMap[roomID] {
-			// Room is no longer active
-			closedRooms = append(closedRooms, roomID)
-			db.updateRoomStatus(roomID, "closed")
+		if activeRoomMap[roomID] {
+			continue
 		}
+		closeNow, changed := db.Tracker.Absent(roomID, &info.RoomState)
+		if changed {
+			db.Rooms[roomID] = info
+			db.dirty = true
+		}
+		if !closeNow {
+			continue
+		}
+		// Room is no longer active
+		closedRooms = append(closedRooms, roomID)
+		db.updateRoomStatus(roomID, "closed")
 	}
 
+	// Announce in a stable order rather than map order
+	sort.Strings(closedRooms)
 	return closedRooms
 }
 
 // Fetch meetings from the HiveTalk API
-func fetchMeetings(baseURL, apiKey string) (*HiveTalkResponse, error) {
+func fetchMeetings(ctx context.Context, baseURL, apiKey string, recorder *engine.ResponseRecorder) (*HiveTalkResponse, error) {
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
 
-	req, err := http.NewRequest("GET", baseURL+"/api/v1/meetings", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/api/v1/meetings", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -202,6 +308,7 @@ func fetchMeetings(baseURL, apiKey string) (*HiveTalkResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	recorder.Record(body)
 
 	var response HiveTalkResponse
 	if err := json.Unmarshal(body, &response); err != nil {
@@ -212,35 +319,57 @@ func fetchMeetings(baseURL, apiKey string) (*HiveTalkResponse, error) {
 }
 
 // Create and publish a 30312 event
-func publishEvent(ctx context.Context, privateKey, roomID, dTag, status string, ownerPubkey string, relayURLs []string, baseURL string) error {
+func publishEvent(ctx context.Context, signer engine.Signer, publisher engine.Publisher, tmpl *EventTemplate, room roomEvent, relayURLs []string, baseURL string) error {
+	roomID, dTag, status := room.roomID, room.dTag, room.status
 	log.Printf("Publishing %s event for room %s with dTag %s", status, roomID, dTag)
 	
-	// Get public key from private key
-	pubkey, err := nostr.GetPublicKey(privateKey)
+	pubkey := signer.PublicKey()
+	log.Printf("Using pubkey: %s", pubkey)
+
+	// Render the descriptive tags from the event template
+	data := TemplateData{
+		RoomID:  roomID,
+		Name:    roomID,
+		Status:  status,
+		BaseURL: baseURL,
+	}
+	for _, participant := range room.participants {
+		if participant.Role == "Host" {
+			data.Presenter = participant.Pubkey
+			break
+		}
+	}
+	descriptive, err := tmpl.render(data)
 	if err != nil {
-		return fmt.Errorf("error getting public key: %v", err)
+		return err
 	}
-	log.Printf("Using pubkey: %s", pubkey)
+	descriptive = overrideTags(descriptive, room.overrides)
 
-	// Create event tags
-	tags := nostr.Tags{
-		nostr.Tag{"d", dTag},
-		nostr.Tag{"room", roomID},
-		nostr.Tag{"summary", "HiveTalk Room"},
-		nostr.Tag{"status", status},
-		nostr.Tag{"image", baseURL+"/logo.png"},
-		nostr.Tag{"service", fmt.Sprintf(baseURL+"/join/%s", roomID)},
+	// Invite-only rooms don't advertise a public join URL
+	if status == "private" {
+		descriptive = engine.WithoutTag(descriptive, "service")
 	}
 
-	// Add owner tag if available
-	if ownerPubkey != "" {
-		log.Printf("Adding owner pubkey: %s", ownerPubkey)
-		tags = append(tags, nostr.Tag{"p", ownerPubkey, "owner"})
+	// Create event tags. The room ID tag lets lost room state be
+	// rebuilt from relays.
+	tags := nostr.Tags{nostr.Tag{"d", dTag}, engine.RoomIDTag(roomID, data.BaseURL)}
+	tags = append(tags, descriptive...)
+	tags = append(tags, nostr.Tag{"status", status})
+	tags = append(tags, engine.ParticipantTags(status, room.counts)...)
+
+	// Add a p tag for every identified participant
+	for _, participant := range room.participants {
+		log.Printf("Adding %s pubkey: %s", participant.Role, participant.Pubkey)
+		tags = append(tags, nostr.Tag{"p", participant.Pubkey, "", participant.Role})
 	}
 
-	// Add t tags
-	tags = append(tags, nostr.Tag{"t", "hivetalk-vanilla"})
-	tags = append(tags, nostr.Tag{"t", "interactive room"})
+	// Let zap-capable clients tip the presenters (NIP-57)
+	tags = append(tags, zapTags(room.zaps, relayURLs)...)
+
+	// Let relays drop the event if it isn't refreshed in time
+	if !room.expiration.IsZero() {
+		tags = append(tags, nostr.Tag{"expiration", strconv.FormatInt(room.expiration.Unix(), 10)})
+	}
 
 	// Add relays tag
 	relaysTag := []string{"relays"}
@@ -257,47 +386,262 @@ func publishEvent(ctx context.Context, privateKey, roomID, dTag, status string,
 	}
 
 	// Sign the event
-	if err := ev.Sign(privateKey); err != nil {
+	if err := signer.SignEvent(ctx, &ev); err != nil {
 		return fmt.Errorf("error signing event: %v", err)
 	}
 	log.Printf("Event signed with ID: %s", ev.ID)
 
-	// Publish to each relay
-	for _, url := range relayURLs {
-		// Trim any whitespace
-		url = strings.TrimSpace(url)
-		log.Printf("Connecting to relay: %s", url)
+	return publisher.Publish(ctx, ev)
+}
+
+// Announcer turns room observations into state transitions and 30312
+// events. The poll loop and the callback listener share one instance.
+type Announcer struct {
+	mu        sync.Mutex
+	db        *RoomDatabase
+	signer    engine.Signer
+	publisher engine.Publisher
+	template  *EventTemplate
+	relayURLs []string
+	baseURL   string
+	presence  *presencePublisher // nil unless presence mode is on
+	heartbeat time.Duration      // republish interval for open rooms, 0 when off
+	policy    *policyEngine      // nil allows every room
+	zaps      *zapTagger         // nil when zap tags are off
+
+	// When the last full API snapshot started being applied; heartbeats
+	// only republish rooms it saw
+	lastPoll time.Time
+}
 
-		// Create a timeout context for each relay connection
-		relayCtx, relayCancel := context.WithTimeout(ctx, 10*time.Second)
+// Apply a set of meetings to the room database and publish any changes.
+// When complete is true the meetings are a full API snapshot, so open
+// rooms missing from it are considered for closing.
+func (a *Announcer) syncMeetings(ctx context.Context, meetings []Meeting, complete bool) {
+	a.mu.Lock()
+	db := a.db
+	if complete {
+		a.lastPoll = db.Tracker.Now()
+	}
 
-		relay, err := nostr.RelayConnect(relayCtx, url)
-		if err != nil {
-			log.Printf("Error connecting to relay %s: %v\n", url, err)
-			relayCancel() // Cancel context if connection fails
+	activeRoomIDs := []string{}
+	roomsWithPubkey := []string{}
+	roomsWithoutPubkey := []string{}
+	closedRooms := []string{}
+	openedRooms := []roomEvent{}
+	liveRooms := []roomEvent{}
+
+	// Process each meeting
+	for _, meeting := range meetings {
+		log.Printf("Processing room: %s with %d peers", meeting.RoomID, len(meeting.Peers))
+		activeRoomIDs = append(activeRoomIDs, meeting.RoomID)
+
+		// Find the presenter (owner)
+		var ownerPubkey string
+		for _, peer := range meeting.Peers {
+			if peer.Presenter && peer.Pubkey != nil {
+				ownerPubkey = *peer.Pubkey
+				log.Printf("Found presenter with pubkey: %s", ownerPubkey)
+				break
+			}
+		}
+
+		// Skip if no presenter with a pubkey
+		if ownerPubkey == "" {
+			log.Printf("Skipping room %s: No presenter with pubkey found", meeting.RoomID)
+			roomsWithoutPubkey = append(roomsWithoutPubkey, meeting.RoomID)
+			continue
+		} else {
+			roomsWithPubkey = append(roomsWithPubkey, meeting.RoomID)
+		}
+
+		// Apply the room policy; a denied room that was announced is closed
+		decision := a.policy.decide(meeting.RoomID, ownerPubkey)
+		if decision.Action == policyDeny {
+			if info, exists := db.Rooms[meeting.RoomID]; exists && engine.Live(info.Status) {
+				db.updateRoomStatus(meeting.RoomID, "closed")
+				closedRooms = append(closedRooms, meeting.RoomID)
+			}
 			continue
 		}
 
-		publishStatus, err := relay.Publish(relayCtx, ev)
+		// Get or create d tag for this room
+		dTag := db.getDTag(meeting.RoomID)
+		log.Printf("Using dTag %s for room %s", dTag, meeting.RoomID)
+
+		// Update room status and participants. Private rooms are announced
+		// invite-only, with no join URL and nobody identified.
+		status := "open"
+		participants := identifiedParticipants(meeting.Peers)
+		if decision.Action == policyPrivate {
+			status = "private"
+			participants = nil
+		}
+		statusChanged := db.updateRoomStatus(meeting.RoomID, status)
+		db.setPresenter(meeting.RoomID, ownerPubkey)
+		participantsChanged := db.updateParticipants(meeting.RoomID, participants)
+		countChanged := db.countPeers(meeting.RoomID, len(meeting.Peers))
+		room := roomEvent{
+			roomID:       meeting.RoomID,
+			dTag:         dTag,
+			status:       status,
+			participants: participants,
+			counts:       db.Rooms[meeting.RoomID].Counts,
+			expiration:   engine.HeartbeatExpiration(db.Tracker.Now(), a.heartbeat, status),
+			overrides:    decision.Tags,
+			zaps:         a.zaps.recipients(participants),
+		}
 
-		// Always close the relay and cancel context when done
-		relay.Close()
-		relayCancel()
+		// Queue event if status or participants changed
+		if statusChanged {
+			log.Printf("Room %s status changed to %s", meeting.RoomID, status)
+			openedRooms = append(openedRooms, room)
+		} else if participantsChanged && engine.Live(db.Rooms[meeting.RoomID].Status) {
+			log.Printf("Room %s participants changed (%d identified), republishing", meeting.RoomID, len(participants))
+			openedRooms = append(openedRooms, room)
+		} else if countChanged && engine.Live(db.Rooms[meeting.RoomID].Status) {
+			log.Printf("Room %s now has %d peers, republishing", meeting.RoomID, room.counts.Current)
+			openedRooms = append(openedRooms, room)
+		} else {
+			log.Printf("Room %s already open, no event published", meeting.RoomID)
+		}
+		if engine.Live(db.Rooms[meeting.RoomID].Status) {
+			liveRooms = append(liveRooms, room)
+		}
+	}
 
-		if err != nil {
-			log.Printf("Error publishing to %s: %v\n", url, err)
-			continue
+	log.Printf("Rooms with presenter pubkey (%d): %v", len(roomsWithPubkey), roomsWithPubkey)
+	log.Printf("Rooms without presenter pubkey (%d): %v", len(roomsWithoutPubkey), roomsWithoutPubkey)
+
+	// Check for closed rooms
+	if complete {
+		closedRooms = append(closedRooms, db.checkClosedRooms(activeRoomIDs)...)
+		log.Printf("Found %d closed rooms", len(closedRooms))
+	}
+
+	for _, room := range openedRooms {
+		db.markPublished(room.roomID)
+	}
+
+	// Commit this cycle's state before announcing it, so a crash
+	// mid-publish never loses a d tag that is already on relays
+	if err := db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	for _, room := range openedRooms {
+		log.Printf("Publishing %s event for room %s", room.status, room.roomID)
+		if err := publishEvent(ctx, a.signer, a.publisher, a.template, room, a.relayURLs, a.baseURL); err != nil {
+			log.Printf("Error publishing %s event for room %s: %v", room.status, room.roomID, err)
 		}
-		log.Printf("Published event for room %s with status %s to %s, relay status: %v\n", roomID, status, url, publishStatus)
 	}
 
-	return nil
+	a.publishClosed(ctx, closedRooms)
+	a.mu.Unlock()
+
+	// Presence points at the 30312, so it follows the room announcements
+	a.updatePresence(ctx, liveRooms, closedRooms)
+}
+
+// Policy tag overrides for republishing a room outside a poll
+func (a *Announcer) overrides(roomID string) nostr.Tags {
+	return a.policy.lookup(roomID, a.db.Rooms[roomID].Presenter).Tags
 }
 
+// Close rooms the SFU reported as ended, without waiting out the grace window
+func (a *Announcer) endRooms(ctx context.Context, roomIDs []string) {
+	a.mu.Lock()
+
+	closedRooms := []string{}
+	for _, roomID := range roomIDs {
+		if info, exists := a.db.Rooms[roomID]; exists && engine.Live(info.Status) {
+			a.db.updateRoomStatus(roomID, "closed")
+			closedRooms = append(closedRooms, roomID)
+		}
+	}
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+	a.publishClosed(ctx, closedRooms)
+	a.mu.Unlock()
+
+	a.updatePresence(ctx, nil, closedRooms)
+}
+
+// Publish closed events for rooms already marked closed in the database
+func (a *Announcer) publishClosed(ctx context.Context, closedRooms []string) {
+	for _, roomID := range closedRooms {
+		dTag := a.db.getDTag(roomID)
+		log.Printf("Room %s closed, publishing closed event with dTag %s", roomID, dTag)
+		room := roomEvent{roomID: roomID, dTag: dTag, status: "closed", counts: a.db.Rooms[roomID].Counts, overrides: a.overrides(roomID)}
+		if err := publishEvent(ctx, a.signer, a.publisher, a.template, room, a.relayURLs, a.baseURL); err != nil {
+			log.Printf("Error publishing closed event for room %s: %v", roomID, err)
+		}
+	}
+}
+
+// Flush room state on shutdown. With closeRooms set, every room still
+// marked open is closed and announced as such, so relays don't show it
+// open forever if the poller never comes back.
+func (a *Announcer) shutdown(ctx context.Context, closeRooms bool) {
+	a.mu.Lock()
+
+	closedRooms := []string{}
+	if closeRooms {
+		for roomID, info := range a.db.Rooms {
+			if engine.Live(info.Status) {
+				a.db.updateRoomStatus(roomID, "closed")
+				closedRooms = append(closedRooms, roomID)
+			}
+		}
+		sort.Strings(closedRooms)
+	}
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+	a.publishClosed(ctx, closedRooms)
+	a.mu.Unlock()
+
+	a.updatePresence(ctx, nil, closedRooms)
+}
+
+// Run a one-off subcommand instead of the poller
+func runCommand(args []string) error {
+	// The .env file is optional for subcommands
+	godotenv.Load()
+
+	switch args[0] {
+	case "preview-template":
+		// preview-template [template.json]
+		path := os.Getenv("EVENT_TEMPLATE")
+		if len(args) > 1 {
+			path = args[1]
+		}
+		baseURL := os.Getenv("BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://hivetalk.org"
+		}
+		return previewEventTemplate(path, baseURL)
+	case "migrate-dtags":
+		// migrate-dtags [-dry-run]
+		return migrateDTags(context.Background(), args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
 
 func main() {
 	// Configure logging
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		return
+	}
 	log.Println("Starting HiveTalk vanilla poller...")
 	
 	// Load environment variables
@@ -306,123 +650,139 @@ func main() {
 	}
 	log.Println("Environment variables loaded")
 
-	// Get environment variables
-	baseURL := os.Getenv("BASE_URL")
-	apiKey := os.Getenv("HIVETALK_API_KEY")
-	privateKey := os.Getenv("NOSTR_PVT_KEY")
-	relayURLsStr := os.Getenv("RELAY_URLS")
-
-	// Validate environment variables
-	if baseURL == "" || apiKey == "" || privateKey == "" || relayURLsStr == "" {
-		log.Fatalf("Missing required environment variables. Please check your .env file.")
-	}
-	log.Printf("Using base URL: %s", baseURL)
-	log.Printf("Relay URLs: %s", relayURLsStr)
-
-	// Parse relay URLs
-	relayURLs := []string{}
-	for _, url := range strings.Split(relayURLsStr, ",") {
-		url = strings.TrimSpace(url)
-		if url != "" {
-			relayURLs = append(relayURLs, url)
+	// Get the servers to poll
+	servers, err := serverConfigsFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring servers: %v", err)
+	}
+	for _, cfg := range servers {
+		log.Printf("Announcing %s to %d relays: %v", cfg.BaseURL, len(cfg.RelayURLs), cfg.RelayURLs)
+	}
+
+	storeKind, _ := engine.StatePathFromEnv("rooms")
+	opts := pollOptions{
+		storeKind: storeKind,
+		closePolicy: engine.ClosePolicy{
+			GracePolls:  engine.EnvInt("CLOSE_GRACE_POLLS", 2),
+			GracePeriod: engine.EnvDuration("CLOSE_GRACE_PERIOD", 0),
+			MinOpenTime: engine.EnvDuration("MIN_OPEN_TIME", 0),
+		},
+		throttle: engine.CountThrottle{
+			MinInterval: engine.EnvDuration("PARTICIPANT_UPDATE_INTERVAL", 2*time.Minute),
+			MinDelta:    engine.EnvInt("PARTICIPANT_UPDATE_DELTA", 1),
+		},
+		heartbeat: engine.EnvDuration("HEARTBEAT_INTERVAL", 0),
+		// Rebuild lost room state from relays once the first poll tells
+		// us which rooms are live
+		reconcile: engine.EnvBool("RECONCILE_FROM_RELAYS", true),
+	}
+	if os.Getenv("DTAG_MODE") == "hmac" {
+		log.Printf("Deriving d tags for new rooms from DTAG_SECRET")
+	}
+	if role := os.Getenv("PEER_ROLE"); role != "" {
+		peerRole = role
+	}
+	log.Printf("Closing rooms after %d missed poll(s) and at least %v; re-announcing after %v", opts.closePolicy.GracePolls, opts.closePolicy.GracePeriod, opts.closePolicy.MinOpenTime)
+	log.Printf("Republishing participant counts on changes of %d or more, at most every %v", opts.throttle.MinDelta, opts.throttle.MinInterval)
+	if opts.heartbeat > 0 {
+		if opts.heartbeat < time.Minute {
+			log.Fatalf("HEARTBEAT_INTERVAL must be at least 1m")
 		}
+		log.Printf("Republishing open rooms every %v with a NIP-40 expiration", opts.heartbeat)
 	}
-
-	if len(relayURLs) == 0 {
-		log.Fatalf("No relay URLs found. Please check your RELAY_URLS environment variable.")
+	if os.Getenv("PRESENCE_SECRET") != "" {
+		log.Printf("Publishing room presence for identified peers")
 	}
-	log.Printf("Found %d relay URLs", len(relayURLs))
 
-	// Load or create the room database
-	db, err := loadRoomDatabase("rooms.json")
-	if err != nil {
-		log.Fatalf("Error loading room database: %v", err)
-	}
-	log.Printf("Room database loaded with %d rooms", len(db.Rooms))
+	// Cancelled on SIGINT/SIGTERM, which stops polling and any in-flight
+	// relay publishes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Create context
-	ctx := context.Background()
+	// Add NIP-57 zap tags for presenters with a lightning address
+	if opts.zaps, err = newZapTaggerFromEnv(); err != nil {
+		log.Fatalf("Error setting up zap tags: %v", err)
+	}
+	if opts.zaps != nil {
+		log.Printf("Adding zap tags for presenters (verifying LNURL: %v)", opts.zaps.verify)
+	}
 
-	// Polling interval (1 minute)
-	interval := 1 * time.Minute
+	// Decide which rooms are announced from a reloadable policy file
+	if policyPath := os.Getenv("POLICY_FILE"); policyPath != "" {
+		if opts.policy, err = newPolicyEngine(policyPath); err != nil {
+			log.Fatalf("Error loading room policy: %v", err)
+		}
+		go opts.policy.reloadOnSignal(ctx)
+	}
 
-	log.Printf("Polling %s every %v", baseURL, interval)
+	// Polling interval (1 minute), or a slower reconciliation interval
+	// when the SFU pushes room lifecycle callbacks
+	listenAddr := os.Getenv("CALLBACK_LISTEN_ADDR")
+	opts.callbacks = listenAddr != ""
+	opts.interval = engine.EnvDuration("POLL_INTERVAL", 1*time.Minute)
+	if opts.callbacks {
+		opts.interval = engine.EnvDuration("POLL_INTERVAL", 10*time.Minute)
+	}
+	opts.maxBackoff = engine.EnvDuration("POLL_MAX_BACKOFF", 15*time.Minute)
 
-	// Main polling loop
-	for {
-		log.Println("Polling for meetings...")
-		
-		// Fetch meetings
-		response, err := fetchMeetings(baseURL, apiKey)
+	pollServers := []*pollServer{}
+	for _, cfg := range servers {
+		s, err := newPollServer(ctx, cfg, opts)
 		if err != nil {
-			log.Printf("Error fetching meetings: %v", err)
-			time.Sleep(interval)
-			continue
+			log.Fatalf("Error setting up %s: %v", cfg.BaseURL, err)
 		}
-		log.Printf("Found %d active meetings", len(response.Meetings))
-
-		activeRoomIDs := []string{}
-		roomsWithPubkey := []string{}
-		roomsWithoutPubkey := []string{}
-
-		// Process each meeting
-		for _, meeting := range response.Meetings {
-			log.Printf("Processing room: %s with %d peers", meeting.RoomID, len(meeting.Peers))
-			activeRoomIDs = append(activeRoomIDs, meeting.RoomID)
-			
-			// Find the presenter (owner)
-			var ownerPubkey string
-			for _, peer := range meeting.Peers {
-				if peer.Presenter && peer.Pubkey != nil {
-					ownerPubkey = *peer.Pubkey
-					log.Printf("Found presenter with pubkey: %s", ownerPubkey)
-					break
-				}
-			}
+		defer s.store.Close()
+		pollServers = append(pollServers, s)
+	}
 
-			// Skip if no presenter with a pubkey
-			if ownerPubkey == "" {
-				log.Printf("Skipping room %s: No presenter with pubkey found", meeting.RoomID)
-				roomsWithoutPubkey = append(roomsWithoutPubkey, meeting.RoomID)
-				continue
-			} else {
-				roomsWithPubkey = append(roomsWithPubkey, meeting.RoomID)
+	// Each server's callbacks arrive on their own path
+	var callbackListener *http.Server
+	if opts.callbacks {
+		mux := http.NewServeMux()
+		for _, s := range pollServers {
+			mux.Handle(s.callbackPath(), s.callbacks)
+		}
+		callbackListener = &http.Server{Addr: listenAddr, Handler: mux}
+		go func() {
+			log.Printf("Listening for HiveTalk room callbacks on %s", listenAddr)
+			if err := callbackListener.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Callback listener failed: %v", err)
 			}
+		}()
+	}
 
-			// Get or create d tag for this room
-			dTag := db.getDTag(meeting.RoomID)
-			log.Printf("Using dTag %s for room %s", dTag, meeting.RoomID)
-
-			// Update room status
-			statusChanged := db.updateRoomStatus(meeting.RoomID, "open")
-
-			// Publish event if status changed
-			if statusChanged {
-				log.Printf("Room %s status changed to open, publishing event", meeting.RoomID)
-				if err := publishEvent(ctx, privateKey, meeting.RoomID, dTag, "open", ownerPubkey, relayURLs, baseURL); err != nil {
-					log.Printf("Error publishing open event for room %s: %v", meeting.RoomID, err)
-				}
-			} else {
-				log.Printf("Room %s already open, no event published", meeting.RoomID)
-			}
-		}
+	// Shutdown behaviour: a restart shouldn't close rooms, so closing
+	// them on exit is opt-in
+	closeOnShutdown := engine.EnvBool("CLOSE_ROOMS_ON_SHUTDOWN", false)
+	shutdownTimeout := engine.EnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second)
 
-		log.Printf("Rooms with presenter pubkey (%d): %v", len(roomsWithPubkey), roomsWithPubkey)
-		log.Printf("Rooms without presenter pubkey (%d): %v", len(roomsWithoutPubkey), roomsWithoutPubkey)
+	// Poll every server concurrently
+	var wg sync.WaitGroup
+	for _, s := range pollServers {
+		wg.Add(1)
+		go func(s *pollServer) {
+			defer wg.Done()
+			s.loop.Run(ctx)
+		}(s)
+	}
+	wg.Wait()
 
-		// Check for closed rooms
-		closedRooms := db.checkClosedRooms(activeRoomIDs)
-		log.Printf("Found %d closed rooms", len(closedRooms))
-		for _, roomID := range closedRooms {
-			dTag := db.getDTag(roomID)
-			log.Printf("Room %s closed, publishing closed event with dTag %s", roomID, dTag)
-			if err := publishEvent(ctx, privateKey, roomID, dTag, "closed", "", relayURLs, baseURL); err != nil {
-				log.Printf("Error publishing closed event for room %s: %v", roomID, err)
-			}
-		}
+	log.Printf("Shutting down (closing open rooms: %v, timeout %v)", closeOnShutdown, shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
 
-		log.Printf("Sleeping for %v before next poll", interval)
-		// Wait for the next polling interval
-		time.Sleep(interval)
+	if callbackListener != nil {
+		if err := callbackListener.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping callback listener: %v", err)
+		}
+	}
+	for _, s := range pollServers {
+		wg.Add(1)
+		go func(s *pollServer) {
+			defer wg.Done()
+			s.announcer.shutdown(shutdownCtx, closeOnShutdown)
+		}(s)
 	}
+	wg.Wait()
+	log.Println("Shutdown complete")
 }
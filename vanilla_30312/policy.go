@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Policy actions
+const (
+	policyAllow   = "allow"   // announce the room
+	policyDeny    = "deny"    // never announce the room
+	policyPrivate = "private" // announce the room as invite-only, without identifying anyone in it
+)
+
+// PolicyFile decides which rooms are announced. Rules are tried in order
+// and the first one matching both the presenter and the room ID wins;
+// rooms no rule matches get Default.
+type PolicyFile struct {
+	Default string       `json:"default"` // allow (the default) or deny, to require opt-in
+	Rules   []PolicyRule `json:"rules"`
+}
+
+type PolicyRule struct {
+	Name      string     `json:"name,omitempty"`      // shown in decision logs
+	Presenter string     `json:"presenter,omitempty"` // hex pubkey or npub; empty matches anyone
+	Room      string     `json:"room,omitempty"`      // room ID glob, e.g. "test-*"; empty matches any room
+	Action    string     `json:"action"`              // allow, deny or private
+	Tags      [][]string `json:"tags,omitempty"`      // replace template tags of the same name
+}
+
+// The outcome of evaluating the policy for a room
+type policyDecision struct {
+	Action string
+	Rule   string     // rule that matched, or "default"
+	Tags   nostr.Tags // tag overrides
+}
+
+// policyEngine holds the current policy file, which can be reloaded while
+// the poller runs. A nil engine allows everything.
+type policyEngine struct {
+	path string
+
+	mu     sync.RWMutex
+	policy *PolicyFile
+}
+
+func newPolicyEngine(path string) (*policyEngine, error) {
+	e := &policyEngine{path: path}
+	if err := e.reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Re-read the policy file. On error the previous policy stays in effect.
+func (e *policyEngine) reload() error {
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return err
+	}
+	var policy PolicyFile
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("error parsing %s: %v", e.path, err)
+	}
+	if err := policy.normalize(); err != nil {
+		return fmt.Errorf("invalid policy %s: %v", e.path, err)
+	}
+
+	e.mu.Lock()
+	e.policy = &policy
+	e.mu.Unlock()
+	log.Printf("Loaded room policy from %s: default %s, %d rules", e.path, policy.Default, len(policy.Rules))
+	return nil
+}
+
+// Validate the policy, converting npubs to hex pubkeys
+func (p *PolicyFile) normalize() error {
+	switch p.Default {
+	case "":
+		p.Default = policyAllow
+	case policyAllow, policyDeny:
+	default:
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		switch rule.Action {
+		case policyAllow, policyDeny, policyPrivate:
+		default:
+			return fmt.Errorf("%s: action must be allow, deny or private, not %q", rule.Name, rule.Action)
+		}
+		if strings.HasPrefix(rule.Presenter, "npub") {
+			prefix, value, err := nip19.Decode(rule.Presenter)
+			if err != nil || prefix != "npub" {
+				return fmt.Errorf("%s: invalid npub %q", rule.Name, rule.Presenter)
+			}
+			rule.Presenter = value.(string)
+		} else if rule.Presenter != "" && !nostr.IsValidPublicKeyHex(rule.Presenter) {
+			return fmt.Errorf("%s: invalid presenter pubkey %q", rule.Name, rule.Presenter)
+		}
+		if _, err := path.Match(rule.Room, ""); err != nil {
+			return fmt.Errorf("%s: invalid room pattern %q", rule.Name, rule.Room)
+		}
+		for _, tag := range rule.Tags {
+			if len(tag) < 2 {
+				return fmt.Errorf("%s: tags need a name and a value", rule.Name)
+			}
+			if engine.ReservedTag(tag[0]) {
+				return fmt.Errorf("%s: the %s tag can't be overridden", rule.Name, tag[0])
+			}
+		}
+	}
+	return nil
+}
+
+// Find the decision for a room without logging it
+func (e *policyEngine) lookup(roomID, presenter string) policyDecision {
+	if e == nil {
+		return policyDecision{Action: policyAllow, Rule: "default"}
+	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.policy.Rules {
+		if rule.Presenter != "" && rule.Presenter != presenter {
+			continue
+		}
+		if matched, _ := path.Match(rule.Room, roomID); rule.Room != "" && !matched {
+			continue
+		}
+		decision := policyDecision{Action: rule.Action, Rule: rule.Name}
+		for _, tag := range rule.Tags {
+			decision.Tags = append(decision.Tags, nostr.Tag(tag))
+		}
+		return decision
+	}
+	return policyDecision{Action: e.policy.Default, Rule: "default"}
+}
+
+// Decide whether and how a room is announced, logging the decision for audit
+func (e *policyEngine) decide(roomID, presenter string) policyDecision {
+	decision := e.lookup(roomID, presenter)
+	if e != nil {
+		log.Printf("Policy: room %s presenter %s -> %s (%s)", roomID, presenter, decision.Action, decision.Rule)
+	}
+	return decision
+}
+
+// Replace rendered tags with policy tags of the same name
+func overrideTags(tags, overrides nostr.Tags) nostr.Tags {
+	if len(overrides) == 0 {
+		return tags
+	}
+	replaced := make(map[string]bool)
+	for _, tag := range overrides {
+		replaced[tag[0]] = true
+	}
+
+	result := nostr.Tags{}
+	for _, tag := range tags {
+		if !replaced[tag[0]] {
+			result = append(result, tag)
+		}
+	}
+	return append(result, overrides...)
+}
+
+// Reload the policy file on SIGHUP until ctx is cancelled
+func (e *policyEngine) reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if err := e.reload(); err != nil {
+				log.Printf("Error reloading room policy, keeping the previous one: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
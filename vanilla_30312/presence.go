@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP-53 room presence kind
+const kindRoomPresence = 10312
+
+// A peer's presence as last published in a room
+type presence struct {
+	eventID   string
+	published time.Time
+}
+
+// presencePublisher announces NIP-53 kind 10312 room presence for the
+// identified peers in each open room. Kind 10312 is replaceable per
+// author, so one bot key can't hold presence for several peers; instead
+// each peer gets a delegated presence key derived from PRESENCE_SECRET and
+// their pubkey, and the event p-tags the peer it stands for. Presence
+// carries a NIP-40 expiration and is refreshed before it lapses; a peer
+// that leaves has their presence deleted.
+type presencePublisher struct {
+	secret     []byte
+	ttl        time.Duration
+	roomPubkey string // author of the 30312 events presence points at
+	relayURLs  []string
+	publisher  engine.Publisher
+
+	mu    sync.Mutex
+	rooms map[string]*presenceRoom
+}
+
+type presenceRoom struct {
+	dTag  string
+	peers map[string]presence // peer pubkey -> presence
+}
+
+// Set up presence publishing from PRESENCE_SECRET and PRESENCE_TTL.
+// Returns nil when PRESENCE_SECRET is unset.
+func newPresencePublisherFromEnv(roomPubkey string, relayURLs []string) (*presencePublisher, error) {
+	secret := os.Getenv("PRESENCE_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	ttl := 5 * time.Minute
+	if value := os.Getenv("PRESENCE_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("invalid PRESENCE_TTL %q: must be a duration of at least 1m", value)
+		}
+		ttl = d
+	}
+	return &presencePublisher{
+		secret:     []byte(secret),
+		ttl:        ttl,
+		roomPubkey: roomPubkey,
+		relayURLs:  relayURLs,
+		publisher:  engine.RelayPublisher{URLs: relayURLs},
+		rooms:      make(map[string]*presenceRoom),
+	}, nil
+}
+
+// Bring presence in line with a sync's live and closed rooms. Callers
+// release Announcer.mu first: presence is an event per peer, and slow
+// relays mustn't hold up callbacks, polls of other rooms or heartbeats.
+func (a *Announcer) updatePresence(ctx context.Context, live []roomEvent, closed []string) {
+	if a.presence == nil {
+		return
+	}
+	for _, room := range live {
+		a.presence.update(ctx, room.roomID, room.dTag, room.participants)
+	}
+	for _, roomID := range closed {
+		a.presence.closeRoom(ctx, roomID)
+	}
+}
+
+// Derive the private key that publishes presence on behalf of a peer
+func (p *presencePublisher) presenceKey(peerPubkey string) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte("presence:" + peerPubkey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Bring a room's presence in line with its identified participants:
+// publish presence for peers that joined, refresh presence that is about
+// to lapse, and delete presence for peers that left
+func (p *presencePublisher) update(ctx context.Context, roomID, dTag string, participants []Participant) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	room, exists := p.rooms[roomID]
+	if !exists || room.dTag != dTag {
+		if exists {
+			p.leaveAll(ctx, room)
+		}
+		room = &presenceRoom{dTag: dTag, peers: make(map[string]presence)}
+		p.rooms[roomID] = room
+	}
+
+	here := make(map[string]bool, len(participants))
+	for _, participant := range participants {
+		here[participant.Pubkey] = true
+		if last, present := room.peers[participant.Pubkey]; present && time.Since(last.published) < p.ttl/2 {
+			continue
+		}
+		p.publish(ctx, room, participant.Pubkey)
+	}
+
+	for peer := range room.peers {
+		if !here[peer] {
+			p.leave(ctx, room, peer)
+		}
+	}
+}
+
+// Delete presence for everyone in a room that closed
+func (p *presencePublisher) closeRoom(ctx context.Context, roomID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if room, exists := p.rooms[roomID]; exists {
+		p.leaveAll(ctx, room)
+		delete(p.rooms, roomID)
+	}
+}
+
+// Refresh presence that is about to lapse, for rooms whose polls or
+// callbacks are further apart than the presence TTL
+func (p *presencePublisher) run(ctx context.Context) {
+	ticker := time.NewTicker(p.ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			for _, room := range p.rooms {
+				for peer, last := range room.peers {
+					if time.Since(last.published) >= p.ttl/2 {
+						p.publish(ctx, room, peer)
+					}
+				}
+			}
+			p.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Number of peers with live presence in a room
+func (p *presencePublisher) count(roomID string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if room, exists := p.rooms[roomID]; exists {
+		return len(room.peers)
+	}
+	return 0
+}
+
+func (p *presencePublisher) publish(ctx context.Context, room *presenceRoom, peer string) {
+	now := time.Now()
+	ev := nostr.Event{
+		CreatedAt: nostr.Timestamp(now.Unix()),
+		Kind:      kindRoomPresence,
+		Tags: nostr.Tags{
+			nostr.Tag{"a", fmt.Sprintf("30312:%s:%s", p.roomPubkey, room.dTag), p.relayURLs[0]},
+			nostr.Tag{"p", peer},
+			nostr.Tag{"expiration", strconv.FormatInt(now.Add(p.ttl).Unix(), 10)},
+		},
+		Content: "",
+	}
+	if err := ev.Sign(p.presenceKey(peer)); err != nil {
+		log.Printf("Error signing presence for %s: %v", peer, err)
+		return
+	}
+	if err := p.publisher.Publish(ctx, ev); err != nil {
+		log.Printf("Error publishing presence for %s: %v", peer, err)
+		return
+	}
+	room.peers[peer] = presence{eventID: ev.ID, published: now}
+}
+
+// Delete a peer's presence with a NIP-09 deletion from their presence key
+func (p *presencePublisher) leave(ctx context.Context, room *presenceRoom, peer string) {
+	last := room.peers[peer]
+	delete(room.peers, peer)
+
+	ev := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindDeletion,
+		Tags: nostr.Tags{
+			nostr.Tag{"e", last.eventID},
+			nostr.Tag{"k", strconv.Itoa(kindRoomPresence)},
+		},
+		Content: "left the room",
+	}
+	if err := ev.Sign(p.presenceKey(peer)); err != nil {
+		log.Printf("Error signing presence deletion for %s: %v", peer, err)
+		return
+	}
+	if err := p.publisher.Publish(ctx, ev); err != nil {
+		log.Printf("Error deleting presence for %s: %v", peer, err)
+	}
+}
+
+func (p *presencePublisher) leaveAll(ctx context.Context, room *presenceRoom) {
+	for peer := range room.peers {
+		p.leave(ctx, room, peer)
+	}
+}
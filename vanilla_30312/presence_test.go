@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Records presence events, and whether Announcer.mu was free when each
+// was published
+type presenceRecorder struct {
+	announcer *Announcer
+
+	mu      sync.Mutex
+	events  []nostr.Event
+	underMu int
+}
+
+func (r *presenceRecorder) Publish(ctx context.Context, ev nostr.Event) error {
+	locked := !r.announcer.mu.TryLock()
+	if !locked {
+		r.announcer.mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+	if locked {
+		r.underMu++
+	}
+	return nil
+}
+
+func (r *presenceRecorder) take() []nostr.Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+// The current_participants tag of the latest room event on a relay
+func currentParticipants(t *testing.T, relay *relaytest.Relay) string {
+	t.Helper()
+	events := relay.Events()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Kind != 30312 {
+			continue
+		}
+		if tag := events[i].Tags.GetFirst([]string{"current_participants", ""}); tag != nil {
+			return (*tag)[1]
+		}
+		return ""
+	}
+	t.Fatal("no room event on the relay")
+	return ""
+}
+
+func TestPresence(t *testing.T) {
+	t.Setenv("DTAG_MODE", "random")
+	t.Setenv("PRESENCE_SECRET", "presence-secret")
+
+	const giraffe = "51e4b4648a549a62bd3e6670122b931cebc8723bc0ff7e8032fe087b00eb3dbd"
+	const zebra = "7e7e9c42a91bfef19fa929e5fda1b72e0ebc1a4c1141673e2794234d86addf4e"
+	dir := t.TempDir()
+	var polls []string
+	for i, meetings := range []string{
+		`{"meetings":[{"roomId":"Lobby","peers":[{"name":"giraffe","presenter":true,"pubkey":"` + giraffe + `"},{"name":"zebra","pubkey":"` + zebra + `"},{"name":"guest"}]}]}`,
+		`{"meetings":[{"roomId":"Lobby","peers":[{"name":"giraffe","presenter":true,"pubkey":"` + giraffe + `"}]}]}`,
+		`{"meetings":[]}`,
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("poll-%03d.json", i+1))
+		if err := os.WriteFile(path, []byte(meetings), 0644); err != nil {
+			t.Fatal(err)
+		}
+		polls = append(polls, path)
+	}
+	api := newReplayAPI(t, polls)
+	relay := relaytest.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := newPollServer(ctx, ServerConfig{
+		BaseURL:     api.server.URL,
+		APIKey:      "replay-api-key",
+		NostrPvtKey: replayPrivateKey,
+		RelayURLs:   []string{relay.URL()},
+		StatePath:   filepath.Join(dir, "rooms.json"),
+	}, pollOptions{storeKind: "json", closePolicy: engine.ClosePolicy{GracePolls: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.store.Close()
+	presence := s.announcer.presence
+	recorder := &presenceRecorder{announcer: s.announcer}
+	presence.publisher = recorder
+
+	// Both identified peers get presence, from their own presence keys,
+	// pointing at the room's 30312, which counts every peer
+	if err := s.loop.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := currentParticipants(t, relay); n != "3" {
+		t.Errorf("current_participants = %s, want 3", n)
+	}
+	dTag := s.announcer.db.Rooms["Lobby"].DTag
+	joined := recorder.take()
+	if len(joined) != 2 || presence.count("Lobby") != 2 {
+		t.Fatalf("published %d presence events, count %d, want 2 and 2", len(joined), presence.count("Lobby"))
+	}
+	byPeer := map[string]nostr.Event{}
+	for _, ev := range joined {
+		peer := ev.Tags.GetFirst([]string{"p", ""})
+		a := ev.Tags.GetFirst([]string{"a", ""})
+		if ev.Kind != kindRoomPresence || peer == nil || a == nil || (*a)[1] != "30312:"+s.announcer.signer.PublicKey()+":"+dTag {
+			t.Fatalf("presence event %v", ev)
+		}
+		if key, _ := nostr.GetPublicKey(presence.presenceKey((*peer)[1])); ev.PubKey != key {
+			t.Errorf("presence for %s signed by %s, want its presence key", (*peer)[1], ev.PubKey)
+		}
+		byPeer[(*peer)[1]] = ev
+	}
+
+	// zebra left, so their presence is deleted
+	if err := s.loop.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	left := recorder.take()
+	if len(left) != 1 || left[0].Kind != nostr.KindDeletion || left[0].Tags.GetFirst([]string{"e", byPeer[zebra].ID}) == nil {
+		t.Fatalf("after zebra left: %v", left)
+	}
+	if n := presence.count("Lobby"); n != 1 {
+		t.Errorf("count after zebra left = %d, want 1", n)
+	}
+	if n := currentParticipants(t, relay); n != "1" {
+		t.Errorf("current_participants after zebra left = %s, want 1", n)
+	}
+
+	// The room closed, taking giraffe's presence with it
+	if err := s.loop.Poll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	closed := recorder.take()
+	if len(closed) != 1 || closed[0].Tags.GetFirst([]string{"e", byPeer[giraffe].ID}) == nil {
+		t.Fatalf("after the room closed: %v", closed)
+	}
+	if n := presence.count("Lobby"); n != 0 {
+		t.Errorf("count after the room closed = %d, want 0", n)
+	}
+
+	if recorder.underMu > 0 {
+		t.Errorf("%d presence events published while holding Announcer.mu", recorder.underMu)
+	}
+}
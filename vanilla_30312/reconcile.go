@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// Rebuild room state the database has lost from what the bot already
+// announced on relays. Local state wins: only d tags the database doesn't
+// know are considered. A lost room is adopted with its relay-side d tag
+// and status; one relays show open that isn't in meetings, or that is
+// already tracked under another d tag, is announced closed.
+func (a *Announcer) reconcileWithRelays(ctx context.Context, meetings []Meeting) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	announced, err := engine.FetchAnnouncedRooms(ctx, a.signer.PublicKey(), a.baseURL, a.relayURLs, a.template.legacyRoomTag())
+	if err != nil {
+		log.Printf("Error fetching announced rooms from relays, skipping reconciliation: %v", err)
+		return
+	}
+
+	knownDTags := make(map[string]bool)
+	for _, info := range a.db.Rooms {
+		knownDTags[info.DTag] = true
+	}
+	live := make(map[string]bool)
+	for _, meeting := range meetings {
+		live[meeting.RoomID] = true
+	}
+
+	adopted := 0
+	stale := []engine.AnnouncedRoom{}
+	for _, room := range announced {
+		if knownDTags[room.DTag] {
+			continue
+		}
+		if _, tracked := a.db.Rooms[room.RoomID]; tracked {
+			if engine.Live(room.Status) {
+				stale = append(stale, room)
+			}
+			continue
+		}
+
+		info := RoomInfo{
+			DTag: room.DTag,
+			RoomState: engine.RoomState{
+				Status:   room.Status,
+				LastSeen: room.CreatedAt.Time(),
+			},
+		}
+		if engine.Live(room.Status) {
+			if live[room.RoomID] {
+				info.PresentSince = a.db.Tracker.Now()
+			} else {
+				info.Status = "closed"
+				stale = append(stale, room)
+			}
+		}
+		a.db.Rooms[room.RoomID] = info
+		a.db.dirty = true
+		adopted++
+		log.Printf("Recovered dTag %s for room %s (%s on relays)", room.DTag, room.RoomID, room.Status)
+	}
+	log.Printf("Reconciled with relays: %d announced rooms, %d recovered, %d to close", len(announced), adopted, len(stale))
+
+	if err := a.db.commit(); err != nil {
+		log.Printf("Error saving room database: %v", err)
+	}
+
+	for _, room := range stale {
+		log.Printf("Room %s is still open on relays under dTag %s, publishing closed event", room.RoomID, room.DTag)
+		closed := roomEvent{roomID: room.RoomID, dTag: room.DTag, status: "closed", overrides: a.overrides(room.RoomID)}
+		if err := publishEvent(ctx, a.signer, a.publisher, a.template, closed, a.relayURLs, a.baseURL); err != nil {
+			log.Printf("Error publishing closed event for room %s: %v", room.RoomID, err)
+		}
+	}
+}
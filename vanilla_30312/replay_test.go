@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected.json of each replay scenario")
+
+// Key the replayed events are signed with
+const replayPrivateKey = "5b5ec5f3c7a1e7f0b3a06dd93f0d51e0b2bd6ab7a0d2c6d9f9a1e1bd2b0c7e41"
+
+// Stand-ins for the test servers' addresses, which change every run
+const (
+	replayBaseURL  = "https://hivetalk.test"
+	replayRelayURL = "wss://relay.test"
+)
+
+// What a replay scenario is expected to produce
+type replayExpected struct {
+	// Tags of every 30312 event published, in order, with d tags
+	// renumbered by first appearance
+	Events []nostr.Tags `json:"events"`
+}
+
+// TestReplay replays each scenario under testdata/replay through the poll
+// loop. A scenario is a directory of meetings responses, poll-001.json,
+// poll-002.json and so on (as written with RECORD_DIR), an optional
+// policy.json, and the expected.json they must produce. Run with -update
+// to rewrite expected.json after an intended change.
+func TestReplay(t *testing.T) {
+	dirs, err := filepath.Glob("testdata/replay/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			replayScenario(t, dir)
+		})
+	}
+}
+
+func replayScenario(t *testing.T, dir string) {
+	polls, err := filepath.Glob(filepath.Join(dir, "poll-*.json"))
+	if err != nil || len(polls) == 0 {
+		t.Fatalf("no recorded polls in %s", dir)
+	}
+
+	api := newReplayAPI(t, polls)
+	relay := relaytest.New(t)
+
+	t.Setenv("DTAG_MODE", "hmac")
+	t.Setenv("DTAG_SECRET", "replay")
+	t.Setenv("PRESENCE_SECRET", "")
+	t.Setenv("ZAP_TAGS", "true")
+	t.Setenv("ZAP_VERIFY_LNURL", "false")
+
+	opts := pollOptions{
+		storeKind:   "json",
+		closePolicy: engine.ClosePolicy{GracePolls: 2},
+		reconcile:   true,
+	}
+	if opts.zaps, err = newZapTaggerFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if policyPath := filepath.Join(dir, "policy.json"); fileExists(policyPath) {
+		if opts.policy, err = newPolicyEngine(policyPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := ServerConfig{
+		BaseURL:     api.server.URL,
+		APIKey:      "replay-api-key",
+		NostrPvtKey: replayPrivateKey,
+		RelayURLs:   []string{relay.URL()},
+		StatePath:   filepath.Join(t.TempDir(), "rooms.json"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := newPollServer(ctx, cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.store.Close()
+
+	for range polls {
+		if err := s.loop.Poll(ctx); err != nil {
+			t.Fatalf("poll %d: %v", api.served(), err)
+		}
+	}
+
+	got := replayExpected{Events: []nostr.Tags{}}
+	dTags := make(map[string]string)
+	for _, ev := range relay.Events() {
+		if ev.Kind != 30312 || ev.PubKey != s.announcer.signer.PublicKey() {
+			t.Fatalf("unexpected kind %d event from %s", ev.Kind, ev.PubKey)
+		}
+		got.Events = append(got.Events, normalizeReplayTags(ev.Tags, dTags, map[string]string{
+			api.server.URL: replayBaseURL,
+			relay.URL():    replayRelayURL,
+		}))
+	}
+
+	expectedPath := filepath.Join(dir, "expected.json")
+	if *update {
+		data, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(expectedPath, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, err := os.ReadFile(expectedPath)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	var want replayExpected
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Events) != len(want.Events) {
+		t.Errorf("published %d events, want %d", len(got.Events), len(want.Events))
+	}
+	for i := 0; i < len(got.Events) && i < len(want.Events); i++ {
+		if !reflect.DeepEqual(got.Events[i], want.Events[i]) {
+			t.Errorf("event %d:\n got %v\nwant %v", i+1, got.Events[i], want.Events[i])
+		}
+	}
+}
+
+// Rewrite the parts of an event's tags that change between runs: server
+// addresses, the expiration, and d tags, numbered in order of appearance
+func normalizeReplayTags(tags nostr.Tags, dTags map[string]string, urls map[string]string) nostr.Tags {
+	normalized := nostr.Tags{}
+	for _, tag := range tags {
+		tag = append(nostr.Tag(nil), tag...)
+		for i := 1; i < len(tag); i++ {
+			for from, to := range urls {
+				tag[i] = strings.ReplaceAll(tag[i], from, to)
+			}
+		}
+		switch {
+		case len(tag) > 1 && tag[0] == "d":
+			if _, seen := dTags[tag[1]]; !seen {
+				dTags[tag[1]] = fmt.Sprintf("d%d", len(dTags)+1)
+			}
+			tag[1] = dTags[tag[1]]
+		case len(tag) > 1 && tag[0] == "expiration":
+			tag[1] = "<expiration>"
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
+// replayAPI serves recorded meetings responses, one per request, and
+// keeps serving the last one once they run out
+type replayAPI struct {
+	server *httptest.Server
+	polls  [][]byte
+
+	mu sync.Mutex
+	n  int
+}
+
+func newReplayAPI(t *testing.T, paths []string) *replayAPI {
+	api := &replayAPI{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		api.polls = append(api.polls, data)
+	}
+	api.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/meetings" || r.Header.Get("authorization") != "replay-api-key" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		api.mu.Lock()
+		body := api.polls[len(api.polls)-1]
+		if api.n < len(api.polls) {
+			body = api.polls[api.n]
+		}
+		api.n++
+		api.mu.Unlock()
+		w.Header().Set("content-type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(api.server.Close)
+	return api
+}
+
+// Number of responses served so far
+func (api *replayAPI) served() int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.n
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -12,11 +12,11 @@ else
 fi
 
 # Check if environment variables are set
-if [ -z "$RELAY_URLS" ] || [ -z "$NOSTR_PVT_KEY" ] || [ -z "$HIVETALK_API_KEY" ] || [ -z "$BASE_URL" ]; then
+if [ -z "$RELAY_URLS" ] || { [ -z "$NOSTR_PVT_KEY" ] && [ -z "$NOSTR_BUNKER_URI" ]; } || [ -z "$HIVETALK_API_KEY" ] || [ -z "$BASE_URL" ]; then
     echo "Error: Required environment variables must be set"
     echo "Make sure the following variables are set in your .env file or environment:"
     echo "- RELAY_URLS: Comma-separated list of Nostr relay URLs"
-    echo "- NOSTR_PVT_KEY: Private key for Nostr bot"
+    echo "- NOSTR_PVT_KEY: Private key for Nostr bot (or NOSTR_BUNKER_URI for a NIP-46 bunker)"
     echo "- HIVETALK_API_KEY: API key for HiveTalk"
     echo "- BASE_URL: Base URL for HiveTalk API"
     echo ""
@@ -47,4 +47,4 @@ echo "Logs will be written to ${LOG_FILE}"
 
 # Download dependencies and run the Go program
 go mod tidy
-go run hivetalk_poller.go 2>&1 | tee "${LOG_FILE}"
+go run . 2>&1 | tee "${LOG_FILE}"
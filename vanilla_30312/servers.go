@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+)
+
+// ServerConfig is one HiveTalk SFU announced by this process. Secrets may
+// reference environment variables as $VAR or ${VAR}.
+type ServerConfig struct {
+	Name            string   `json:"name"` // namespaces room state and callback paths
+	BaseURL         string   `json:"base_url"`
+	APIKey          string   `json:"api_key"`
+	NostrPvtKey     string   `json:"nostr_pvt_key,omitempty"`
+	BunkerURI       string   `json:"bunker_uri,omitempty"`
+	BunkerClientKey string   `json:"bunker_client_key,omitempty"`
+	RelayURLs       []string `json:"relay_urls"`
+	EventTemplate   string   `json:"event_template,omitempty"`
+	StatePath       string   `json:"state_path,omitempty"`      // defaults to rooms-<name>.json, or .db for bolt
+	CallbackSecret  string   `json:"callback_secret,omitempty"` // defaults to CALLBACK_SECRET
+}
+
+// Server names end up in file names and URL paths
+var serverNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// The single server configured by BASE_URL, HIVETALK_API_KEY and friends
+func serverConfigFromEnv() (ServerConfig, error) {
+	_, statePath := engine.StatePathFromEnv("rooms")
+	cfg := ServerConfig{
+		BaseURL:         os.Getenv("BASE_URL"),
+		APIKey:          os.Getenv("HIVETALK_API_KEY"),
+		NostrPvtKey:     os.Getenv("NOSTR_PVT_KEY"),
+		BunkerURI:       os.Getenv("NOSTR_BUNKER_URI"),
+		BunkerClientKey: os.Getenv("NOSTR_BUNKER_CLIENT_KEY"),
+		RelayURLs:       engine.ParseRelayURLs(os.Getenv("RELAY_URLS")),
+		EventTemplate:   os.Getenv("EVENT_TEMPLATE"),
+		StatePath:       statePath,
+		CallbackSecret:  os.Getenv("CALLBACK_SECRET"),
+	}
+	if cfg.BaseURL == "" || cfg.APIKey == "" || (cfg.NostrPvtKey == "" && cfg.BunkerURI == "") || len(cfg.RelayURLs) == 0 {
+		return cfg, fmt.Errorf("missing required environment variables, please check your .env file")
+	}
+	return cfg, nil
+}
+
+// Load the servers listed in a SERVERS_FILE
+func loadServerConfigs(path string) ([]ServerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var servers []ServerConfig
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s lists no servers", path)
+	}
+
+	storeKind, _ := engine.StatePathFromEnv("rooms")
+	names := make(map[string]bool)
+	baseURLs := make(map[string]bool)
+	statePaths := make(map[string]bool)
+	for i := range servers {
+		cfg := &servers[i]
+		if !serverNamePattern.MatchString(cfg.Name) {
+			return nil, fmt.Errorf("servers[%d]: name %q must be letters, digits, - or _", i, cfg.Name)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate server name %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		cfg.APIKey = os.ExpandEnv(cfg.APIKey)
+		cfg.NostrPvtKey = os.ExpandEnv(cfg.NostrPvtKey)
+		cfg.BunkerURI = os.ExpandEnv(cfg.BunkerURI)
+		cfg.BunkerClientKey = os.ExpandEnv(cfg.BunkerClientKey)
+		cfg.CallbackSecret = os.ExpandEnv(cfg.CallbackSecret)
+		if cfg.CallbackSecret == "" {
+			cfg.CallbackSecret = os.Getenv("CALLBACK_SECRET")
+		}
+		if cfg.BaseURL == "" || cfg.APIKey == "" || len(cfg.RelayURLs) == 0 {
+			return nil, fmt.Errorf("server %s: base_url, api_key and relay_urls are required", cfg.Name)
+		}
+		if cfg.NostrPvtKey == "" && cfg.BunkerURI == "" {
+			return nil, fmt.Errorf("server %s: one of nostr_pvt_key or bunker_uri is required", cfg.Name)
+		}
+
+		// Events name the server they announce a room on, so servers
+		// sharing a key and relays only reconcile their own rooms
+		baseURL := strings.TrimRight(cfg.BaseURL, "/")
+		if baseURLs[baseURL] {
+			return nil, fmt.Errorf("server %s: base_url %s is used by another server", cfg.Name, cfg.BaseURL)
+		}
+		baseURLs[baseURL] = true
+
+		// Keep each server's rooms apart, so the same room ID on two
+		// SFUs never shares a d tag
+		if cfg.StatePath == "" {
+			cfg.StatePath = "rooms-" + cfg.Name + ".json"
+			if storeKind == "bolt" {
+				cfg.StatePath = "rooms-" + cfg.Name + ".db"
+			}
+		}
+		if statePaths[cfg.StatePath] {
+			return nil, fmt.Errorf("server %s: state path %s is used by another server", cfg.Name, cfg.StatePath)
+		}
+		statePaths[cfg.StatePath] = true
+	}
+	return servers, nil
+}
+
+// The servers to poll: those in SERVERS_FILE if set, otherwise the one
+// configured by the environment
+func serverConfigsFromEnv() ([]ServerConfig, error) {
+	if path := os.Getenv("SERVERS_FILE"); path != "" {
+		return loadServerConfigs(path)
+	}
+	cfg, err := serverConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return []ServerConfig{cfg}, nil
+}
+
+// Find a server by name for a subcommand. Without SERVERS_FILE the name
+// must be empty and the environment's server is used.
+func serverConfigByName(name string) (ServerConfig, error) {
+	servers, err := serverConfigsFromEnv()
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	if name == "" {
+		if len(servers) > 1 {
+			return ServerConfig{}, fmt.Errorf("SERVERS_FILE lists %d servers, choose one with -server", len(servers))
+		}
+		return servers[0], nil
+	}
+	for _, cfg := range servers {
+		if cfg.Name == name {
+			return cfg, nil
+		}
+	}
+	return ServerConfig{}, fmt.Errorf("no server named %q", name)
+}
+
+// Settings shared by every polled server
+type pollOptions struct {
+	storeKind   string
+	closePolicy engine.ClosePolicy
+	throttle    engine.CountThrottle // participant count republishes
+	clock       engine.Clock         // SystemClock when nil
+	heartbeat   time.Duration
+	interval    time.Duration
+	maxBackoff  time.Duration // longest wait after repeated fetch errors
+	reconcile   bool
+	policy      *policyEngine
+	zaps        *zapTagger
+	callbacks   bool // push callbacks are enabled
+}
+
+// pollServer polls one HiveTalk server and announces its rooms
+type pollServer struct {
+	cfg       ServerConfig
+	store     engine.RoomStore[RoomInfo]
+	announcer *Announcer
+	callbacks *callbackServer // nil unless callbacks are enabled
+	loop      *engine.Loop[[]Meeting]
+
+	// Reconcile room state with relays on the next successful poll
+	reconcile bool
+}
+
+// meetingsSource lists the live meetings on a HiveTalk server
+type meetingsSource struct {
+	cfg      ServerConfig
+	recorder *engine.ResponseRecorder // nil unless RECORD_DIR is set
+}
+
+func (m meetingsSource) Name() string {
+	return m.cfg.BaseURL
+}
+
+func (m meetingsSource) Fetch(ctx context.Context) ([]Meeting, error) {
+	response, err := fetchMeetings(ctx, m.cfg.BaseURL, m.cfg.APIKey, m.recorder)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Found %d active meetings on %s", len(response.Meetings), m.cfg.BaseURL)
+	return response.Meetings, nil
+}
+
+// Set up the room state, signer, template and announcer for a server. Its
+// background publishers only start once all of that has succeeded.
+func newPollServer(ctx context.Context, cfg ServerConfig, opts pollOptions) (*pollServer, error) {
+	if opts.callbacks && cfg.CallbackSecret == "" {
+		return nil, fmt.Errorf("CALLBACK_SECRET is required when CALLBACK_LISTEN_ADDR is set")
+	}
+
+	store, err := engine.OpenRoomStore[RoomInfo](opts.storeKind, cfg.StatePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening room state store: %v", err)
+	}
+	log.Printf("Using %s state store at %s for %s", opts.storeKind, cfg.StatePath, cfg.BaseURL)
+
+	db, err := loadRoomDatabase(store)
+	if err != nil {
+		// Relays still hold the d tags we announced, so with reconciling
+		// on, start empty and rebuild from them. The old state is kept
+		// aside either way.
+		if !opts.reconcile {
+			store.Close()
+			return nil, fmt.Errorf("error loading room database (set RECONCILE_FROM_RELAYS=true to rebuild it from relays): %v", err)
+		}
+		var aside string
+		if store, aside, err = engine.SetAsideRoomStore(store, opts.storeKind, cfg.StatePath); err != nil {
+			return nil, fmt.Errorf("error setting aside room database that failed to load: %v", err)
+		}
+		log.Printf("Room database for %s failed to load, moved to %s; rebuilding from relays", cfg.BaseURL, aside)
+		db = &RoomDatabase{Rooms: make(map[string]RoomInfo), store: store, dirty: true}
+	}
+	db.Tracker = engine.Tracker{Policy: opts.closePolicy, Throttle: opts.throttle, Clock: opts.clock}
+	if db.deriver, err = engine.NewDTagDeriverFromEnv(cfg.BaseURL); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("error setting up d tags: %v", err)
+	}
+	log.Printf("Room database for %s loaded with %d rooms", cfg.BaseURL, len(db.Rooms))
+
+	// Sign with the NIP-46 bunker if configured, otherwise the local key
+	signer, err := engine.NewSigner(ctx, cfg.NostrPvtKey, cfg.BunkerURI, cfg.BunkerClientKey)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("error setting up event signer: %v", err)
+	}
+	log.Printf("Signing events for %s as %s", cfg.BaseURL, signer.PublicKey())
+
+	// Load and validate the 30312 event template
+	tmpl, err := loadEventTemplate(cfg.EventTemplate)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("error loading event template: %v", err)
+	}
+
+	// Publish NIP-53 room presence for identified peers if configured
+	presence, err := newPresencePublisherFromEnv(signer.PublicKey(), cfg.RelayURLs)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("error setting up room presence: %v", err)
+	}
+
+	s := &pollServer{
+		cfg:       cfg,
+		store:     store,
+		reconcile: opts.reconcile,
+		announcer: &Announcer{
+			db:        db,
+			signer:    signer,
+			publisher: engine.RelayPublisher{URLs: cfg.RelayURLs},
+			template:  tmpl,
+			relayURLs: cfg.RelayURLs,
+			baseURL:   cfg.BaseURL,
+			presence:  presence,
+			heartbeat: opts.heartbeat,
+			policy:    opts.policy,
+			zaps:      opts.zaps,
+		},
+	}
+	s.loop = &engine.Loop[[]Meeting]{
+		Source:     meetingsSource{cfg: cfg, recorder: engine.NewResponseRecorderFromEnv(cfg.Name)},
+		Apply:      s.apply,
+		Clock:      opts.clock,
+		Interval:   opts.interval,
+		MaxBackoff: opts.maxBackoff,
+	}
+	if presence != nil {
+		go presence.run(ctx)
+	}
+	if opts.heartbeat > 0 {
+		go engine.RunHeartbeat(ctx, s.announcer.heartbeat, s.announcer.republishOpen)
+	}
+	if opts.callbacks {
+		s.callbacks = newCallbackServer(ctx, []byte(cfg.CallbackSecret), s.announcer)
+	}
+	return s, nil
+}
+
+// Path the server's room callbacks are posted to
+func (s *pollServer) callbackPath() string {
+	if s.cfg.Name == "" {
+		return "/"
+	}
+	return "/" + s.cfg.Name
+}
+
+// Announce the changes in a full meetings snapshot. On the first snapshot
+// after start-up, room state is first reconciled with relays.
+func (s *pollServer) apply(ctx context.Context, meetings []Meeting) {
+	if s.reconcile {
+		s.announcer.reconcileWithRelays(ctx, meetings)
+		s.reconcile = false
+	}
+	if s.callbacks != nil {
+		s.callbacks.resetMeetings(meetings)
+	}
+	s.announcer.syncMeetings(ctx, meetings, true)
+}
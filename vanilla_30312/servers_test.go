@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/bitcarrot/hivetalk/scheduler/engine/relaytest"
+)
+
+// Two servers announcing with one key to the same relays must leave each
+// other's rooms alone, even when their room IDs collide
+func TestServersSharingAKey(t *testing.T) {
+	t.Setenv("DTAG_MODE", "random")
+	t.Setenv("PRESENCE_SECRET", "")
+
+	relay := relaytest.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	poll := func(name, meetings string) *pollServer {
+		path := filepath.Join(t.TempDir(), "poll-001.json")
+		if err := os.WriteFile(path, []byte(meetings), 0644); err != nil {
+			t.Fatal(err)
+		}
+		api := newReplayAPI(t, []string{path})
+		s, err := newPollServer(ctx, ServerConfig{
+			Name:        name,
+			BaseURL:     api.server.URL,
+			APIKey:      "replay-api-key",
+			NostrPvtKey: replayPrivateKey,
+			RelayURLs:   []string{relay.URL()},
+			StatePath:   filepath.Join(t.TempDir(), "rooms.json"),
+		}, pollOptions{storeKind: "json", closePolicy: engine.ClosePolicy{GracePolls: 2}, reconcile: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.store.Close() })
+		if err := s.loop.Poll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	lobby := `{"meetings":[{"roomId":"Lobby","peers":[{"name":"giraffe","presenter":true,"pubkey":"51e4b4648a549a62bd3e6670122b931cebc8723bc0ff7e8032fe087b00eb3dbd"}]}]}`
+	a := poll("a", lobby)
+	aDTag := a.announcer.db.Rooms["Lobby"].DTag
+	if aDTag == "" {
+		t.Fatal("server a didn't announce its room")
+	}
+
+	// One server with a room of the same name, one with no rooms at all
+	b := poll("b", lobby)
+	if dTag := b.announcer.db.Rooms["Lobby"].DTag; dTag == aDTag {
+		t.Errorf("server b adopted server a's d tag %s", aDTag)
+	}
+	poll("c", `{"meetings":[]}`)
+
+	for _, ev := range relay.Events() {
+		if ev.Tags.GetFirst([]string{"d", aDTag}) != nil && ev.Tags.GetFirst([]string{"status", "open"}) == nil {
+			t.Errorf("server a's room was announced %v by another server", ev.Tags.GetFirst([]string{"status", ""}))
+		}
+	}
+}
+
+// A state file that fails to load is only replaced when relays can
+// rebuild it, and kept aside when it is
+func TestCorruptRoomDatabase(t *testing.T) {
+	t.Setenv("DTAG_MODE", "random")
+	relay := relaytest.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, reconcile := range []bool{false, true} {
+		statePath := filepath.Join(t.TempDir(), "rooms.json")
+		if err := os.WriteFile(statePath, []byte(`{"Lobby":`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := newPollServer(ctx, ServerConfig{
+			BaseURL:     "http://127.0.0.1:1",
+			NostrPvtKey: replayPrivateKey,
+			RelayURLs:   []string{relay.URL()},
+			StatePath:   statePath,
+		}, pollOptions{storeKind: "json", reconcile: reconcile})
+		aside, _ := filepath.Glob(statePath + ".corrupt-*")
+		if !reconcile {
+			if err == nil || len(aside) > 0 {
+				t.Errorf("without reconciling: err = %v, set aside %v", err, aside)
+			}
+			if data, _ := os.ReadFile(statePath); string(data) != `{"Lobby":` {
+				t.Errorf("state file changed to %q", data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.store.Close()
+		if len(aside) != 1 || len(s.announcer.db.Rooms) != 0 {
+			t.Errorf("with reconciling: set aside %v, %d rooms", aside, len(s.announcer.db.Rooms))
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// EventTemplate controls the descriptive tags of published 30312 events.
+// Every string is a Go text/template rendered with TemplateData; tags
+// that render to an empty string are left out. The d, status, p,
+// relays and other engine.ReservedTag tags are always generated by the
+// poller, and extra tags can't use their names.
+type EventTemplate struct {
+	Room     string     `json:"room"`
+	Summary  string     `json:"summary"`
+	Image    string     `json:"image"`
+	Service  string     `json:"service"`
+	Hashtags []string   `json:"hashtags"`
+	Tags     [][]string `json:"tags,omitempty"` // extra tags, e.g. ["title", "{{.RoomID}}"]
+
+	compiled map[string]*template.Template
+}
+
+// TemplateData is what event templates can refer to
+type TemplateData struct {
+	RoomID      string
+	Name        string
+	Description string
+	PictureUrl  string
+	Status      string
+	BaseURL     string
+	Presenter   string // pubkey of the first host, if any
+}
+
+// Template matching the tags the poller has always published
+var defaultEventTemplate = EventTemplate{
+	Room:     "{{.RoomID}}",
+	Summary:  "HiveTalk Room",
+	Image:    "{{.BaseURL}}/logo.png",
+	Service:  "{{.BaseURL}}/join/{{.RoomID}}",
+	Hashtags: []string{"hivetalk-vanilla", "interactive room"},
+}
+
+// Whether the room tag renders as it did before templates, so events
+// announced before the room ID tag can be matched by it
+func (t *EventTemplate) legacyRoomTag() bool {
+	return t.Room == defaultEventTemplate.Room
+}
+
+var templateFuncs = template.FuncMap{
+	"pathEscape":  url.PathEscape,
+	"queryEscape": url.QueryEscape,
+	"lower":       strings.ToLower,
+	"upper":       strings.ToUpper,
+	"trim":        strings.TrimSpace,
+}
+
+// Load an event template from a JSON file, filling unset fields from the
+// default template. An empty path returns the default template.
+func loadEventTemplate(path string) (*EventTemplate, error) {
+	tmpl := defaultEventTemplate
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &tmpl); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", path, err)
+		}
+	}
+
+	if err := tmpl.compile(); err != nil {
+		return nil, err
+	}
+	if err := tmpl.validate(); err != nil {
+		return nil, err
+	}
+	return &tmpl, nil
+}
+
+func (t *EventTemplate) compile() error {
+	t.compiled = make(map[string]*template.Template)
+	add := func(name, text string) error {
+		parsed, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("error parsing %s template: %v", name, err)
+		}
+		t.compiled[name] = parsed
+		return nil
+	}
+
+	if err := add("room", t.Room); err != nil {
+		return err
+	}
+	if err := add("summary", t.Summary); err != nil {
+		return err
+	}
+	if err := add("image", t.Image); err != nil {
+		return err
+	}
+	if err := add("service", t.Service); err != nil {
+		return err
+	}
+	for i, hashtag := range t.Hashtags {
+		if err := add(fmt.Sprintf("hashtags[%d]", i), hashtag); err != nil {
+			return err
+		}
+	}
+	for i, tag := range t.Tags {
+		if len(tag) < 2 {
+			return fmt.Errorf("tags[%d] needs a name and a value", i)
+		}
+		if engine.ReservedTag(tag[0]) {
+			return fmt.Errorf("tags[%d]: the %s tag is generated by the poller", i, tag[0])
+		}
+		for j, value := range tag[1:] {
+			if err := add(fmt.Sprintf("tags[%d][%d]", i, j+1), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Render the template against sample rooms so mistakes surface at startup
+func (t *EventTemplate) validate() error {
+	for _, data := range sampleTemplateData("https://hivetalk.example") {
+		tags, err := t.render(data)
+		if err != nil {
+			return err
+		}
+		service := tags.GetFirst([]string{"service"})
+		if service == nil {
+			return fmt.Errorf("service template rendered empty for a %s room", data.Status)
+		}
+		if u, err := url.Parse((*service)[1]); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("service template rendered %q, which is not an absolute URL", (*service)[1])
+		}
+	}
+	return nil
+}
+
+func (t *EventTemplate) execute(name string, data TemplateData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.compiled[name].Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering %s template: %v", name, err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Render the room, summary, image, service, t and extra tags, in that order
+func (t *EventTemplate) render(data TemplateData) (nostr.Tags, error) {
+	tags := nostr.Tags{}
+	for _, name := range []string{"room", "summary", "image", "service"} {
+		value, err := t.execute(name, data)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			tags = append(tags, nostr.Tag{name, value})
+		}
+	}
+
+	for i := range t.Hashtags {
+		value, err := t.execute(fmt.Sprintf("hashtags[%d]", i), data)
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			tags = append(tags, nostr.Tag{"t", value})
+		}
+	}
+
+	for i, tag := range t.Tags {
+		rendered := nostr.Tag{tag[0]}
+		for j := range tag[1:] {
+			value, err := t.execute(fmt.Sprintf("tags[%d][%d]", i, j+1), data)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, value)
+		}
+		if rendered[1] != "" {
+			tags = append(tags, rendered)
+		}
+	}
+	return tags, nil
+}
+
+// Sample rooms used for validation and previews
+func sampleTemplateData(baseURL string) []TemplateData {
+	return []TemplateData{
+		{
+			RoomID:    "56377RedLizard",
+			Name:      "56377RedLizard",
+			Status:    "open",
+			BaseURL:   baseURL,
+			Presenter: "51e4b4648a549a62bd3e6670122b931cebc8723bc0ff7e8032fe087b00eb3dbd",
+		},
+		{
+			RoomID:  "56377RedLizard",
+			Name:    "56377RedLizard",
+			Status:  "closed",
+			BaseURL: baseURL,
+		},
+	}
+}
+
+// Print the tags a template produces for sample open and closed rooms
+func previewEventTemplate(path, baseURL string) error {
+	tmpl, err := loadEventTemplate(path)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range sampleTemplateData(baseURL) {
+		tags, err := tmpl.render(data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# %s room %s\n", data.Status, data.RoomID)
+		for _, tag := range tags {
+			out, err := json.Marshal(tag)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\n", out)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitcarrot/hivetalk/scheduler/engine"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Largest LNURL-pay response we read
+const maxLNURLResponseSize = 64 << 10
+
+// The parts of an LNURL-pay response (LUD-06) that matter for NIP-57
+type lnurlPayResponse struct {
+	Tag         string `json:"tag"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason"`
+	AllowsNostr bool   `json:"allowsNostr"`
+	NostrPubkey string `json:"nostrPubkey"`
+}
+
+// A lightning address check, cached until expires
+type zapCheck struct {
+	ok      bool
+	expires time.Time
+}
+
+// zapTagger picks which presenters a room's NIP-57 zap tags split tips
+// between: hosts with a lightning address, optionally only those whose
+// LNURL-pay endpoint says it accepts zaps. Endpoints are checked in the
+// background, never while a room is being announced, so a slow or
+// unreachable one can't hold up the poller. A nil tagger adds no zap tags.
+type zapTagger struct {
+	verify bool
+	ttl    time.Duration // how long a check is trusted
+	client *http.Client
+
+	mu       sync.Mutex
+	checks   map[string]zapCheck // lightning address -> last check
+	checking map[string]bool     // lightning addresses being checked
+}
+
+// Set up zap tags from ZAP_TAGS, ZAP_VERIFY_LNURL and ZAP_VERIFY_TTL.
+// Returns nil when ZAP_TAGS is false.
+func newZapTaggerFromEnv() (*zapTagger, error) {
+	if !engine.EnvBool("ZAP_TAGS", true) {
+		return nil, nil
+	}
+	ttl := engine.EnvDuration("ZAP_VERIFY_TTL", time.Hour)
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ZAP_VERIFY_TTL must be positive")
+	}
+	return newZapTagger(engine.EnvBool("ZAP_VERIFY_LNURL", false), ttl, &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: publicDialer().DialContext},
+	}), nil
+}
+
+func newZapTagger(verify bool, ttl time.Duration, client *http.Client) *zapTagger {
+	return &zapTagger{
+		verify:   verify,
+		ttl:      ttl,
+		client:   client,
+		checks:   make(map[string]zapCheck),
+		checking: make(map[string]bool),
+	}
+}
+
+// Lightning addresses are chosen by whoever joins a room, so LNURL
+// requests may only go to public addresses, never to the poller's own
+// host or network. The check runs after DNS resolution, on every
+// connection including redirects, so a name can't be rebound past it.
+func publicDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// Pubkeys of the hosts a room's zaps go to, in participant order
+func (z *zapTagger) recipients(participants []Participant) []string {
+	if z == nil {
+		return nil
+	}
+	recipients := []string{}
+	for _, participant := range participants {
+		if participant.Role != "Host" || participant.Lnaddress == "" {
+			continue
+		}
+		if z.verify && !z.allowsNostr(participant.Lnaddress) {
+			continue
+		}
+		recipients = append(recipients, participant.Pubkey)
+	}
+	return recipients
+}
+
+// Report whether a lightning address accepts zaps, as of its last check.
+// An address not checked yet, or checked more than a TTL ago, is checked
+// in the background; until the first check finishes it is left out.
+func (z *zapTagger) allowsNostr(lnaddress string) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	check, cached := z.checks[lnaddress]
+	if (!cached || !time.Now().Before(check.expires)) && !z.checking[lnaddress] {
+		z.checking[lnaddress] = true
+		go z.check(lnaddress)
+	}
+	return check.ok
+}
+
+func (z *zapTagger) check(lnaddress string) {
+	err := z.checkLNURL(context.Background(), lnaddress)
+	if err != nil {
+		log.Printf("Lightning address %s can't receive zaps: %v", lnaddress, err)
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.checks[lnaddress] = zapCheck{ok: err == nil, expires: time.Now().Add(z.ttl)}
+	delete(z.checking, lnaddress)
+}
+
+// Resolve a lightning address to its LNURL-pay endpoint (LUD-16) and check
+// that it allows Nostr zaps
+func (z *zapTagger) checkLNURL(ctx context.Context, lnaddress string) error {
+	name, domain, ok := strings.Cut(lnaddress, "@")
+	if !ok || name == "" || domain == "" || strings.ContainsAny(domain, "/?#") {
+		return fmt.Errorf("not a lightning address")
+	}
+
+	url := "https://" + domain + "/.well-known/lnurlp/" + name
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("accept", "application/json")
+
+	resp, err := z.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status code %d", url, resp.StatusCode)
+	}
+
+	var pay lnurlPayResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxLNURLResponseSize)).Decode(&pay); err != nil {
+		return fmt.Errorf("error parsing %s: %v", url, err)
+	}
+	if pay.Status == "ERROR" {
+		return fmt.Errorf("%s returned error: %s", url, pay.Reason)
+	}
+	if pay.Tag != "payRequest" {
+		return fmt.Errorf("%s is not an LNURL-pay endpoint", url)
+	}
+	if !pay.AllowsNostr || !nostr.IsValidPublicKeyHex(pay.NostrPubkey) {
+		return fmt.Errorf("%s doesn't allow Nostr zaps", url)
+	}
+	return nil
+}
+
+// NIP-57 zap tags splitting tips between recipients. A single recipient
+// gets everything, so weights are only added when there are several.
+func zapTags(recipients []string, relayURLs []string) nostr.Tags {
+	relay := ""
+	if len(relayURLs) > 0 {
+		relay = relayURLs[0]
+	}
+	tags := nostr.Tags{}
+	for _, pubkey := range recipients {
+		tag := nostr.Tag{"zap", pubkey, relay}
+		if len(recipients) > 1 {
+			tag = append(tag, "1")
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const zapPubkey = "51e4b4648a549a62bd3e6670122b931cebc8723bc0ff7e8032fe087b00eb3dbd"
+
+func TestZapVerificationRunsInTheBackground(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		if r.URL.Path != "/.well-known/lnurlp/giraffe" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"tag":"payRequest","allowsNostr":true,"nostrPubkey":"` + zapPubkey + `"}`))
+	}))
+	defer server.Close()
+	domain := strings.TrimPrefix(server.URL, "https://")
+
+	z := newZapTagger(true, time.Hour, server.Client())
+	hosts := []Participant{
+		{Pubkey: "host1", Role: "Host", Lnaddress: "giraffe@" + domain},
+		{Pubkey: "host2", Role: "Host", Lnaddress: "nobody@" + domain},
+	}
+
+	// The endpoint hasn't answered, yet recipients returns right away
+	if got := z.recipients(hosts); len(got) != 0 {
+		t.Errorf("recipients before any check finished = %v", got)
+	}
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := z.recipients(hosts)
+		if reflect.DeepEqual(got, []string{"host1"}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recipients = %v, want only the address that allows zaps", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestZapChecksStayOffPrivateNetworks(t *testing.T) {
+	for address, want := range map[string]bool{
+		"8.8.8.8":     true,
+		"2606:4700::": true,
+		"127.0.0.1":   false,
+		"10.1.2.3":    false,
+		"192.168.0.1": false,
+		"169.254.1.1": false,
+		"0.0.0.0":     false,
+		"::1":         false,
+		"fd00::1":     false,
+	} {
+		if got := publicIP(net.ParseIP(address)); got != want {
+			t.Errorf("publicIP(%s) = %v, want %v", address, got, want)
+		}
+	}
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	t.Setenv("ZAP_TAGS", "true")
+	z, err := newZapTaggerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = z.checkLNURL(context.Background(), "giraffe@"+strings.TrimPrefix(server.URL, "https://"))
+	if err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("checking a loopback endpoint: err = %v", err)
+	}
+}